@@ -16,29 +16,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
         "strings"
         "strconv"
         "regexp"
         "github.com/prometheus/client_golang/prometheus"
 )
 
-func AccountsData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o %A|%a|%T|%C")
-        stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func AccountsData() ([]byte, error) {
+        return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "-o %A|%a|%T|%C"}))
 }
 
 type JobMetrics struct {
@@ -88,10 +73,10 @@ type AccountsCollector struct {
 func NewAccountsCollector() *AccountsCollector {
         labels := []string{"account"}
         return &AccountsCollector{
-                pending: prometheus.NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
-                running: prometheus.NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
-                running_cpus: prometheus.NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
-                suspended: prometheus.NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
+                pending: NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
+                running: NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
+                running_cpus: NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
+                suspended: NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
         }
 }
 
@@ -102,8 +87,12 @@ func (ac *AccountsCollector) Describe(ch chan<- *prometheus.Desc) {
         ch <- ac.suspended
 }
 
-func (ac *AccountsCollector) Collect(ch chan<- prometheus.Metric) {
-        am := ParseAccountsMetrics(AccountsData())
+func (ac *AccountsCollector) Update(ch chan<- prometheus.Metric) error {
+        data, err := AccountsData()
+        if err != nil {
+                return err
+        }
+        am := ParseAccountsMetrics(data)
         for a := range am {
                 if am[a].pending > 0 {
                         ch <- prometheus.MustNewConstMetric(ac.pending, prometheus.GaugeValue, am[a].pending, a)
@@ -118,4 +107,14 @@ func (ac *AccountsCollector) Collect(ch chan<- prometheus.Metric) {
                         ch <- prometheus.MustNewConstMetric(ac.suspended, prometheus.GaugeValue, am[a].suspended, a)
                 }
         }
+        return nil
+}
+
+// Parse returns the jobs per account as parsed from squeue, see DebugParser
+func (ac *AccountsCollector) Parse() (interface{}, error) {
+        data, err := AccountsData()
+        if err != nil {
+                return nil, err
+        }
+        return ParseAccountsMetrics(data), nil
 }
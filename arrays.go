@@ -0,0 +1,102 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type ArraysMetrics struct {
+	// array tasks per normalized state, see NormalizeJobState
+	tasks map[string]float64
+	// distinct array jobs with at least one task in the queue
+	jobs float64
+}
+
+// Execute squeue to get the array job ID, the array task ID and the state
+// of every job, -r prints every task of an array on its own line
+func ArraysData() ([]byte, error) {
+	return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "-o", "%F|%K|%T"}))
+}
+
+func ArraysGetMetrics() (*ArraysMetrics, error) {
+	data, err := ArraysData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseArraysMetrics(data), nil
+}
+
+// ParseArraysMetrics counts the tasks of array jobs per state and the
+// distinct array jobs in lines of "ArrayJobID|ArrayTaskID|State". Jobs which
+// are not part of an array have no task ID, "N/A", and are skipped.
+func ParseArraysMetrics(input []byte) *ArraysMetrics {
+	am := ArraysMetrics{tasks: make(map[string]float64)}
+	arrays := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 || fields[1] == "N/A" || fields[1] == "" {
+			continue
+		}
+		am.tasks[NormalizeJobState(fields[2])]++
+		arrays[fields[0]] = true
+	}
+	am.jobs = float64(len(arrays))
+	return &am
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm array job metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewArraysCollector() *ArraysCollector {
+	return &ArraysCollector{
+		tasks: NewDesc("slurm_array_tasks", "Tasks of array jobs in the queue per state", []string{"state"}, nil),
+		jobs:  NewDesc("slurm_array_jobs", "Array jobs with tasks in the queue", nil, nil),
+	}
+}
+
+type ArraysCollector struct {
+	tasks *prometheus.Desc
+	jobs  *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (ac *ArraysCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ac.tasks
+	ch <- ac.jobs
+}
+
+func (ac *ArraysCollector) Update(ch chan<- prometheus.Metric) error {
+	am, err := ArraysGetMetrics()
+	if err != nil {
+		return err
+	}
+	for state, count := range am.tasks {
+		ch <- prometheus.MustNewConstMetric(ac.tasks, prometheus.GaugeValue, count, state)
+	}
+	ch <- prometheus.MustNewConstMetric(ac.jobs, prometheus.GaugeValue, am.jobs)
+	return nil
+}
+
+// Parse returns the array job tasks as parsed from squeue, see DebugParser
+func (ac *ArraysCollector) Parse() (interface{}, error) {
+	return ArraysGetMetrics()
+}
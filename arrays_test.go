@@ -0,0 +1,32 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestArraysGetMetrics(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"squeue -a -r -h -o %F|%K|%T": "test_data/squeue_arrays.txt",
+	})()
+	am, err := ArraysGetMetrics()
+	assert.NoError(t, err)
+	// jobs 4720 and 4740 are no array jobs
+	assert.Equal(t, map[string]float64{"running": 2, "pending": 5, "suspended": 1}, am.tasks)
+	assert.Equal(t, 3.0, am.jobs)
+}
@@ -0,0 +1,129 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+// Limits are set per association, i.e. per account or per user of an
+// account, and per TRES
+type assocLimitKey struct {
+	account string
+	user    string
+	tres    string
+}
+
+// Execute sacctmgr to get the GrpTRES limits of all associations
+func AssocData() ([]byte, error) {
+	return Execute("sacctmgr", []string{"-n", "-P", "show", "assoc", "format=Account,User,GrpTRES"})
+}
+
+// ParseGrpTres extracts the limits of a TRES string like
+// "cpu=100,mem=500G,gres/gpu=8,gres/gpu:a100=4". GPUs are summed like the
+// allocated GPUs of a job, memory is converted into bytes and other GRES
+// are reported by their name, e.g. "gres/fpga=2" as "fpga".
+func ParseGrpTres(tres string) map[string]float64 {
+	limits := make(map[string]float64)
+	if gpus, _ := ParseGpuTres(tres); gpus > 0 {
+		limits["gpu"] = gpus
+	}
+	for _, part := range strings.Split(tres, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "gres/gpu") {
+			continue
+		}
+		name := strings.TrimPrefix(kv[0], "gres/")
+		// typed GRES other than GPUs are skipped, their untyped entry counts
+		if strings.Contains(name, ":") {
+			continue
+		}
+		var limit float64
+		var err error
+		if name == "mem" {
+			limit, err = ParseTresMemory(kv[1])
+		} else {
+			limit, err = strconv.ParseFloat(kv[1], 64)
+		}
+		if err == nil {
+			limits[name] = limit
+		}
+	}
+	return limits
+}
+
+// ParseAssocLimits parses lines of "Account|User|GrpTRES" as printed by
+// sacctmgr. Limits of an account have an empty user, associations without
+// GrpTRES are skipped.
+func ParseAssocLimits(input []byte) map[assocLimitKey]float64 {
+	limits := make(map[assocLimitKey]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 || strings.TrimSpace(fields[2]) == "" {
+			continue
+		}
+		account := strings.TrimSpace(fields[0])
+		user := strings.TrimSpace(fields[1])
+		for tres, limit := range ParseGrpTres(strings.TrimSpace(fields[2])) {
+			limits[assocLimitKey{account, user, tres}] = limit
+		}
+	}
+	return limits
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * limits of the associations into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewAssocCollector() *AssocCollector {
+	return &AssocCollector{
+		grpTres: NewDesc("slurm_assoc_grptres_limit", "GrpTRES limit of an account or a user of an account per TRES", []string{"account", "user", "tres"}, nil),
+	}
+}
+
+type AssocCollector struct {
+	grpTres *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (ac *AssocCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ac.grpTres
+}
+
+func (ac *AssocCollector) Update(ch chan<- prometheus.Metric) error {
+	data, err := AssocData()
+	if err != nil {
+		return err
+	}
+	for key, limit := range ParseAssocLimits(data) {
+		ch <- prometheus.MustNewConstMetric(ac.grpTres, prometheus.GaugeValue, limit, key.account, key.user, key.tres)
+	}
+	return nil
+}
+
+// Parse returns the association limits as parsed from sacctmgr, see
+// DebugParser
+func (ac *AssocCollector) Parse() (interface{}, error) {
+	data, err := AssocData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseAssocLimits(data), nil
+}
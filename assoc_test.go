@@ -0,0 +1,41 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseAssocLimits(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sacctmgr -n -P show assoc format=Account,User,GrpTRES": "test_data/sacctmgr_assoc.txt",
+	})()
+	data, err := AssocData()
+	if err != nil {
+		t.Fatalf("Can not run sacctmgr: %v", err)
+	}
+	assert.Equal(t, map[assocLimitKey]float64{
+		{"physics", "", "cpu"}:        512,
+		{"physics", "", "gpu"}:        16,
+		{"physics", "", "mem"}:        2 << 40,
+		{"physics", "alice", "gpu"}:   6,
+		{"chemistry", "", "cpu"}:      256,
+		{"chemistry", "", "fpga"}:     2,
+		{"chemistry", "", "node"}:     8,
+		{"chemistry", "carol", "gpu"}: 2,
+	}, ParseAssocLimits(data))
+}
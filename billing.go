@@ -0,0 +1,120 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Execute sacct, or squeue if configured as source of the running jobs, to
+// get the partition and the TRES allocated to running jobs
+func BillingData() ([]byte, error) {
+	if *runningSource == "squeue" {
+		return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "--states=RUNNING", "-O", "JobID:30,Partition:100,tres-alloc:200"}))
+	}
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--format=JobID,Partition,AllocTRES", "--state=RUNNING", "--noheader", "--parsable2"}))
+}
+
+func BillingGetMetrics() (map[string]float64, error) {
+	data, err := BillingData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseBillingMetrics(data), nil
+}
+
+// ParseTresBilling returns the billing of a TRES string, e.g. 12 of
+// "billing=12,cpu=8,gres/gpu=1", as weighted by the TRESBillingWeights of the
+// partition. Without billing, e.g. for TRES of old jobs, it returns 0.
+func ParseTresBilling(tres string) float64 {
+	for _, part := range strings.Split(tres, ",") {
+		if strings.HasPrefix(part, "billing=") {
+			billing, _ := strconv.ParseFloat(strings.TrimPrefix(part, "billing="), 64)
+			return billing
+		}
+	}
+	return 0
+}
+
+// ParseBillingMetrics parses the job ID, the partition and the allocated
+// TRES of running jobs, separated by "|" as printed by sacct or by spaces as
+// printed by squeue, and sums the billing per partition. Every job ID is
+// counted once. The billing is the one of the whole job, it is not split
+// across the nodes of the job, thus it is not exported per node.
+func ParseBillingMetrics(input []byte) map[string]float64 {
+	partitions := make(map[string]float64)
+	jobs := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			fields = strings.Fields(line)
+		}
+		if len(fields) < 3 || jobs[fields[0]] {
+			continue
+		}
+		jobs[fields[0]] = true
+		partition := strings.TrimSpace(fields[1])
+		if !PartitionSelected(partition) {
+			continue
+		}
+		partitions[partition] += ParseTresBilling(strings.TrimSpace(fields[2]))
+	}
+	return partitions
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * billing of the running jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewBillingCollector() *BillingCollector {
+	return &BillingCollector{
+		partition:       NewDesc("slurm_partition_billing", "Billing of the TRES allocated to running jobs per partition", []string{"partition"}, nil),
+		partitionSeries: NewRecentSeries(),
+	}
+}
+
+type BillingCollector struct {
+	partition *prometheus.Desc
+	// partitions exported with 0 after their last running job
+	partitionSeries *RecentSeries
+}
+
+// Send all metric descriptions
+func (bc *BillingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bc.partition
+}
+
+func (bc *BillingCollector) Update(ch chan<- prometheus.Metric) error {
+	partitions, err := BillingGetMetrics()
+	if err != nil {
+		return err
+	}
+	for partition, billing := range bc.partitionSeries.Fill(time.Now(), partitions) {
+		ch <- prometheus.MustNewConstMetric(bc.partition, prometheus.GaugeValue, billing, partition)
+	}
+	return nil
+}
+
+// Parse returns the billing per partition, without the partitions kept by the
+// zero retention, see DebugParser
+func (bc *BillingCollector) Parse() (interface{}, error) {
+	return BillingGetMetrics()
+}
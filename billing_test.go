@@ -0,0 +1,46 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseBillingMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_billing.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// job 4712 is printed twice, job 4715 has no TRES
+	assert.Equal(t, map[string]float64{"gpu": 28, "main": 64, "debug": 0}, ParseBillingMetrics(data))
+	assert.Equal(t, 12.0, ParseTresBilling("billing=12,cpu=8,gres/gpu=1"))
+	assert.Equal(t, 0.0, ParseTresBilling("cpu=1,mem=512M"))
+}
+
+func TestBillingGetMetricsSqueue(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"squeue -a -r -h --states=RUNNING -O JobID:30,Partition:100,tres-alloc:200": "test_data/squeue_billing_running.txt",
+	})()
+	defer flag.Set("slurm.running-source", "sacct")
+
+	flag.Set("slurm.running-source", "squeue")
+	partitions, err := BillingGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"gpu": 24, "main": 64}, partitions)
+}
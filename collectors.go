@@ -0,0 +1,499 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Label value of the users beyond the configured user metrics limit
+const otherUsers = "__other__"
+
+// LimitUsers keeps the values of the users with the highest values, up to the
+// configured user metrics limit, and sums the values of all other users into
+// the "__other__" user. Without a limit the values are returned as is.
+func LimitUsers(values map[string]float64) map[string]float64 {
+	if *userMetricsLimit <= 0 || len(values) <= *userMetricsLimit {
+		return values
+	}
+	users := make([]string, 0, len(values))
+	for user := range values {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if values[users[i]] != values[users[j]] {
+			return values[users[i]] > values[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	limited := make(map[string]float64)
+	for i, user := range users {
+		if i < *userMetricsLimit {
+			limited[user] = values[user]
+		} else {
+			limited[otherUsers] += values[user]
+		}
+	}
+	return limited
+}
+
+// LimitedCounters limits the users of per user counters, e.g. the GPU
+// seconds, to the configured user metrics limit without breaking them as
+// counters. Unlike LimitUsers, the exported users do not follow the ranking
+// of every collection: a user keeps its series while it is reported and new
+// users get a series while the limit is not reached, the highest values
+// first. All further users are folded into "__other__", which only grows by
+// the increase of the folded users. Several counters of the same users, e.g.
+// the count and the time of the RPCs per user, share the exported users.
+type LimitedCounters struct {
+	sync.Mutex
+	exported map[string]bool
+	// last values of the folded users per counter
+	folded map[string][]float64
+	other  []float64
+}
+
+func NewLimitedCounters() *LimitedCounters {
+	return &LimitedCounters{exported: make(map[string]bool), folded: make(map[string][]float64)}
+}
+
+// Limit returns the values of the counters limited to the exported users and
+// "__other__", new users are ranked by the values of the first counter. A
+// user no longer reported is forgotten. Without a limit the values are
+// returned as is.
+func (lc *LimitedCounters) Limit(counters ...map[string]float64) []map[string]float64 {
+	if *userMetricsLimit <= 0 || len(counters) == 0 {
+		return counters
+	}
+	lc.Lock()
+	defer lc.Unlock()
+	if len(lc.other) != len(counters) {
+		lc.other = make([]float64, len(counters))
+	}
+	reported := make(map[string]bool)
+	for _, values := range counters {
+		for user := range values {
+			reported[user] = true
+		}
+	}
+	for user := range lc.exported {
+		if !reported[user] {
+			delete(lc.exported, user)
+		}
+	}
+	for user := range lc.folded {
+		if !reported[user] {
+			delete(lc.folded, user)
+		}
+	}
+	var users []string
+	for user := range reported {
+		if _, folded := lc.folded[user]; !lc.exported[user] && !folded {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if counters[0][users[i]] != counters[0][users[j]] {
+			return counters[0][users[i]] > counters[0][users[j]]
+		}
+		return users[i] < users[j]
+	})
+	for _, user := range users {
+		if len(lc.exported) < *userMetricsLimit {
+			lc.exported[user] = true
+		} else {
+			lc.folded[user] = make([]float64, len(counters))
+		}
+	}
+	limited := make([]map[string]float64, len(counters))
+	for i, values := range counters {
+		limited[i] = make(map[string]float64)
+		for user, value := range values {
+			if lc.exported[user] {
+				limited[i][user] = value
+				continue
+			}
+			// a value below the last one is a restarted counter
+			increase := value - lc.folded[user][i]
+			if increase < 0 {
+				increase = value
+			}
+			lc.other[i] += increase
+			lc.folded[user][i] = value
+		}
+		if len(lc.folded) > 0 || lc.other[i] > 0 {
+			limited[i][otherUsers] = lc.other[i]
+		}
+	}
+	return limited
+}
+
+// RecentSeries remembers the label values of a metric, e.g. the users of
+// slurm_user_gpus_running, to keep exporting them with a value of 0 for the
+// configured zero retention after they disappeared from the output of Slurm.
+// Otherwise the series of a user ends with the last job, which breaks rate()
+// and alerts on the series.
+type RecentSeries struct {
+	sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func NewRecentSeries() *RecentSeries {
+	return &RecentSeries{lastSeen: make(map[string]time.Time)}
+}
+
+// Fill returns the values completed by a 0 for every label value seen within
+// the zero retention, label values seen before are forgotten. Without a
+// retention the values are returned as is.
+func (rs *RecentSeries) Fill(now time.Time, values map[string]float64) map[string]float64 {
+	if *zeroRetention <= 0 {
+		return values
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	filled := make(map[string]float64, len(values))
+	for label, value := range values {
+		filled[label] = value
+		rs.lastSeen[label] = now
+	}
+	for label, seen := range rs.lastSeen {
+		if now.Sub(seen) > *zeroRetention {
+			delete(rs.lastSeen, label)
+			continue
+		}
+		if _, ok := filled[label]; !ok {
+			filled[label] = 0
+		}
+	}
+	return filled
+}
+
+// PartitionArguments appends the partitions configured on the command line to
+// the arguments of sinfo, squeue or sacct, which then only report these
+// partitions. Without partitions the arguments are returned as is.
+func PartitionArguments(arguments []string) []string {
+	if *partitionsFilter == "" {
+		return arguments
+	}
+	return append(arguments, "--partition="+*partitionsFilter)
+}
+
+// ClusterArguments appends the cluster configured on the command line to the
+// arguments of sacct and squeue, the other commands do not support it or
+// print a different format for it. Without a cluster the arguments are
+// returned as is.
+func ClusterArguments(command string, arguments []string) []string {
+	if *slurmCluster == "" || command != "sacct" && command != "squeue" {
+		return arguments
+	}
+	return append(arguments, "-M", *slurmCluster)
+}
+
+// StripClusterHeader removes the "CLUSTER: <name>" line which squeue prints
+// above the jobs of every cluster queried with -M
+func StripClusterHeader(output []byte) []byte {
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(line, "CLUSTER: ") {
+			lines = append(lines, line)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// PartitionSelected returns whether the metrics of a partition are exported,
+// i.e. no partitions are configured on the command line or the partition is
+// one of them.
+func PartitionSelected(partition string) bool {
+	if *partitionsFilter == "" {
+		return true
+	}
+	for _, p := range strings.Split(*partitionsFilter, ",") {
+		if strings.TrimSpace(p) == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// UserSelected returns whether the per user metrics of a user are exported,
+// i.e. the user is not excluded on the command line and either no users are
+// configured or the user is one of them. The jobs of other users still count
+// for the metrics which are not per user.
+func UserSelected(user string) bool {
+	for _, u := range strings.Split(*excludeUsers, ",") {
+		if strings.TrimSpace(u) == user {
+			return false
+		}
+	}
+	if *usersFilter == "" {
+		return true
+	}
+	for _, u := range strings.Split(*usersFilter, ",") {
+		if strings.TrimSpace(u) == user {
+			return true
+		}
+	}
+	return false
+}
+
+// UtilizationValue returns a utilization ratio between 0 and 1, or in
+// percent if configured on the command line
+func UtilizationValue(ratio float64) float64 {
+	if *utilizationPercent {
+		return ratio * 100
+	}
+	return ratio
+}
+
+// UtilizationHelp appends the scale of the utilization metrics, as
+// configured on the command line, to the help of a utilization metric
+func UtilizationHelp(help string) string {
+	if *utilizationPercent {
+		return help + ", in percent (0-100)"
+	}
+	return help + ", as ratio (0-1)"
+}
+
+// NewDesc creates the description of a metric like prometheus.NewDesc, the
+// "slurm" prefix of the metric name is replaced by the configured namespace
+// and the cluster name, if configured, is added as a constant label.
+func NewDesc(name string, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	if strings.HasPrefix(name, "slurm_") {
+		name = prometheus.BuildFQName(*metricsNamespace, "", strings.TrimPrefix(name, "slurm_"))
+	}
+	if *clusterName != "" {
+		labels := prometheus.Labels{"cluster": *clusterName}
+		for label, value := range constLabels {
+			labels[label] = value
+		}
+		constLabels = labels
+	}
+	return prometheus.NewDesc(name, help, variableLabels, constLabels)
+}
+
+// Collector is implemented by all collectors of the exporter. Update sends
+// the metrics of a scrape or returns an error if they can not be collected.
+type Collector interface {
+	Describe(ch chan<- *prometheus.Desc)
+	Update(ch chan<- prometheus.Metric) error
+}
+
+// scrapeCollector runs a collector on a scrape and reports whether it
+// succeeded. The metrics of a failing collector are dropped, so that their
+// series go stale instead of reporting misleading zeros.
+type scrapeCollector struct {
+	name      string
+	collector Collector
+	success   *prometheus.Desc
+}
+
+func newScrapeCollector(name string, collector Collector) *scrapeCollector {
+	return &scrapeCollector{
+		name:      name,
+		collector: collector,
+		success:   NewDesc("slurm_exporter_scrape_success", "Whether the last scrape of a collector succeeded", nil, prometheus.Labels{"collector": name}),
+	}
+}
+
+func (sc *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.collector.Describe(ch)
+	ch <- sc.success
+}
+
+func (sc *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	var err error
+	go func() {
+		err = sc.collector.Update(metrics)
+		close(metrics)
+	}()
+	var collected []prometheus.Metric
+	for metric := range metrics {
+		collected = append(collected, metric)
+	}
+	success := 1.0
+	if err != nil {
+		// missing commands are already reported on startup by CheckCommands
+		// and the opening of a circuit by recordCommand
+		if IsCommandNotFound(err) || IsCircuitOpen(err) {
+			slog.Debug("Failed to collect metrics", "collector", sc.name, "err", err)
+		} else {
+			slog.Error("Failed to collect metrics", "collector", sc.name, "err", err)
+		}
+		success = 0
+	} else {
+		for _, metric := range collected {
+			ch <- metric
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(sc.success, prometheus.GaugeValue, success)
+}
+
+// A collector which is enabled or disabled by its --collector.<name> flag
+type collectorFlag struct {
+	name    string
+	enabled *bool
+	create  func() Collector
+}
+
+func newCollectorFlag(name string, enabled bool, help string, create func() Collector) collectorFlag {
+	return collectorFlag{
+		name:    name,
+		enabled: flag.Bool("collector."+name, enabled, help),
+		create:  create,
+	}
+}
+
+// All collectors of the exporter. The association limits, billing, completed
+// jobs, slurmdbd, GPUs, GRES, jobs and preempted jobs collectors rely on the
+// Slurm accounting and the nvidia-smi collector on a GPU node, thus they are
+// disabled by default. The efficiency collector exports a series per job and
+// is disabled for its cardinality, the custom collector is enabled by the
+// custom metrics file.
+var collectorFlags = []collectorFlag{
+	newCollectorFlag("accounts", true, "Enable the jobs per account collector.",
+		func() Collector { return NewAccountsCollector() }),
+	newCollectorFlag("arrays", false, "Enable the array job tasks collector.",
+		func() Collector { return NewArraysCollector() }),
+	newCollectorFlag("assoc", false, "Enable the association limits collector.",
+		func() Collector { return NewAssocCollector() }),
+	newCollectorFlag("billing", false, "Enable the billing of running jobs per partition collector.",
+		func() Collector { return NewBillingCollector() }),
+	newCollectorFlag("completed", false, "Enable the completed jobs collector.",
+		func() Collector { return NewCompletedCollector() }),
+	newCollectorFlag("controller", true, "Enable the slurmctld version and boot time collector.",
+		func() Collector { return NewControllerCollector() }),
+	newCollectorFlag("cpus", true, "Enable the CPUs collector.",
+		func() Collector { return NewCPUsCollector() }),
+	newCollectorFlag("custom", false, "Enable the collector of the custom metrics, see --custom-metrics.file.",
+		func() Collector { return NewCustomCollector() }),
+	newCollectorFlag("dbd", false, "Enable the collector of the reachability of the slurmdbd.",
+		func() Collector { return NewDBDCollector() }),
+	newCollectorFlag("efficiency", false, "Enable the CPU and wall-clock efficiency per running job collector.",
+		func() Collector { return NewEfficiencyCollector() }),
+	newCollectorFlag("exporter", true, "Enable the collector of the Slurm command statistics.",
+		func() Collector { return NewExporterCollector() }),
+	newCollectorFlag("fairshare", true, "Enable the fair-share collector.",
+		func() Collector { return NewFairShareCollector() }),
+	newCollectorFlag("gpus", false, "Enable the GPUs collector.",
+		func() Collector { return NewGPUsCollector() }),
+	newCollectorFlag("gres", false, "Enable the generic resources collector.",
+		func() Collector { return NewGresCollector() }),
+	newCollectorFlag("jobs", false, "Enable the submitted and completed jobs counters.",
+		func() Collector { return NewJobsCollector() }),
+	newCollectorFlag("licenses", true, "Enable the licenses collector.",
+		func() Collector { return NewLicensesCollector() }),
+	newCollectorFlag("node", true, "Enable the per node collector.",
+		func() Collector { return NewNodeCollector() }),
+	newCollectorFlag("node-weights", false, "Enable the nodes per state and weight collector.",
+		func() Collector { return NewNodeWeightsCollector() }),
+	newCollectorFlag("nodes", true, "Enable the nodes per state collector.",
+		func() Collector { return NewNodesCollector() }),
+	newCollectorFlag("nvidia-smi", false, "Enable the GPU device utilization collector, runs nvidia-smi on the local or SSH host.",
+		func() Collector { return NewNvidiaSMICollector() }),
+	newCollectorFlag("partitions", true, "Enable the partitions collector.",
+		func() Collector { return NewPartitionsCollector() }),
+	newCollectorFlag("preempted", false, "Enable the preempted jobs collector.",
+		func() Collector { return NewPreemptedCollector() }),
+	newCollectorFlag("qos", true, "Enable the jobs and GPUs per QOS collector.",
+		func() Collector { return NewQOSCollector() }),
+	newCollectorFlag("queue", true, "Enable the jobs per state collector.",
+		func() Collector { return NewQueueCollector() }),
+	newCollectorFlag("reservations", true, "Enable the reservations collector.",
+		func() Collector { return NewReservationsCollector() }),
+	newCollectorFlag("scheduler", true, "Enable the scheduler collector.",
+		func() Collector { return NewSchedulerCollector() }),
+	newCollectorFlag("topology", false, "Enable the nodes per switch of the network topology collector.",
+		func() Collector { return NewTopologyCollector() }),
+	newCollectorFlag("users", true, "Enable the jobs per user collector.",
+		func() Collector { return NewUsersCollector() }),
+}
+
+// Exporter holds the collectors enabled on the command line
+type Exporter struct {
+	collectors map[string]Collector
+}
+
+// NewExporter creates all collectors enabled on the command line, it has
+// to be called once the flags are parsed.
+func NewExporter() *Exporter {
+	e := &Exporter{collectors: make(map[string]Collector)}
+	for _, c := range collectorFlags {
+		if *c.enabled {
+			e.collectors[c.name] = c.create()
+		}
+	}
+	return e
+}
+
+// Names returns the names of the enabled collectors in the order of their flags
+func (e *Exporter) Names() []string {
+	var names []string
+	for _, c := range collectorFlags {
+		if _, ok := e.collectors[c.name]; ok {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// Register registers all enabled collectors with the registry, only those
+// are run on a scrape. The success of every collector is reported by
+// slurm_exporter_scrape_success.
+func (e *Exporter) Register(registerer prometheus.Registerer) error {
+	for _, name := range e.Names() {
+		if err := registerer.Register(newScrapeCollector(name, e.collectors[name])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DryRun runs every enabled collector once and writes the Slurm commands it
+// executes and the metrics it collects in the text format to w. It returns
+// whether all Slurm commands succeeded.
+func (e *Exporter) DryRun(w io.Writer) (bool, error) {
+	commandLog = w
+	defer func() { commandLog = nil }()
+	failures := CommandFailures()
+	for _, name := range e.Names() {
+		fmt.Fprintf(w, "# collector %s\n", name)
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(newScrapeCollector(name, e.collectors[name])); err != nil {
+			return false, err
+		}
+		families, err := registry.Gather()
+		if err != nil {
+			return false, err
+		}
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+				return false, err
+			}
+		}
+	}
+	return CommandFailures() == failures, nil
+}
@@ -0,0 +1,245 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExporter(t *testing.T) {
+	defer flag.Set("collector.users", "true")
+	defer flag.Set("collector.gpus", "false")
+
+	flag.Set("collector.gpus", "true")
+	flag.Set("collector.users", "false")
+	e := NewExporter()
+	names := e.Names()
+	expected := []string{"accounts", "controller", "cpus", "exporter", "fairshare", "gpus", "licenses", "node", "nodes", "partitions", "qos", "queue", "reservations", "scheduler"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Enabled collectors %v, expected %v", names, expected)
+	}
+	if err := e.Register(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("Failed to register collectors: %v", err)
+	}
+}
+
+func TestNewDesc(t *testing.T) {
+	defer flag.Set("metrics.namespace", "slurm")
+
+	flag.Set("metrics.namespace", "hpc")
+	desc := NewDesc("slurm_nodes_alloc", "Allocated nodes", nil, nil)
+	if !strings.Contains(desc.String(), `fqName: "hpc_nodes_alloc"`) {
+		t.Fatalf("Unexpected description %s", desc)
+	}
+}
+
+func TestNewDescClusterName(t *testing.T) {
+	defer flag.Set("slurm.cluster-name", "")
+
+	flag.Set("slurm.cluster-name", "hpc1")
+	desc := NewDesc("slurm_nodes", "Nodes per state", []string{"state"}, nil)
+	if !strings.Contains(desc.String(), `constLabels: {cluster="hpc1"}`) {
+		t.Fatalf("Unexpected description %s", desc)
+	}
+}
+
+func TestUtilizationPercent(t *testing.T) {
+	assert.Equal(t, 0.25, UtilizationValue(0.25))
+	assert.Equal(t, "Allocated GPUs, as ratio (0-1)", UtilizationHelp("Allocated GPUs"))
+	defer flag.Set("metrics.utilization-percent", "false")
+	flag.Set("metrics.utilization-percent", "true")
+	assert.Equal(t, 25.0, UtilizationValue(0.25))
+	assert.Equal(t, "Allocated GPUs, in percent (0-100)", UtilizationHelp("Allocated GPUs"))
+}
+
+func TestLimitUsers(t *testing.T) {
+	defer flag.Set("slurm.user-metrics-limit", "0")
+
+	values := map[string]float64{"alice": 8, "bob": 1, "carol": 4, "dave": 2, "eve": 4}
+	if limited := LimitUsers(values); !reflect.DeepEqual(limited, values) {
+		t.Fatalf("Unexpected values without a limit: %v", limited)
+	}
+	flag.Set("slurm.user-metrics-limit", "2")
+	expected := map[string]float64{"alice": 8, "carol": 4, otherUsers: 7}
+	if limited := LimitUsers(values); !reflect.DeepEqual(limited, expected) {
+		t.Fatalf("Limited values %v, expected %v", limited, expected)
+	}
+}
+
+func TestLimitedCounters(t *testing.T) {
+	defer flag.Set("slurm.user-metrics-limit", "0")
+
+	lc := NewLimitedCounters()
+	values := map[string]float64{"alice": 8, "bob": 1, "carol": 4}
+	if limited := lc.Limit(values)[0]; !reflect.DeepEqual(limited, values) {
+		t.Fatalf("Unexpected values without a limit: %v", limited)
+	}
+	flag.Set("slurm.user-metrics-limit", "2")
+	expected := map[string]float64{"alice": 8, "carol": 4, otherUsers: 1}
+	if limited := lc.Limit(values)[0]; !reflect.DeepEqual(limited, expected) {
+		t.Fatalf("Limited values %v, expected %v", limited, expected)
+	}
+	// bob overtakes carol, but the exported users are kept and __other__
+	// only grows by the increase of bob
+	expected = map[string]float64{"alice": 9, "carol": 4, otherUsers: 11}
+	if limited := lc.Limit(map[string]float64{"alice": 9, "bob": 11, "carol": 4})[0]; !reflect.DeepEqual(limited, expected) {
+		t.Fatalf("Limited values %v, expected %v", limited, expected)
+	}
+	// carol is gone, dave takes her series, bob stays folded
+	expected = map[string]float64{"alice": 9, "dave": 2, otherUsers: 12}
+	if limited := lc.Limit(map[string]float64{"alice": 9, "bob": 12, "dave": 2})[0]; !reflect.DeepEqual(limited, expected) {
+		t.Fatalf("Limited values %v, expected %v", limited, expected)
+	}
+	// a restarted counter of bob adds its new value
+	expected = map[string]float64{"alice": 9, "dave": 2, otherUsers: 15}
+	if limited := lc.Limit(map[string]float64{"alice": 9, "bob": 3, "dave": 2})[0]; !reflect.DeepEqual(limited, expected) {
+		t.Fatalf("Limited values %v, expected %v", limited, expected)
+	}
+
+	// several counters share the users ranked by the first one
+	lc = NewLimitedCounters()
+	limited := lc.Limit(
+		map[string]float64{"alice": 8, "bob": 1, "carol": 4},
+		map[string]float64{"alice": 1, "bob": 9, "carol": 2})
+	expected = map[string]float64{"alice": 1, "carol": 2, otherUsers: 9}
+	if !reflect.DeepEqual(limited[1], expected) {
+		t.Fatalf("Limited values %v, expected %v", limited[1], expected)
+	}
+}
+
+func TestPartitionFilter(t *testing.T) {
+	defer flag.Set("slurm.partitions", "")
+
+	arguments := []string{"-h", "-o %C"}
+	if !reflect.DeepEqual(PartitionArguments(arguments), arguments) || !PartitionSelected("cpu") {
+		t.Fatalf("Partitions filtered without configured partitions")
+	}
+	flag.Set("slurm.partitions", "gpu,debug")
+	expected := []string{"-h", "-o %C", "--partition=gpu,debug"}
+	if filtered := PartitionArguments(arguments); !reflect.DeepEqual(filtered, expected) {
+		t.Fatalf("Arguments %v, expected %v", filtered, expected)
+	}
+	if !PartitionSelected("debug") || PartitionSelected("cpu") {
+		t.Fatalf("Unexpected partitions selected by gpu,debug")
+	}
+	qm := ParseQueueMetrics([]byte("1|RUNNING|gpu|None\n2|RUNNING|cpu|None\n"))
+	if _, ok := qm.partitions["cpu"]; ok {
+		t.Fatalf("Unexpected jobs of partition cpu: %v", qm.partitions)
+	}
+}
+
+func TestRecentSeries(t *testing.T) {
+	defer flag.Set("metrics.zero-retention", "0")
+	start := time.Now()
+	rs := NewRecentSeries()
+	// disabled by default
+	rs.Fill(start, map[string]float64{"alice": 2})
+	assert.Equal(t, map[string]float64{}, rs.Fill(start.Add(time.Minute), map[string]float64{}))
+
+	flag.Set("metrics.zero-retention", "1h")
+	assert.Equal(t, map[string]float64{"alice": 2, "bob": 1}, rs.Fill(start, map[string]float64{"alice": 2, "bob": 1}))
+	assert.Equal(t, map[string]float64{"alice": 0, "bob": 4}, rs.Fill(start.Add(time.Minute), map[string]float64{"bob": 4}))
+	assert.Equal(t, map[string]float64{"bob": 0}, rs.Fill(start.Add(61*time.Minute), map[string]float64{}))
+	assert.Equal(t, map[string]float64{}, rs.Fill(start.Add(3*time.Hour), map[string]float64{}))
+}
+
+func TestUserFilter(t *testing.T) {
+	defer flag.Set("slurm.users", "")
+	defer flag.Set("slurm.exclude-users", "")
+
+	if !UserSelected("root") {
+		t.Fatalf("Users filtered without configured users")
+	}
+	flag.Set("slurm.exclude-users", "root, nobody")
+	if UserSelected("root") || UserSelected("nobody") || !UserSelected("alice") {
+		t.Fatalf("Unexpected users selected by the exclusion of root,nobody")
+	}
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_pending.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	flag.Set("slurm.users", "alice,bob,root")
+	pending, userPending := ParsePendingGPUsMetrics(data)
+	// the GPUs of the other users are still part of the total
+	if pending != 19 || !reflect.DeepEqual(userPending, map[string]float64{"alice": 10, "bob": 8}) {
+		t.Fatalf("Pending GPUs %v and per user %v, expected 19 and the GPUs of alice and bob", pending, userPending)
+	}
+	if _, ok := ParseUsersMetrics([]byte("1|root|RUNNING|1\n2|alice|RUNNING|1\n"))["root"]; ok {
+		t.Fatalf("Unexpected jobs of the excluded user root")
+	}
+}
+
+// A collector which sends a metric before it fails if err is set
+type failingCollector struct {
+	desc *prometheus.Desc
+	err  error
+}
+
+func (fc failingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fc.desc
+}
+
+func (fc failingCollector) Update(ch chan<- prometheus.Metric) error {
+	ch <- prometheus.MustNewConstMetric(fc.desc, prometheus.GaugeValue, 0)
+	return fc.err
+}
+
+func TestScrapeCollector(t *testing.T) {
+	desc := NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil)
+	expected := `
+# HELP slurm_exporter_scrape_success Whether the last scrape of a collector succeeded
+# TYPE slurm_exporter_scrape_success gauge
+slurm_exporter_scrape_success{collector="gpus"} 0
+`
+	sc := newScrapeCollector("gpus", failingCollector{desc, errors.New("sinfo failed")})
+	if err := testutil.CollectAndCompare(sc, strings.NewReader(expected)); err != nil {
+		t.Fatalf("Unexpected metrics of a failing collector: %v", err)
+	}
+	sc = newScrapeCollector("gpus", failingCollector{desc, nil})
+	expected = `
+# HELP slurm_gpus_idle Idle GPUs
+# TYPE slurm_gpus_idle gauge
+slurm_gpus_idle 0
+` + strings.Replace(expected, "} 0", "} 1", 1)
+	if err := testutil.CollectAndCompare(sc, strings.NewReader(expected)); err != nil {
+		t.Fatalf("Unexpected metrics of a succeeding collector: %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer useFixtures(fixtureExecutor{"sdiag": "test_data/sdiag.txt"})()
+	e := &Exporter{collectors: map[string]Collector{"scheduler": NewSchedulerCollector()}}
+	var out strings.Builder
+	ok, err := e.DryRun(&out)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, out.String(), "# collector scheduler\n# sdiag (")
+	assert.Contains(t, out.String(), "slurm_exporter_scrape_success{collector=\"scheduler\"} 1\n")
+	// sinfo has no recorded output
+	e = &Exporter{collectors: map[string]Collector{"nodes": NewNodesCollector()}}
+	ok, err = e.DryRun(&out)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,123 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+type CompletedMetrics struct {
+	jobs float64
+	// sum of the elapsed time in seconds of the jobs whose elapsed time
+	// could be parsed, and the number of these jobs
+	elapsed      float64
+	elapsedCount float64
+}
+
+// SacctStartTime returns the sacct option to select the jobs of a time
+// window which ends now
+func SacctStartTime(window time.Duration) string {
+	return fmt.Sprintf("--starttime=now-%dseconds", int(window.Seconds()))
+}
+
+// Execute sacct to get the jobs completed within the configured time window.
+// Only the allocations are reported (-X), not their steps.
+func CompletedData() ([]byte, error) {
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--state=COMPLETED", SacctStartTime(*completedWindow), "--endtime=now", "--format=JobID,Partition,Elapsed", "--noheader", "--parsable2"}))
+}
+
+func CompletedGetMetrics() (map[string]*CompletedMetrics, error) {
+	data, err := CompletedData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseCompletedMetrics(data), nil
+}
+
+// ParseCompletedMetrics parses lines of "JobID|Partition|Elapsed" as printed
+// by sacct. Job steps like "4711.batch" are skipped, thus every job is
+// counted once even if sacct reports its steps. A job whose elapsed time can
+// not be parsed is counted, but left out of the mean elapsed time.
+func ParseCompletedMetrics(input []byte) map[string]*CompletedMetrics {
+	partitions := make(map[string]*CompletedMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 3 || strings.Contains(parts[0], ".") {
+			continue
+		}
+		partition := strings.TrimSpace(parts[1])
+		if !PartitionSelected(partition) {
+			continue
+		}
+		if _, ok := partitions[partition]; !ok {
+			partitions[partition] = &CompletedMetrics{}
+		}
+		partitions[partition].jobs++
+		if elapsed, err := ParseSlurmDuration(strings.TrimSpace(parts[2])); err == nil {
+			partitions[partition].elapsed += elapsed.Seconds()
+			partitions[partition].elapsedCount++
+		}
+	}
+	return partitions
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * metrics of the completed jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewCompletedCollector() *CompletedCollector {
+	labels := []string{"partition"}
+	return &CompletedCollector{
+		jobs:    NewDesc("slurm_jobs_completed", "Jobs completed within the configured time window", labels, nil),
+		elapsed: NewDesc("slurm_jobs_completed_elapsed_seconds_mean", "Mean elapsed time of the jobs completed within the configured time window", labels, nil),
+	}
+}
+
+type CompletedCollector struct {
+	jobs    *prometheus.Desc
+	elapsed *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (cc *CompletedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.jobs
+	ch <- cc.elapsed
+}
+
+func (cc *CompletedCollector) Update(ch chan<- prometheus.Metric) error {
+	partitions, err := CompletedGetMetrics()
+	if err != nil {
+		return err
+	}
+	for partition, cm := range partitions {
+		ch <- prometheus.MustNewConstMetric(cc.jobs, prometheus.GaugeValue, cm.jobs, partition)
+		if cm.elapsedCount > 0 {
+			ch <- prometheus.MustNewConstMetric(cc.elapsed, prometheus.GaugeValue, cm.elapsed/cm.elapsedCount, partition)
+		}
+	}
+	return nil
+}
+
+// Parse returns the completed jobs per partition as parsed from sacct, see
+// DebugParser
+func (cc *CompletedCollector) Parse() (interface{}, error) {
+	return CompletedGetMetrics()
+}
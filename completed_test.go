@@ -0,0 +1,46 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseCompletedMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_completed.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]*CompletedMetrics{
+		"gpu":  {jobs: 2, elapsed: 4 * 3600, elapsedCount: 2},
+		"main": {jobs: 2, elapsed: 24*3600 + 600, elapsedCount: 2},
+	}, ParseCompletedMetrics(data))
+
+	// a job without a valid elapsed time does not lower the mean
+	assert.Equal(t, map[string]*CompletedMetrics{
+		"gpu": {jobs: 2, elapsed: 3600, elapsedCount: 1},
+	}, ParseCompletedMetrics([]byte("4711|gpu|01:00:00\n4712|gpu|INVALID\n")))
+}
+
+func TestCompletedData(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sacct -a -X --state=COMPLETED --starttime=now-3600seconds --endtime=now --format=JobID,Partition,Elapsed --noheader --parsable2": "test_data/sacct_completed.txt",
+	})()
+	_, err := CompletedData()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,116 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+// ControllerInfo stores the version and the boot time of the slurmctld
+type ControllerInfo struct {
+	version  string
+	bootTime time.Time
+}
+
+// Execute scontrol to get the configuration of the slurmctld
+func ControllerData() ([]byte, error) {
+	return Execute("scontrol", []string{"show", "config"})
+}
+
+// ParseControllerInfo parses the "key = value" lines printed by scontrol show
+// config. The version and boot time are the ones of the running slurmctld,
+// not of the local Slurm commands like sinfo --version.
+func ParseControllerInfo(input []byte, location *time.Location) (*ControllerInfo, error) {
+	var ci ControllerInfo
+	for _, line := range strings.Split(string(input), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "SLURM_VERSION":
+			ci.version = value
+		case "BOOT_TIME":
+			if bootTime, err := time.ParseInLocation(slurmTimeLayout, value, location); err == nil {
+				ci.bootTime = bootTime
+			}
+		}
+	}
+	if ci.version == "" {
+		return nil, fmt.Errorf("scontrol show config: no SLURM_VERSION")
+	}
+	return &ci, nil
+}
+
+func ControllerGetInfo() (*ControllerInfo, error) {
+	data, err := ControllerData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseControllerInfo(data, time.Now().Location())
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * version and the boot time of the slurmctld into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewControllerCollector() *ControllerCollector {
+	return &ControllerCollector{
+		info:     NewDesc("slurm_controller_info", "Version of the slurmctld, the value is always 1", []string{"version"}, nil),
+		bootTime: NewDesc("slurm_controller_boot_time_seconds", "Start time of the slurmctld since the Unix epoch in seconds", nil, nil),
+	}
+}
+
+type ControllerCollector struct {
+	info     *prometheus.Desc
+	bootTime *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (cc *ControllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.info
+	ch <- cc.bootTime
+}
+
+func (cc *ControllerCollector) Update(ch chan<- prometheus.Metric) error {
+	ci, err := ControllerGetInfo()
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(cc.info, prometheus.GaugeValue, 1, ci.version)
+	if !ci.bootTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(cc.bootTime, prometheus.GaugeValue, float64(ci.bootTime.Unix()))
+	}
+	return nil
+}
+
+// Parse returns the version and boot time of the slurmctld, see DebugParser
+func (cc *ControllerCollector) Parse() (interface{}, error) {
+	ci, err := ControllerGetInfo()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Version  string    `json:"version"`
+		BootTime time.Time `json:"boot_time"`
+	}{ci.version, ci.bootTime}, nil
+}
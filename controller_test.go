@@ -0,0 +1,37 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseControllerInfo(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_config.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	ci, err := ParseControllerInfo(data, time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, "21.08.5", ci.version)
+	assert.Equal(t, time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), ci.bootTime)
+
+	_, err = ParseControllerInfo([]byte("slurm_load_ctl_conf error: Unable to contact slurm controller\n"), time.UTC)
+	assert.Error(t, err)
+}
@@ -17,9 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"strconv"
 	"strings"
 )
@@ -31,37 +28,52 @@ type CPUsMetrics struct {
 	total float64
 }
 
-func CPUsGetMetrics() *CPUsMetrics {
-	return ParseCPUsMetrics(CPUsData())
+func CPUsGetMetrics() (*CPUsMetrics, error) {
+	data, err := CPUsData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseCPUsMetrics(data), nil
 }
 
+// ParseCPUsMetrics extracts the allocated/idle/other/total CPUs from the
+// output of sinfo. Lines which do not consist of four numbers separated
+// by slashes are ignored; without any usable line all metrics are zero.
 func ParseCPUsMetrics(input []byte) *CPUsMetrics {
 	var cm CPUsMetrics
-	if strings.Contains(string(input), "/") {
-		splitted := strings.Split(strings.TrimSpace(string(input)), "/")
-		cm.alloc, _ = strconv.ParseFloat(splitted[0], 64)
-		cm.idle, _ = strconv.ParseFloat(splitted[1], 64)
-		cm.other, _ = strconv.ParseFloat(splitted[2], 64)
-		cm.total, _ = strconv.ParseFloat(splitted[3], 64)
+	for _, line := range strings.Split(string(input), "\n") {
+		splitted := strings.Split(strings.TrimSpace(line), "/")
+		if len(splitted) != 4 {
+			continue
+		}
+		var values [4]float64
+		valid := true
+		for i, field := range splitted {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				valid = false
+				break
+			}
+			values[i] = value
+		}
+		if valid {
+			cm.alloc, cm.idle, cm.other, cm.total = values[0], values[1], values[2], values[3]
+			break
+		}
 	}
 	return &cm
 }
 
 // Execute the sinfo command and return its output
-func CPUsData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %C")
-	stdout, err := cmd.StdoutPipe()
+func CPUsData() ([]byte, error) {
+	nodes, ok, err := SinfoJSONNodes()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	if ok {
+		return SinfoJSONCPUsLines(nodes), nil
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-o %C"}))
 }
 
 /*
@@ -72,10 +84,10 @@ func CPUsData() []byte {
 
 func NewCPUsCollector() *CPUsCollector {
 	return &CPUsCollector{
-		alloc: prometheus.NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
-		idle:  prometheus.NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
-		other: prometheus.NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
-		total: prometheus.NewDesc("slurm_cpus_total", "Total CPUs", nil, nil),
+		alloc: NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
+		idle:  NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
+		other: NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
+		total: NewDesc("slurm_cpus_total", "Total CPUs", nil, nil),
 	}
 }
 
@@ -93,10 +105,19 @@ func (cc *CPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.other
 	ch <- cc.total
 }
-func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := CPUsGetMetrics()
+func (cc *CPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	cm, err := CPUsGetMetrics()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.other, prometheus.GaugeValue, cm.other)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
+	return nil
+}
+
+// Parse returns the CPUs as parsed from sinfo, see DebugParser
+func (cc *CPUsCollector) Parse() (interface{}, error) {
+	return CPUsGetMetrics()
 }
@@ -19,6 +19,8 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCPUsMetrics(t *testing.T) {
@@ -28,9 +30,18 @@ func TestCPUsMetrics(t *testing.T) {
 		t.Fatalf("Can not open test data: %v", err)
 	}
 	data, err := ioutil.ReadAll(file)
-	t.Logf("%+v", ParseCPUsMetrics(data))
+	cm := ParseCPUsMetrics(data)
+	t.Logf("%+v", cm)
+	assert.Equal(t, CPUsMetrics{alloc: 5725, idle: 877, other: 34, total: 6636}, *cm)
+}
+
+func TestCPUsMetricsInvalid(t *testing.T) {
+	for _, input := range []string{"", "\n", "sinfo: error: Unable to contact slurm controller", "1/2/3", "a/b/c/d"} {
+		assert.Equal(t, CPUsMetrics{}, *ParseCPUsMetrics([]byte(input)), "input %q", input)
+	}
 }
 
 func TestCPUssGetMetrics(t *testing.T) {
-	t.Logf("%+v", CPUsGetMetrics())
+	metrics, err := CPUsGetMetrics()
+	t.Logf("%+v %v", metrics, err)
 }
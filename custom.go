@@ -0,0 +1,195 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CustomMetric is a metric defined in the custom metrics file. The command
+// is an argv array run like the Slurm commands, without a shell. Every line
+// of its output matching the regular expression is a sample: the named group
+// "value" is the value, all other named groups are labels. The values of
+// lines with the same labels are summed up.
+type CustomMetric struct {
+	Name    string   `json:"name"`
+	Help    string   `json:"help"`
+	Command []string `json:"command"`
+	Regex   string   `json:"regex"`
+	regexp  *regexp.Regexp
+	labels  []string
+}
+
+// The custom metrics loaded from the file set on the command line
+var customMetrics []*CustomMetric
+
+// LoadCustomMetrics reads the custom metrics from a JSON file of the form
+// {"metrics": [{"name": ..., "help": ..., "command": [...], "regex": ...}]}
+// and validates them, so that a broken file is reported on startup instead
+// of on every scrape.
+func LoadCustomMetrics(path string) ([]*CustomMetric, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Metrics []*CustomMetric `json:"metrics"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for _, cm := range config.Metrics {
+		if !model.IsValidMetricName(model.LabelValue(cm.Name)) {
+			return nil, fmt.Errorf("%s: invalid metric name %q", path, cm.Name)
+		}
+		if names[cm.Name] {
+			return nil, fmt.Errorf("%s: metric %s defined twice", path, cm.Name)
+		}
+		names[cm.Name] = true
+		if len(cm.Command) == 0 || cm.Command[0] == "" {
+			return nil, fmt.Errorf("%s: metric %s without command", path, cm.Name)
+		}
+		cm.regexp, err = regexp.Compile(cm.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%s: metric %s: %v", path, cm.Name, err)
+		}
+		hasValue := false
+		for _, group := range cm.regexp.SubexpNames()[1:] {
+			switch {
+			case group == "value":
+				hasValue = true
+			case group == "":
+			case !model.LabelName(group).IsValid():
+				return nil, fmt.Errorf("%s: metric %s: invalid label %q", path, cm.Name, group)
+			default:
+				cm.labels = append(cm.labels, group)
+			}
+		}
+		if !hasValue {
+			return nil, fmt.Errorf("%s: metric %s: regex without (?P<value>...) group", path, cm.Name)
+		}
+		if cm.Help == "" {
+			cm.Help = "Custom metric " + cm.Name
+		}
+	}
+	return config.Metrics, nil
+}
+
+// customSample is the summed up value of the lines with the same labels
+type customSample struct {
+	labels []string
+	value  float64
+}
+
+// ParseCustomMetric extracts the samples of a custom metric from the output
+// of its command. Lines which do not match or whose value is not a number
+// are skipped.
+func ParseCustomMetric(cm *CustomMetric, input []byte) []*customSample {
+	var samples []*customSample
+	byLabels := make(map[string]*customSample)
+	for _, line := range strings.Split(string(input), "\n") {
+		match := cm.regexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		var value float64
+		var err error
+		var labels []string
+		for i, group := range cm.regexp.SubexpNames() {
+			switch {
+			case i == 0 || group == "":
+			case group == "value":
+				value, err = strconv.ParseFloat(strings.TrimSpace(match[i]), 64)
+			default:
+				labels = append(labels, match[i])
+			}
+		}
+		if err != nil {
+			continue
+		}
+		key := strings.Join(labels, "\x00")
+		sample, ok := byLabels[key]
+		if !ok {
+			sample = &customSample{labels: labels}
+			byLabels[key] = sample
+			samples = append(samples, sample)
+		}
+		sample.value += value
+	}
+	return samples
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * custom metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewCustomCollector() *CustomCollector {
+	cc := &CustomCollector{descs: make(map[string]*prometheus.Desc)}
+	for _, cm := range customMetrics {
+		cc.descs[cm.Name] = NewDesc(cm.Name, cm.Help, cm.labels, nil)
+	}
+	return cc
+}
+
+type CustomCollector struct {
+	descs map[string]*prometheus.Desc
+}
+
+// Send all metric descriptions
+func (cc *CustomCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range cc.descs {
+		ch <- desc
+	}
+}
+
+// Update runs the command of every custom metric. A failing command fails
+// the whole collector, like the Slurm commands of the other collectors.
+func (cc *CustomCollector) Update(ch chan<- prometheus.Metric) error {
+	for _, cm := range customMetrics {
+		data, err := Execute(cm.Command[0], cm.Command[1:])
+		if err != nil {
+			return err
+		}
+		for _, sample := range ParseCustomMetric(cm, data) {
+			ch <- prometheus.MustNewConstMetric(cc.descs[cm.Name], prometheus.GaugeValue, sample.value, sample.labels...)
+		}
+	}
+	return nil
+}
+
+// Parse returns the samples of every custom metric by its name, see
+// DebugParser
+func (cc *CustomCollector) Parse() (interface{}, error) {
+	parsed := make(map[string][]*customSample)
+	for _, cm := range customMetrics {
+		data, err := Execute(cm.Command[0], cm.Command[1:])
+		if err != nil {
+			return nil, err
+		}
+		parsed[cm.Name] = ParseCustomMetric(cm, data)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,86 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCustomMetrics(t *testing.T) {
+	metrics, err := LoadCustomMetrics("test_data/custom_metrics.json")
+	if err != nil {
+		t.Fatalf("Failed to load custom metrics: %v", err)
+	}
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, []string{"sinfo", "-h", "-N", "-o", "%N %G"}, metrics[0].Command)
+	assert.Equal(t, []string{"node"}, metrics[0].labels)
+	assert.Equal(t, "Custom metric slurm_jobs_billing", metrics[1].Help)
+
+	dir, err := ioutil.TempDir("", "slurm-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, config := range []string{
+		`{"metrics": [{"name": "invalid-name", "command": ["sinfo"], "regex": "(?P<value>\\d+)"}]}`,
+		`{"metrics": [{"name": "slurm_x", "command": [], "regex": "(?P<value>\\d+)"}]}`,
+		`{"metrics": [{"name": "slurm_x", "command": ["sinfo"], "regex": "(\\d+)"}]}`,
+		`{"metrics": [{"name": "slurm_x", "command": ["sinfo"], "regex": "(?P<value>\\d+"}]}`,
+		`{"metrics": [{"name": "slurm_x", "command": ["sinfo"], "regex": "(?P<value>\\d+)"}, {"name": "slurm_x", "command": ["sinfo"], "regex": "(?P<value>\\d+)"}]}`,
+		`not json`,
+	} {
+		path := filepath.Join(dir, "custom.json")
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadCustomMetrics(path)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestCustomCollector(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sinfo -h -N -o %N %G": "test_data/sinfo_scratch.txt",
+		"squeue -h -o %P %b":   "test_data/squeue_billing.txt",
+	})()
+	defer func(previous []*CustomMetric) { customMetrics = previous }(customMetrics)
+
+	metrics, err := LoadCustomMetrics("test_data/custom_metrics.json")
+	if err != nil {
+		t.Fatalf("Failed to load custom metrics: %v", err)
+	}
+	customMetrics = metrics
+	expected := `
+# HELP slurm_jobs_billing Custom metric slurm_jobs_billing
+# TYPE slurm_jobs_billing gauge
+slurm_jobs_billing{partition="gpu"} 10
+slurm_jobs_billing{partition="main"} 1.5
+# HELP slurm_node_scratch_bytes Scratch space per node from the GRES
+# TYPE slurm_node_scratch_bytes gauge
+slurm_node_scratch_bytes{node="node001"} 500
+slurm_node_scratch_bytes{node="node002"} 1000
+`
+	collector := newScrapeCollector("custom", NewCustomCollector())
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_jobs_billing", "slurm_node_scratch_bytes"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Execute a cheap sacct query, which lists no jobs but has to reach the
+// slurmdbd like every other sacct call
+func DBDProbeData() ([]byte, error) {
+	return Execute("sacct", []string{"-a", "-X", "--starttime=now", "--endtime=now", "--format=JobID", "--noheader", "--parsable2"})
+}
+
+// DBDUp runs the sacct probe and returns whether the slurmdbd answered. An
+// empty output is a successful answer. Errors which do not tell about the
+// slurmdbd, i.e. a missing sacct or a probe skipped by the circuit breaker,
+// are returned.
+func DBDUp() (bool, error) {
+	_, err := DBDProbeData()
+	if err == nil {
+		return true, nil
+	}
+	if IsCommandNotFound(err) || IsCircuitOpen(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * reachability of the Slurm accounting storage into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewDBDCollector() *DBDCollector {
+	return &DBDCollector{
+		up: NewDesc("slurm_dbd_up", "Whether sacct can reach the slurmdbd", nil, nil),
+	}
+}
+
+type DBDCollector struct {
+	up *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (dc *DBDCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dc.up
+}
+
+func (dc *DBDCollector) Update(ch chan<- prometheus.Metric) error {
+	up, err := DBDUp()
+	if err != nil {
+		return err
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(dc.up, prometheus.GaugeValue, value)
+	return nil
+}
+
+// Parse returns whether the slurmdbd is reachable, see DebugParser
+func (dc *DBDCollector) Parse() (interface{}, error) {
+	return DBDUp()
+}
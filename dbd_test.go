@@ -0,0 +1,40 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDBDUp(t *testing.T) {
+	defer func(path string) { *sacctPath = path }(*sacctPath)
+
+	// an empty output is a successful answer
+	*sacctPath = "true"
+	up, err := DBDUp()
+	assert.NoError(t, err)
+	assert.True(t, up)
+
+	*sacctPath = "false"
+	up, err = DBDUp()
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	*sacctPath = "/nonexistent/sacct"
+	_, err = DBDUp()
+	assert.True(t, IsCommandNotFound(err))
+}
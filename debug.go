@@ -0,0 +1,157 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// DebugCollector is what a collector parsed from the Slurm commands, or the
+// error which failed it
+type DebugCollector struct {
+	Error  string      `json:"error,omitempty"`
+	Parsed interface{} `json:"parsed,omitempty"`
+}
+
+// DebugParser is implemented by the collectors to return what they parsed
+// from the Slurm commands, before their Update limits the users, fills in
+// the series of the zero retention or clamps the values. Parse must not
+// change the state of the collector, e.g. counters or last seen series.
+type DebugParser interface {
+	Parse() (interface{}, error)
+}
+
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// debugValue copies a parse result into maps, slices and plain values which
+// encoding/json can encode, including the unexported fields of its structs.
+// Struct fields are named by their JSON tag, if any, or else by their name.
+func debugValue(v reflect.Value) interface{} {
+	if v.CanInterface() && v.Type().Implements(jsonMarshaler) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return debugValue(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+				name = tag
+			}
+			fields[name] = debugValue(v.Field(i))
+		}
+		return fields
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		entries := make(map[string]interface{})
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[debugKey(iter.Key())] = debugValue(iter.Value())
+		}
+		return entries
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = debugValue(v.Index(i))
+		}
+		return values
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// debugKey formats a map key as JSON object key, the fields of a struct or
+// array key, e.g. the account and user of a fair-share, are joined by "/"
+func debugKey(key reflect.Value) string {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String()
+	case reflect.Struct:
+		parts := make([]string, key.NumField())
+		for i := range parts {
+			parts[i] = debugKey(key.Field(i))
+		}
+		return strings.Join(parts, "/")
+	case reflect.Array:
+		parts := make([]string, key.Len())
+		for i := range parts {
+			parts[i] = debugKey(key.Index(i))
+		}
+		return strings.Join(parts, "/")
+	}
+	return fmt.Sprint(debugValue(key))
+}
+
+// DebugGather parses the output of the Slurm commands of every enabled
+// collector once and returns the parse results by collector name. Unlike a
+// scrape, it does not run Update, thus the results are neither limited nor
+// filled nor clamped and the state of the collectors is left alone.
+func (e *Exporter) DebugGather() map[string]*DebugCollector {
+	result := make(map[string]*DebugCollector)
+	for _, name := range e.Names() {
+		dc := &DebugCollector{}
+		parser, ok := e.collectors[name].(DebugParser)
+		if !ok {
+			dc.Error = "collector does not report its parse results"
+			result[name] = dc
+			continue
+		}
+		parsed, err := parser.Parse()
+		if err != nil {
+			dc.Error = err.Error()
+		} else {
+			dc.Parsed = debugValue(reflect.ValueOf(parsed))
+		}
+		result[name] = dc
+	}
+	return result
+}
+
+// DebugHandler responds with the parse results of all collectors as JSON, to
+// inspect what the collectors parsed from the Slurm commands without reading
+// the text format of /metrics.
+func DebugHandler(e *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(e.DebugGather())
+	}
+}
@@ -0,0 +1,73 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	defer useFixtures(fixtureExecutor{"sdiag": "test_data/sdiag.txt"})()
+	defer flag.Set("slurm.user-metrics-limit", "0")
+	flag.Set("slurm.user-metrics-limit", "1")
+	e := &Exporter{collectors: map[string]Collector{
+		"gres":      NewGresCollector(),
+		"scheduler": NewSchedulerCollector(),
+	}}
+	rec := httptest.NewRecorder()
+	DebugHandler(e)(rec, httptest.NewRequest("GET", "/debug/metrics.json", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var result map[string]*DebugCollector
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	assert.Empty(t, result["scheduler"].Error)
+	parsed := result["scheduler"].Parsed.(map[string]interface{})
+	assert.Equal(t, 3.0, parsed["threads"])
+	// the parse results are not limited to the top users like the metrics
+	assert.Equal(t, map[string]interface{}{"root": 4500.0, "alice": 88.0}, parsed["rpc_user_count"])
+	// sinfo and sacct have no recorded output
+	assert.NotEmpty(t, result["gres"].Error)
+	assert.Nil(t, result["gres"].Parsed)
+}
+
+func TestDebugValue(t *testing.T) {
+	type key struct {
+		account string
+		user    string
+	}
+	assert.Equal(t, map[string]interface{}{
+		"physics/alice": map[string]interface{}{"total": 4.0, "types": map[string]interface{}{"a100": 4.0}, "nodes": []interface{}{"gpu001"}},
+	}, debugValue(reflect.ValueOf(map[key]*struct {
+		total float64
+		types map[string]float64
+		nodes []string
+	}{
+		{"physics", "alice"}: {4, map[string]float64{"a100": 4}, []string{"gpu001"}},
+	})))
+}
+
+func TestCollectorsDebugParser(t *testing.T) {
+	for _, c := range collectorFlags {
+		_, ok := c.create().(DebugParser)
+		assert.True(t, ok, "collector %s does not report its parse results", c.name)
+	}
+}
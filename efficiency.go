@@ -0,0 +1,127 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+type EfficiencyMetrics struct {
+	// CPU time used divided by the elapsed time times the allocated CPUs
+	cpu float64
+	// elapsed time divided by the time limit, -1 without a time limit
+	walltime float64
+}
+
+// Execute sacct to get the CPU time and the elapsed time of the running
+// jobs. Only the allocations are reported (-X), their TotalCPU is the sum of
+// the steps.
+func EfficiencyData() ([]byte, error) {
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--state=RUNNING", "--format=JobID,NCPUS,Elapsed,TotalCPU,Timelimit", "--noheader", "--parsable2"}))
+}
+
+func EfficiencyGetMetrics() (map[string]*EfficiencyMetrics, error) {
+	data, err := EfficiencyData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseEfficiencyMetrics(data, *efficiencyMinCPUs), nil
+}
+
+// ParseEfficiencyMetrics parses lines of
+// "JobID|NCPUS|Elapsed|TotalCPU|Timelimit" as printed by sacct. Jobs with
+// fewer than minCPUs allocated CPUs and jobs which did not run yet are
+// skipped. The CPU efficiency is an approximation, sacct accounts the CPU
+// time of a step once it has finished, thus it is low for a job whose
+// steps are still running.
+func ParseEfficiencyMetrics(input []byte, minCPUs int) map[string]*EfficiencyMetrics {
+	jobs := make(map[string]*EfficiencyMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 5 || strings.Contains(parts[0], ".") {
+			continue
+		}
+		cpus, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || cpus <= 0 || cpus < minCPUs {
+			continue
+		}
+		elapsed, err := ParseSlurmDuration(strings.TrimSpace(parts[2]))
+		if err != nil || elapsed <= 0 {
+			continue
+		}
+		totalCPU, err := ParseSlurmDuration(strings.TrimSpace(parts[3]))
+		if err != nil {
+			continue
+		}
+		em := EfficiencyMetrics{
+			cpu:      totalCPU.Seconds() / (elapsed.Seconds() * float64(cpus)),
+			walltime: -1,
+		}
+		// the time limit is "UNLIMITED" or "Partition_Limit" without a limit
+		if limit, err := ParseSlurmDuration(strings.TrimSpace(parts[4])); err == nil && limit > 0 {
+			em.walltime = elapsed.Seconds() / limit.Seconds()
+		}
+		jobs[strings.TrimSpace(parts[0])] = &em
+	}
+	return jobs
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * efficiency metrics of the running jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewEfficiencyCollector() *EfficiencyCollector {
+	labels := []string{"job"}
+	return &EfficiencyCollector{
+		cpu:      NewDesc("slurm_job_cpu_efficiency", UtilizationHelp("CPU time used by a running job divided by its elapsed time times its allocated CPUs"), labels, nil),
+		walltime: NewDesc("slurm_job_walltime_efficiency", UtilizationHelp("Elapsed time of a running job divided by its time limit"), labels, nil),
+	}
+}
+
+type EfficiencyCollector struct {
+	cpu      *prometheus.Desc
+	walltime *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (ec *EfficiencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ec.cpu
+	ch <- ec.walltime
+}
+
+func (ec *EfficiencyCollector) Update(ch chan<- prometheus.Metric) error {
+	jobs, err := EfficiencyGetMetrics()
+	if err != nil {
+		return err
+	}
+	for job, em := range jobs {
+		ch <- prometheus.MustNewConstMetric(ec.cpu, prometheus.GaugeValue, UtilizationValue(em.cpu), job)
+		// jobs without a time limit have no wall-clock efficiency
+		if em.walltime >= 0 {
+			ch <- prometheus.MustNewConstMetric(ec.walltime, prometheus.GaugeValue, UtilizationValue(em.walltime), job)
+		}
+	}
+	return nil
+}
+
+// Parse returns the efficiency per running job, as ratio, see DebugParser
+func (ec *EfficiencyCollector) Parse() (interface{}, error) {
+	return EfficiencyGetMetrics()
+}
@@ -0,0 +1,45 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseEfficiencyMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_efficiency.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs := ParseEfficiencyMetrics(data, 16)
+	t.Logf("%+v", jobs)
+	assert.Equal(t, map[string]*EfficiencyMetrics{
+		"4711": {cpu: 0.5, walltime: 0.5},
+		"4712": {cpu: 320.5 / 38400, walltime: -1},
+		"4715": {cpu: 0, walltime: -1},
+	}, jobs)
+	assert.Contains(t, ParseEfficiencyMetrics(data, 0), "4713")
+}
+
+func TestEfficiencyData(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sacct -a -X --state=RUNNING --format=JobID,NCPUS,Elapsed,TotalCPU,Timelimit --noheader --parsable2": "test_data/sacct_efficiency.txt",
+	})()
+	_, err := EfficiencyData()
+	assert.NoError(t, err)
+}
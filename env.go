@@ -0,0 +1,57 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Prefix of the environment variables setting the flags
+const envPrefix = "SLURM_EXPORTER_"
+
+// EnvName returns the environment variable of a flag: the flag name without
+// a leading "slurm.", upper case, with "." and "-" replaced by "_" and the
+// prefix prepended, e.g. SLURM_EXPORTER_CACHE_TTL for -slurm.cache-ttl and
+// SLURM_EXPORTER_COLLECTOR_GPUS for -collector.gpus.
+func EnvName(name string) string {
+	name = strings.TrimPrefix(name, "slurm.")
+	name = strings.NewReplacer(".", "_", "-", "_").Replace(name)
+	return envPrefix + strings.ToUpper(name)
+}
+
+// ApplyEnvironment sets every flag not given on the command line from its
+// environment variable, if set, thus the command line takes precedence. It
+// has to be called after parsing the command line.
+func ApplyEnvironment(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		value, ok := lookup(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q of %s: %v", value, EnvName(f.Name), setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,64 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "SLURM_EXPORTER_CACHE_TTL", EnvName("slurm.cache-ttl"))
+	assert.Equal(t, "SLURM_EXPORTER_COLLECTOR_NODE_WEIGHTS", EnvName("collector.node-weights"))
+	assert.Equal(t, "SLURM_EXPORTER_WEB_LISTEN_ADDRESS", EnvName("web.listen-address"))
+	// no two flags of the exporter share an environment variable
+	names := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if other, ok := names[EnvName(f.Name)]; ok {
+			t.Errorf("%s and %s share %s", f.Name, other, EnvName(f.Name))
+		}
+		names[EnvName(f.Name)] = f.Name
+	})
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	ttl := fs.Duration("slurm.cache-ttl", 0, "")
+	partitions := fs.String("slurm.partitions", "", "")
+	gpus := fs.Bool("collector.gpus", false, "")
+	env := map[string]string{
+		"SLURM_EXPORTER_CACHE_TTL":      "10s",
+		"SLURM_EXPORTER_PARTITIONS":     "gpu",
+		"SLURM_EXPORTER_COLLECTOR_GPUS": "true",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	assert.NoError(t, fs.Parse([]string{"-slurm.partitions=cpu"}))
+	assert.NoError(t, ApplyEnvironment(fs, lookup))
+	assert.Equal(t, 10*time.Second, *ttl)
+	// the command line takes precedence
+	assert.Equal(t, "cpu", *partitions)
+	assert.True(t, *gpus)
+
+	env["SLURM_EXPORTER_CACHE_TTL"] = "often"
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("slurm.cache-ttl", 0, "")
+	assert.Error(t, ApplyEnvironment(fs, lookup))
+}
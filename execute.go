@@ -0,0 +1,606 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The output of a command, reused until it expires
+type cacheEntry struct {
+	sync.Mutex
+	output  []byte
+	expires time.Time
+}
+
+var (
+	commandCacheMutex sync.Mutex
+	commandCache      = make(map[string]*cacheEntry)
+)
+
+// Cache TTLs of single commands configured on the command line, commands
+// not listed here use the global cache TTL
+var commandTTLs map[string]time.Duration
+
+// ParseCommandCacheTTLs parses the comma separated cache TTLs of single
+// commands, e.g. "sinfo=5m,sacct=10s"
+func ParseCommandCacheTTLs(ttls string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration)
+	for _, item := range strings.Split(ttls, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid command cache TTL %q, use command=duration", item)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid command cache TTL %q: %v", item, err)
+		}
+		parsed[strings.TrimSpace(kv[0])] = ttl
+	}
+	return parsed, nil
+}
+
+// CacheTTL returns the time the output of a command is reused
+func CacheTTL(command string) time.Duration {
+	if ttl, ok := commandTTLs[command]; ok {
+		return ttl
+	}
+	return *cacheTTL
+}
+
+// commandSlots limits the number of commands running at once to the
+// configured maximum, the other commands wait in acquire
+type commandSlots struct {
+	sync.Mutex
+	cond    *sync.Cond
+	running int
+}
+
+func newCommandSlots() *commandSlots {
+	cs := &commandSlots{}
+	cs.cond = sync.NewCond(&cs.Mutex)
+	return cs
+}
+
+var runningCommands = newCommandSlots()
+
+// Parent context of all commands, canceled on shutdown to kill the running
+// commands and to fail further ones
+var commandsContext, cancelCommands = context.WithCancel(context.Background())
+
+func (cs *commandSlots) acquire() {
+	cs.Lock()
+	defer cs.Unlock()
+	for *maxConcurrentCommands > 0 && cs.running >= *maxConcurrentCommands {
+		cs.cond.Wait()
+	}
+	cs.running++
+}
+
+func (cs *commandSlots) release() {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.running--
+	cs.cond.Signal()
+}
+
+// count returns the number of running commands
+func (cs *commandSlots) count() int {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.running
+}
+
+// StopCommands kills all running commands and fails all further commands,
+// then waits until the killed commands have exited or the context is done.
+// It returns whether all commands have exited.
+func StopCommands(ctx context.Context) bool {
+	cancelCommands()
+	for runningCommands.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// Upper bounds of the buckets of the command duration histogram, from fast
+// commands like scontrol up to sacct queries close to the scrape timeout
+var commandDurationBuckets = [...]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Statistics of a command, exported by the ExporterCollector
+type commandStats struct {
+	duration float64
+	failures float64
+	// histogram of all durations, the bucket counts are cumulative
+	durationCount   uint64
+	durationSum     float64
+	durationBuckets [len(commandDurationBuckets)]uint64
+	// executions killed by the timeout whose partial output was used
+	partial float64
+}
+
+var (
+	commandStatsMutex sync.Mutex
+	commandStatistics = make(map[string]*commandStats)
+)
+
+// recordCommand updates the statistics of a command after its execution
+func recordCommand(command string, duration time.Duration, err error) {
+	commandStatsMutex.Lock()
+	defer commandStatsMutex.Unlock()
+	stats, ok := commandStatistics[command]
+	if !ok {
+		stats = &commandStats{}
+		commandStatistics[command] = stats
+	}
+	stats.duration = duration.Seconds()
+	stats.durationCount++
+	stats.durationSum += stats.duration
+	for i, bound := range commandDurationBuckets {
+		if stats.duration <= bound {
+			stats.durationBuckets[i]++
+		}
+	}
+	if err != nil {
+		stats.failures++
+	}
+}
+
+// The circuit breaker of a command line. After the configured number of
+// failed executions since the last success, the circuit is open, i.e. the
+// command line is not executed, until openUntil.
+type circuit struct {
+	command             string
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+var (
+	circuitsMutex sync.Mutex
+	circuits      = make(map[string]*circuit)
+)
+
+// circuitKey returns the key of the circuit of a command line. Each command
+// line has its own circuit, thus e.g. a failing sacct query of the
+// completed jobs does not skip the sacct query of the running jobs.
+func circuitKey(command string, arguments []string) string {
+	return strings.Join(append([]string{command}, arguments...), "\x00")
+}
+
+// recordCircuit updates the circuit of a command line after an execution
+// by Execute. The retries of an execution count as a single failure.
+func recordCircuit(command string, arguments []string, err error) {
+	circuitsMutex.Lock()
+	defer circuitsMutex.Unlock()
+	key := circuitKey(command, arguments)
+	c, ok := circuits[key]
+	if !ok {
+		c = &circuit{command: command}
+		circuits[key] = c
+	}
+	if err == nil {
+		c.consecutiveFailures = 0
+		c.openUntil = time.Time{}
+		return
+	}
+	c.consecutiveFailures++
+	if *circuitFailures > 0 && c.consecutiveFailures >= *circuitFailures {
+		c.openUntil = time.Now().Add(*circuitCooldown)
+		slog.Warn("Slurm command failed repeatedly, skipping it for the cooldown", "argv", strings.Join(append([]string{command}, arguments...), " "), "failures", c.consecutiveFailures, "cooldown", *circuitCooldown)
+	}
+}
+
+// Error of a command which is skipped because its circuit is open
+type circuitOpenError struct {
+	argv  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s failed repeatedly, skipped until %s", e.argv, e.until.Format(time.RFC3339))
+}
+
+// IsCircuitOpen reports whether an error of Execute is caused by a command
+// which is skipped after repeated failures.
+func IsCircuitOpen(err error) bool {
+	_, ok := err.(*circuitOpenError)
+	return ok
+}
+
+// checkCircuit returns an error if the circuit of a command line is open.
+// Once the cooldown has passed the command is executed again, a single
+// further failure opens the circuit once more, a success closes it.
+func checkCircuit(command string, arguments []string, now time.Time) error {
+	circuitsMutex.Lock()
+	defer circuitsMutex.Unlock()
+	if c, ok := circuits[circuitKey(command, arguments)]; ok && now.Before(c.openUntil) {
+		return &circuitOpenError{strings.Join(append([]string{command}, arguments...), " "), c.openUntil}
+	}
+	return nil
+}
+
+// OpenCircuits returns the commands with at least one command line skipped
+// at the given time
+func OpenCircuits(now time.Time) map[string]bool {
+	circuitsMutex.Lock()
+	defer circuitsMutex.Unlock()
+	open := make(map[string]bool)
+	for _, c := range circuits {
+		if now.Before(c.openUntil) {
+			open[c.command] = true
+		}
+	}
+	return open
+}
+
+// DurationBuckets returns the cumulative count of executions per upper bound
+// of the command duration histogram
+func (s commandStats) DurationBuckets() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(commandDurationBuckets))
+	for i, bound := range commandDurationBuckets {
+		buckets[bound] = s.durationBuckets[i]
+	}
+	return buckets
+}
+
+// recordPartial counts the use of the partial output of a command killed by
+// the timeout, the execution itself is already counted as failure
+func recordPartial(command string) {
+	commandStatsMutex.Lock()
+	defer commandStatsMutex.Unlock()
+	if stats, ok := commandStatistics[command]; ok {
+		stats.partial++
+	}
+}
+
+// CommandStatistics returns a copy of the statistics of all executed commands
+func CommandStatistics() map[string]commandStats {
+	commandStatsMutex.Lock()
+	defer commandStatsMutex.Unlock()
+	statistics := make(map[string]commandStats)
+	for command, stats := range commandStatistics {
+		statistics[command] = *stats
+	}
+	return statistics
+}
+
+// CommandFailures returns the failed executions of all commands
+func CommandFailures() float64 {
+	var failures float64
+	for _, stats := range CommandStatistics() {
+		failures += stats.failures
+	}
+	return failures
+}
+
+// Execute runs a Slurm command and returns its standard output.
+// A command which can not be started, exits with a non-zero status or
+// runs longer than the configured command timeout is reported as an
+// error, so that a single failing command does not bring down the
+// whole exporter nor stall the scrape.
+//
+// With a cache TTL configured, the output of a successful command is
+// reused by all scrapes within the TTL. Concurrent scrapes wait for a
+// running command instead of starting it once more. The TTL may differ
+// per command, see CacheTTL.
+//
+// A command line which failed several times in a row is not executed for a
+// cooldown, to spare a recovering slurmctld, see checkCircuit.
+//
+// A failing command is retried up to the configured number of retries, each
+// failed attempt counts as failure in the statistics of the command.
+//
+// At most the configured number of commands run at once, further commands
+// wait until one of them has finished.
+func Execute(command string, arguments []string) ([]byte, error) {
+	ttl := CacheTTL(command)
+	if ttl <= 0 {
+		return executeWithTimeout(command, arguments)
+	}
+	key := strings.Join(append([]string{command}, arguments...), "\x00")
+	commandCacheMutex.Lock()
+	entry, ok := commandCache[key]
+	if !ok {
+		entry = &cacheEntry{}
+		commandCache[key] = entry
+	}
+	commandCacheMutex.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if time.Now().Before(entry.expires) {
+		return entry.output, nil
+	}
+	out, err := executeWithTimeout(command, arguments)
+	if err != nil {
+		return nil, err
+	}
+	entry.output = out
+	entry.expires = time.Now().Add(ttl)
+	return out, nil
+}
+
+// ExecutePartial runs a Slurm command like Execute. If the command is killed
+// by the timeout and partial output is enabled on the command line, the
+// complete lines it printed until then are returned instead of the error,
+// e.g. the running jobs sacct listed so far. Only line oriented parsers may
+// use it, a truncated JSON document can not be decoded anyway. The
+// execution still counts as failure of the command.
+func ExecutePartial(command string, arguments []string) ([]byte, error) {
+	out, err := Execute(command, arguments)
+	if err == nil || !*partialOutput {
+		return out, err
+	}
+	timeout, ok := err.(*commandTimeoutError)
+	if !ok {
+		return out, err
+	}
+	partial := timeout.output
+	if i := bytes.LastIndexByte(partial, '\n'); i >= 0 {
+		partial = partial[:i+1]
+	} else {
+		partial = nil
+	}
+	recordPartial(command)
+	slog.Warn("Slurm command timed out, using its partial output", "command", command, "bytes", len(partial))
+	return partial, nil
+}
+
+// Delay before the first retry of a failed command, doubled for every
+// further retry
+var commandRetryBackoff = 500 * time.Millisecond
+
+// executeWithTimeout runs a command and retries it up to the configured
+// number of retries if it fails, e.g. on a transient "Socket timed out" of
+// the slurmctld. Missing commands and commands killed by the timeout or the
+// shutdown are not retried, the latter to not prolong the scrape.
+func executeWithTimeout(command string, arguments []string) ([]byte, error) {
+	if err := checkCircuit(command, arguments, time.Now()); err != nil {
+		return nil, err
+	}
+	for retry := 0; ; retry++ {
+		out, timedOut, err := executeOnce(command, arguments)
+		if err == nil || timedOut || IsCommandNotFound(err) || retry >= *commandRetries || commandsContext.Err() != nil {
+			recordCircuit(command, arguments, err)
+			return out, err
+		}
+		backoff := commandRetryBackoff << uint(retry)
+		slog.Debug("Retrying failed Slurm command", "command", command, "retry", retry+1, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+	}
+}
+
+// executeOnce runs a command with the configured timeout and reports
+// whether it was killed by the timeout
+func executeOnce(command string, arguments []string) ([]byte, bool, error) {
+	// the time waiting for a slot does not count against the timeout
+	runningCommands.acquire()
+	defer runningCommands.release()
+	ctx := commandsContext
+	if *commandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *commandTimeout)
+		defer cancel()
+	}
+	out, err := ExecuteContext(ctx, command, arguments)
+	return out, ctx.Err() == context.DeadlineExceeded, err
+}
+
+// Error of a command which is not installed
+type commandNotFoundError struct {
+	path string
+}
+
+// Error of a command killed by the timeout with the output it printed
+// until then
+type commandTimeoutError struct {
+	argv   string
+	output []byte
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("%s: timed out", e.argv)
+}
+
+func (e *commandNotFoundError) Error() string {
+	return fmt.Sprintf("%s: command not found, install the Slurm commands or configure their path", e.path)
+}
+
+// IsCommandNotFound reports whether an error of Execute or ExecuteContext is
+// caused by a command which is not installed.
+func IsCommandNotFound(err error) bool {
+	_, ok := err.(*commandNotFoundError)
+	return ok
+}
+
+// CheckCommands logs the path of every Slurm command on startup, or that it
+// is missing. Commands run via SSH are not checked.
+func CheckCommands() {
+	if *sshHost != "" {
+		return
+	}
+	for _, command := range []string{"sacct", "sacctmgr", "scontrol", "sdiag", "sinfo", "squeue", "sshare"} {
+		path, err := exec.LookPath(CommandPath(command))
+		if err != nil {
+			slog.Warn("Slurm command not found, metrics depending on it are empty", "command", CommandPath(command))
+			continue
+		}
+		slog.Info("Slurm command found", "command", command, "path", path)
+	}
+}
+
+// CommandPath returns the path of a Slurm command as configured on the
+// command line, other commands are looked up in PATH.
+func CommandPath(command string) string {
+	switch command {
+	case "sacct":
+		return *sacctPath
+	case "sacctmgr":
+		return *sacctmgrPath
+	case "scontrol":
+		return *scontrolPath
+	case "sdiag":
+		return *sdiagPath
+	case "sinfo":
+		return *sinfoPath
+	case "squeue":
+		return *squeuePath
+	case "sshare":
+		return *ssharePath
+	}
+	return command
+}
+
+// Executor runs a single command and returns its standard output
+type Executor interface {
+	Execute(ctx context.Context, command string, arguments []string) ([]byte, error)
+}
+
+// The executor of all commands, tests replace it to feed recorded output
+// of the Slurm commands into the collectors.
+var executor Executor = commandExecutor{}
+
+// commandExecutor runs the commands locally or on the SSH host
+type commandExecutor struct{}
+
+func (commandExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	return executeContext(ctx, command, arguments)
+}
+
+// ExecuteContext runs a Slurm command like Execute, but kills it once the
+// context is done. The killed process is always waited for, hence no
+// zombie processes are left behind.
+func ExecuteContext(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	arguments = ClusterArguments(command, arguments)
+	start := time.Now()
+	out, err := executor.Execute(ctx, command, arguments)
+	if err == nil && command == "squeue" && *slurmCluster != "" {
+		out = StripClusterHeader(out)
+	}
+	duration := time.Since(start)
+	recordCommand(command, duration, err)
+	if commandLog != nil {
+		fmt.Fprintf(commandLog, "# %s (%s, err: %v)\n", CommandLine(command, arguments), duration, err)
+	}
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		slog.Debug("Executed command", "argv", CommandLine(command, arguments), "duration", duration, "err", err)
+	}
+	return out, err
+}
+
+// Writer to print every executed command to, set by the dry run
+var commandLog io.Writer
+
+// CommandLine returns the command line of a Slurm command as executed,
+// locally or via SSH
+func CommandLine(command string, arguments []string) string {
+	argv := append([]string{CommandPath(command)}, arguments...)
+	if *sshHost != "" {
+		argv = append([]string{"ssh"}, SSHArguments(CommandPath(command), arguments)...)
+	}
+	return strings.Join(argv, " ")
+}
+
+// ShellQuote quotes an argument for the shell on the remote host
+func ShellQuote(argument string) string {
+	return "'" + strings.Replace(argument, "'", `'\''`, -1) + "'"
+}
+
+// SSHArguments returns the arguments of ssh to run a command on the remote
+// host. All commands share one connection, which is kept open in between
+// scrapes by a control master to avoid a handshake per command.
+func SSHArguments(path string, arguments []string) []string {
+	controlPath := filepath.Join(os.TempDir(), "prometheus-slurm-exporter-%r@%h:%p")
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPersist=10m",
+		"-o", "ControlPath=" + controlPath,
+	}
+	if *sshUser != "" {
+		args = append(args, "-l", *sshUser)
+	}
+	if *sshKey != "" {
+		args = append(args, "-i", *sshKey)
+	}
+	// the environment is not passed by ssh
+	var remote []string
+	if *slurmConf != "" {
+		remote = append(remote, "SLURM_CONF="+ShellQuote(*slurmConf))
+	}
+	remote = append(remote, ShellQuote(path))
+	for _, argument := range arguments {
+		remote = append(remote, ShellQuote(argument))
+	}
+	return append(args, *sshHost, strings.Join(remote, " "))
+}
+
+// Time to wait for the output pipes of a command once it exited or was
+// killed. A child which outlives the command keeps the pipes open, like the
+// control master ssh forks off on its first connection, which lives on for
+// ControlPersist. The pipes are closed after this delay instead of waiting
+// for the child.
+var commandWaitDelay = time.Second
+
+func executeContext(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	path := CommandPath(command)
+	var cmd *exec.Cmd
+	if *sshHost != "" {
+		cmd = exec.CommandContext(ctx, "ssh", SSHArguments(path, arguments)...)
+	} else {
+		cmd = exec.CommandContext(ctx, path, arguments...)
+		if *slurmConf != "" {
+			cmd.Env = append(os.Environ(), "SLURM_CONF="+*slurmConf)
+		}
+	}
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.Output()
+	// the command itself succeeded, only a child of it held the pipes open
+	if errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil {
+		err = nil
+	}
+	if err != nil {
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound || os.IsNotExist(err) {
+			return nil, &commandNotFoundError{path}
+		}
+		argv := strings.TrimSpace(path + " " + strings.Join(arguments, " "))
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &commandTimeoutError{argv, out}
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("%s: %v: %s", argv, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("%s: %v", argv, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,415 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtureExecutor returns the recorded output of a Slurm command, the
+// command line is mapped to a file in test_data.
+type fixtureExecutor map[string]string
+
+func (f fixtureExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	argv := strings.Join(append([]string{command}, arguments...), " ")
+	fixture, ok := f[argv]
+	if !ok {
+		return nil, fmt.Errorf("%s: no recorded output", argv)
+	}
+	return ioutil.ReadFile(fixture)
+}
+
+// useFixtures replaces the executor by a fixtureExecutor until the
+// returned function is called.
+func useFixtures(fixtures fixtureExecutor) func() {
+	previous := executor
+	executor = fixtures
+	return func() { executor = previous }
+}
+
+func TestExecute(t *testing.T) {
+	out, err := Execute("echo", []string{"-n", "slurm"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if string(out) != "slurm" {
+		t.Errorf("Unexpected output: %q", out)
+	}
+	if _, err := Execute("false", nil); err == nil {
+		t.Error("Expected an error for a failing command")
+	}
+}
+
+func TestExecuteContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ExecuteContext(ctx, "sleep", []string{"10"}); err == nil {
+		t.Error("Expected an error for a command exceeding its timeout")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Command was not killed after the timeout")
+	}
+}
+
+func TestExecuteChildHoldsOutput(t *testing.T) {
+	defer func(delay time.Duration) { commandWaitDelay = delay }(commandWaitDelay)
+	commandWaitDelay = 100 * time.Millisecond
+	// the background sleep keeps stdout open like the control master of ssh
+	start := time.Now()
+	out, err := executeContext(context.Background(), "sh", []string{"-c", "sleep 10 & echo 4711"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(out) != "4711\n" {
+		t.Errorf("Unexpected output: %q", out)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Waited %v for the child of the command", elapsed)
+	}
+}
+
+func TestExecutePartial(t *testing.T) {
+	defer func(timeout time.Duration, partial bool) {
+		*commandTimeout, *partialOutput = timeout, partial
+	}(*commandTimeout, *partialOutput)
+	*commandTimeout = 200 * time.Millisecond
+	// the last line is incomplete when the command is killed
+	arguments := []string{"-c", "echo 4711; echo 4712; printf 47; exec sleep 10"}
+	if _, err := ExecutePartial("sh", arguments); err == nil {
+		t.Error("Expected an error without partial output enabled")
+	}
+	*partialOutput = true
+	out, err := ExecutePartial("sh", arguments)
+	if err != nil {
+		t.Fatalf("Expected the partial output: %v", err)
+	}
+	if string(out) != "4711\n4712\n" {
+		t.Errorf("Unexpected partial output: %q", out)
+	}
+	if partial := CommandStatistics()["sh"].partial; partial != 1 {
+		t.Errorf("Partial output used %v times, expected 1", partial)
+	}
+	if _, err := ExecutePartial("false", nil); err == nil {
+		t.Error("Expected an error for a failing command")
+	}
+}
+
+func TestExecuteCache(t *testing.T) {
+	defer func(ttl time.Duration) { *cacheTTL = ttl }(*cacheTTL)
+	*cacheTTL = time.Minute
+	first, err := Execute("date", []string{"+%s%N"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	second, err := Execute("date", []string{"+%s%N"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if string(first) != string(second) {
+		t.Errorf("Output was not cached: %q != %q", first, second)
+	}
+}
+
+func TestCommandCacheTTLs(t *testing.T) {
+	ttls, err := ParseCommandCacheTTLs("sinfo=5m, sacct=10s")
+	if err != nil {
+		t.Fatalf("ParseCommandCacheTTLs failed: %v", err)
+	}
+	if ttls["sinfo"] != 5*time.Minute || ttls["sacct"] != 10*time.Second {
+		t.Errorf("Unexpected cache TTLs: %v", ttls)
+	}
+	for _, invalid := range []string{"sinfo", "sinfo=5", "=5m"} {
+		if _, err := ParseCommandCacheTTLs(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+
+	// the TTL of a single command overrides the global TTL, here it
+	// disables the cache of date
+	defer func(ttl time.Duration) { *cacheTTL = ttl }(*cacheTTL)
+	defer func(ttls map[string]time.Duration) { commandTTLs = ttls }(commandTTLs)
+	*cacheTTL = time.Minute
+	commandTTLs = map[string]time.Duration{"date": 0}
+	first, err := Execute("date", []string{"+%N"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	second, err := Execute("date", []string{"+%N"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if string(first) == string(second) {
+		t.Errorf("Output was cached: %q", first)
+	}
+	if CacheTTL("sinfo") != time.Minute {
+		t.Errorf("Expected the global TTL for sinfo, got %v", CacheTTL("sinfo"))
+	}
+}
+
+func TestCommandStatistics(t *testing.T) {
+	Execute("false", nil)
+	stats, ok := CommandStatistics()["false"]
+	if !ok {
+		t.Fatal("No statistics recorded for the command")
+	}
+	if stats.failures < 1 {
+		t.Errorf("Failure was not recorded: %+v", stats)
+	}
+}
+
+func TestCommandDurationHistogram(t *testing.T) {
+	recordCommand("histogram-test", 3*time.Millisecond, nil)
+	recordCommand("histogram-test", 2*time.Second, nil)
+	recordCommand("histogram-test", 2*time.Minute, nil)
+	stats := CommandStatistics()["histogram-test"]
+	if stats.durationCount != 3 || stats.durationSum != 122.003 {
+		t.Errorf("Unexpected count or sum: %+v", stats)
+	}
+	buckets := stats.DurationBuckets()
+	// cumulative, the duration beyond the last bucket only counts in +Inf
+	expected := map[float64]uint64{0.001: 0, 0.005: 1, 1: 1, 2.5: 2, 60: 2}
+	for bound, count := range expected {
+		if buckets[bound] != count {
+			t.Errorf("Bucket %v: %d executions, expected %d", bound, buckets[bound], count)
+		}
+	}
+}
+
+func TestSSHArguments(t *testing.T) {
+	defer func(host, user string) { *sshHost, *sshUser = host, user }(*sshHost, *sshUser)
+	*sshHost = "slurm.example.org"
+	*sshUser = "prometheus"
+	args := SSHArguments("sinfo", []string{"-h", "-o", "%n %G", "it's"})
+	remote := args[len(args)-1]
+	if remote != `'sinfo' '-h' '-o' '%n %G' 'it'\''s'` {
+		t.Errorf("Unexpected remote command: %s", remote)
+	}
+	if args[len(args)-2] != "slurm.example.org" {
+		t.Errorf("Unexpected host: %s", args[len(args)-2])
+	}
+}
+
+func TestExecuteCommandNotFound(t *testing.T) {
+	_, err := Execute("slurm-command-not-found", nil)
+	if !IsCommandNotFound(err) {
+		t.Fatalf("Expected a command not found error, got %v", err)
+	}
+	// the error is reported on every execution, the collectors fail
+	if _, err := Execute("slurm-command-not-found", nil); !IsCommandNotFound(err) {
+		t.Errorf("Expected a command not found error again, got %v", err)
+	}
+	if _, err := ExecuteContext(context.Background(), "/nonexistent/sinfo", nil); !IsCommandNotFound(err) {
+		t.Errorf("Expected a command not found error, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer useFixtures(fixtureExecutor{})()
+	defer flag.Set("slurm.circuit-failures", "0")
+
+	flag.Set("slurm.circuit-failures", "2")
+	for i := 0; i < 2; i++ {
+		if _, err := Execute("circuit-test", nil); err == nil || IsCircuitOpen(err) {
+			t.Fatalf("Expected the command to fail, got %v", err)
+		}
+	}
+	_, err := Execute("circuit-test", nil)
+	if !IsCircuitOpen(err) {
+		t.Fatalf("Expected an open circuit, got %v", err)
+	}
+	if !OpenCircuits(time.Now())["circuit-test"] {
+		t.Errorf("Expected the circuit to be reported as open")
+	}
+	// other command lines of the same command have their own circuit
+	if _, err := Execute("circuit-test", []string{"-h"}); IsCircuitOpen(err) {
+		t.Errorf("Expected a closed circuit for other arguments, got %v", err)
+	}
+	// after the cooldown the command is executed again
+	now := time.Now().Add(*circuitCooldown)
+	if err := checkCircuit("circuit-test", nil, now); err != nil {
+		t.Errorf("Expected a closed circuit after the cooldown, got %v", err)
+	}
+	recordCircuit("circuit-test", nil, nil)
+	if err := checkCircuit("circuit-test", nil, time.Now()); err != nil {
+		t.Errorf("Expected a closed circuit after a success, got %v", err)
+	}
+}
+
+func TestCircuitBreakerRetries(t *testing.T) {
+	defer func(previous Executor, backoff time.Duration) {
+		executor, commandRetryBackoff = previous, backoff
+	}(executor, commandRetryBackoff)
+	defer flag.Set("slurm.command-retries", "0")
+	defer flag.Set("slurm.circuit-failures", "0")
+	flag.Set("slurm.command-retries", "2")
+	flag.Set("slurm.circuit-failures", "2")
+	commandRetryBackoff = time.Millisecond
+
+	// the failed attempts of a single execution count as one failure
+	executor = &flakyExecutor{failures: 3}
+	if _, err := Execute("circuit-retry-test", nil); err == nil || IsCircuitOpen(err) {
+		t.Fatalf("Expected the command to fail, got %v", err)
+	}
+	if err := checkCircuit("circuit-retry-test", nil, time.Now()); err != nil {
+		t.Errorf("Expected a closed circuit after a single execution, got %v", err)
+	}
+	// commands run directly, like the health check, leave the circuit alone
+	executor = &flakyExecutor{}
+	if _, err := ExecuteContext(context.Background(), "circuit-retry-test", nil); err != nil {
+		t.Fatal(err)
+	}
+	executor = &flakyExecutor{failures: 3}
+	Execute("circuit-retry-test", nil)
+	if err := checkCircuit("circuit-retry-test", nil, time.Now()); !IsCircuitOpen(err) {
+		t.Errorf("Expected an open circuit after two executions, got %v", err)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	defer flag.Set("slurm.cluster", "")
+	flag.Set("slurm.cluster", "cluster2")
+	defer useFixtures(fixtureExecutor{
+		"squeue -h -M cluster2": "test_data/squeue_cluster.txt",
+		"sinfo -h":              "test_data/sinfo.txt",
+	})()
+	out, err := Execute("squeue", []string{"-h"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(out) != "4711|alice|RUNNING|8\n" {
+		t.Errorf("Unexpected output: %q", out)
+	}
+	// sinfo is not passed the cluster
+	if _, err := Execute("sinfo", []string{"-h"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSlurmConf(t *testing.T) {
+	defer flag.Set("slurm.conf", "")
+	flag.Set("slurm.conf", "/etc/slurm/cluster2.conf")
+	out, err := Execute("env", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(string(out), "SLURM_CONF=/etc/slurm/cluster2.conf\n") {
+		t.Errorf("SLURM_CONF not set in the environment: %s", out)
+	}
+}
+
+// blockingExecutor records the maximum number of commands running at once
+type blockingExecutor struct {
+	sync.Mutex
+	running, max int
+}
+
+func (b *blockingExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	b.Lock()
+	b.running++
+	if b.running > b.max {
+		b.max = b.running
+	}
+	b.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	b.Lock()
+	b.running--
+	b.Unlock()
+	return nil, nil
+}
+
+func TestMaxConcurrentCommands(t *testing.T) {
+	defer flag.Set("slurm.max-concurrent-commands", "4")
+	flag.Set("slurm.max-concurrent-commands", "2")
+	defer func(previous Executor) { executor = previous }(executor)
+	b := &blockingExecutor{}
+	executor = b
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Execute("sinfo", nil)
+		}()
+	}
+	wg.Wait()
+	if b.max != 2 {
+		t.Errorf("Expected at most 2 commands at once, got %d", b.max)
+	}
+}
+
+// flakyExecutor fails the first executions of every command
+type flakyExecutor struct {
+	sync.Mutex
+	failures   int
+	executions int
+}
+
+func (f *flakyExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.executions++
+	if f.executions <= f.failures {
+		return nil, fmt.Errorf("slurm_load_jobs error: Socket timed out on send/recv operation")
+	}
+	return []byte("ok"), nil
+}
+
+func TestCommandRetries(t *testing.T) {
+	defer func(previous Executor, backoff time.Duration) {
+		executor, commandRetryBackoff = previous, backoff
+	}(executor, commandRetryBackoff)
+	defer flag.Set("slurm.command-retries", "0")
+	flag.Set("slurm.command-retries", "2")
+	commandRetryBackoff = time.Millisecond
+
+	f := &flakyExecutor{failures: 2}
+	executor = f
+	out, err := Execute("retry-test", nil)
+	if err != nil || string(out) != "ok" {
+		t.Fatalf("Expected success on the last retry, got %q %v", out, err)
+	}
+	// every failed attempt is counted
+	if failures := CommandStatistics()["retry-test"].failures; failures != 2 {
+		t.Errorf("Expected 2 failures, got %v", failures)
+	}
+
+	f = &flakyExecutor{failures: 3}
+	executor = f
+	if _, err := Execute("retry-test", nil); err == nil {
+		t.Errorf("Expected an error after all retries")
+	}
+	if f.executions != 3 {
+		t.Errorf("Expected 3 executions, got %d", f.executions)
+	}
+
+	// missing commands are not retried
+	executor = commandExecutor{}
+	before := CommandStatistics()["slurm-command-not-found"].failures
+	if _, err := Execute("slurm-command-not-found", nil); !IsCommandNotFound(err) {
+		t.Errorf("Expected a command not found error, got %v", err)
+	}
+	if failures := CommandStatistics()["slurm-command-not-found"].failures - before; failures != 1 {
+		t.Errorf("Expected a single execution, got %v", failures)
+	}
+}
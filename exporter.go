@@ -0,0 +1,84 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Version of the exporter, set at build time with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * metrics about the exporter itself into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewExporterCollector() *ExporterCollector {
+	labels := []string{"command"}
+	return &ExporterCollector{
+		commandDuration: NewDesc("slurm_exporter_command_duration_seconds", "Duration of the last execution of a Slurm command", labels, nil),
+		commandSeconds:  NewDesc("slurm_exporter_command_seconds", "Histogram of the durations of the executions of a Slurm command", labels, nil),
+		commandFailures: NewDesc("slurm_exporter_command_failures_total", "Failed executions of a Slurm command", labels, nil),
+		commandPartial:  NewDesc("slurm_exporter_command_partial_total", "Executions of a Slurm command killed by the timeout whose partial output was used", labels, nil),
+		circuitOpen:     NewDesc("slurm_exporter_command_circuit_open", "Whether a Slurm command is skipped after repeated failures", labels, nil),
+		info:            NewDesc("slurm_exporter_info", "Version of the exporter, the value is always 1", []string{"version"}, nil),
+	}
+}
+
+type ExporterCollector struct {
+	commandDuration *prometheus.Desc
+	commandSeconds  *prometheus.Desc
+	commandFailures *prometheus.Desc
+	commandPartial  *prometheus.Desc
+	circuitOpen     *prometheus.Desc
+	info            *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (ec *ExporterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ec.commandDuration
+	ch <- ec.commandSeconds
+	ch <- ec.commandFailures
+	ch <- ec.commandPartial
+	ch <- ec.circuitOpen
+	ch <- ec.info
+}
+
+func (ec *ExporterCollector) Update(ch chan<- prometheus.Metric) error {
+	ch <- prometheus.MustNewConstMetric(ec.info, prometheus.GaugeValue, 1, version)
+	circuits := OpenCircuits(time.Now())
+	for command, stats := range CommandStatistics() {
+		open := 0.0
+		if circuits[command] {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ec.circuitOpen, prometheus.GaugeValue, open, command)
+		ch <- prometheus.MustNewConstMetric(ec.commandDuration, prometheus.GaugeValue, stats.duration, command)
+		ch <- prometheus.MustNewConstHistogram(ec.commandSeconds, stats.durationCount, stats.durationSum, stats.DurationBuckets(), command)
+		ch <- prometheus.MustNewConstMetric(ec.commandFailures, prometheus.CounterValue, stats.failures, command)
+		ch <- prometheus.MustNewConstMetric(ec.commandPartial, prometheus.CounterValue, stats.partial, command)
+	}
+	return nil
+}
+
+// Parse returns the statistics of the Slurm commands, see DebugParser
+func (ec *ExporterCollector) Parse() (interface{}, error) {
+	return CommandStatistics(), nil
+}
@@ -16,161 +16,1217 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
-	"io/ioutil"
-	"os/exec"
-	"strings"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 )
 
+// Label value for GPUs whose GRES does not specify a type
+const unknownGpuType = "unknown"
+
+// MIG profiles like "1g.5gb" at the end of a GPU type, e.g. "a100_1g.5gb"
+var migProfileRegexp = regexp.MustCompile(`^(.*?)[_-]?(\d+g\.\d+gb)$`)
+
 type GPUsMetrics struct {
 	alloc       float64
 	idle        float64
 	total       float64
 	utilization float64
 	userAlloc   map[string]float64
+	userMem     map[string]float64
+	typeAlloc   map[string]float64
+	typeTotal   map[string]float64
+	// GPUs allocated to suspended jobs, not part of typeAlloc
+	typeSuspended map[string]float64
+	// GPUs on nodes which can not run jobs, e.g. down or drained
+	typeUnavailable map[string]float64
+	// GPUs not allocated on nodes which can run jobs, see ParseIdleGPUs
+	typeIdle    map[string]float64
+	unavailable float64
+	nodeGpus    map[string]*NodeGPUsMetrics
+	// total and allocated GPUs per partition
+	partitionGpus map[string]*NodeGPUsMetrics
+	pending       float64
+	userPending   map[string]float64
+	// most GPUs requested by a single pending job
+	largestPending float64
+	// pending jobs per user held back by a GPU limit
+	userLimited map[string]float64
+	// GPUs requested per account for pending jobs
+	accountPending map[string]float64
+	// most GPUs not allocated on a single usable node
+	maxFree float64
+	// GPUs allocated per account for running jobs
+	accountAlloc map[string]float64
+	// running jobs holding GPUs, in total and per user
+	jobs     float64
+	userJobs map[string]float64
+	// GPU types with more GPUs allocated than known by sinfo
+	inconsistentTypes []string
 }
 
-func GPUsGetMetrics() *GPUsMetrics {
-	return ParseGPUsMetrics()
+// NodeGPUsMetrics stores the GPUs of a single node
+type NodeGPUsMetrics struct {
+	total float64
+	alloc float64
+	// GPUs not allocated on the nodes which can run jobs, only set for
+	// partitions
+	idle float64
+	// total and allocated GPUs per type, only set for nodes
+	typeTotal map[string]float64
+	typeAlloc map[string]float64
+}
+
+// ParseGpuTres extracts the GPUs of a single job from its TRES string,
+// e.g. "cpu=8,mem=64G,node=1,billing=8,gres/gpu=2,gres/gpu:a100=2".
+// It returns the number of GPUs of the job and their breakdown by type.
+// Slurm reports typed GPUs next to the untyped total, thus GPUs are only
+// attributed to the unknown type if the typed entries do not add up.
+func ParseGpuTres(tres string) (float64, map[string]float64) {
+	var untyped, typed float64
+	hasUntyped := false
+	types := make(map[string]float64)
+	for _, part := range strings.Split(tres, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "gres/gpu") {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		count, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case kv[0] == "gres/gpu":
+			untyped += count
+			hasUntyped = true
+		case strings.HasPrefix(kv[0], "gres/gpu:"):
+			types[strings.TrimPrefix(kv[0], "gres/gpu:")] += count
+			typed += count
+		}
+	}
+	if !hasUntyped {
+		return typed, types
+	}
+	if untyped > typed {
+		types[unknownGpuType] += untyped - typed
+	}
+	return untyped, types
 }
 
-func ParseAllocatedGPUs() (float64, map[string]float64) {
-	var totalGpus float64
-	userGpus := make(map[string]float64)
+// SplitGpuType splits a GPU type into the GPU model and the profile of a
+// NVIDIA MIG instance, e.g. "nvidia_a100_1g.5gb" into "nvidia_a100" and
+// "1g.5gb". Whole GPUs have an empty MIG profile, a GPU type of just "mig"
+// is reported as a MIG instance of an unknown model.
+func SplitGpuType(gpuType string) (string, string) {
+	if gpuType == "mig" {
+		return unknownGpuType, gpuType
+	}
+	match := migProfileRegexp.FindStringSubmatch(gpuType)
+	if match == nil {
+		return gpuType, ""
+	}
+	model := strings.TrimRight(strings.TrimSuffix(match[1], "mig"), "_-")
+	if model == "" {
+		model = unknownGpuType
+	}
+	return model, match[2]
+}
+
+// AllocatedMetrics stores the resources allocated to running jobs and the
+// GPUs still held by suspended jobs
+type AllocatedMetrics struct {
+	typeGpus    map[string]float64
+	userGpus    map[string]float64
+	userMem     map[string]float64
+	accountGpus map[string]float64
+	// GPUs per type allocated to suspended jobs
+	typeSuspended map[string]float64
+	// running jobs holding GPUs, in total and per user
+	jobs     float64
+	userJobs map[string]float64
+	// IDs of the jobs counted, see countJob
+	jobIDs map[string]bool
+}
+
+func NewAllocatedMetrics() *AllocatedMetrics {
+	return &AllocatedMetrics{
+		typeGpus:      make(map[string]float64),
+		userGpus:      make(map[string]float64),
+		userMem:       make(map[string]float64),
+		accountGpus:   make(map[string]float64),
+		typeSuspended: make(map[string]float64),
+		userJobs:      make(map[string]float64),
+		jobIDs:        make(map[string]bool),
+	}
+}
+
+// JobTres holds the resources of a single job parsed from its TRES string
+type JobTres struct {
+	gpus     float64
+	gpuTypes map[string]float64
+	mem      float64
+}
+
+// ParseJobTres sums the GPUs and the memory in bytes of a TRES string, e.g.
+// "cpu=8,mem=64G,node=1,gres/gpu=2,gres/gpu:a100=2".
+func ParseJobTres(tres string) JobTres {
+	var jt JobTres
+	for _, part := range strings.Split(tres, ",") {
+		if strings.HasPrefix(part, "mem=") {
+			if memory, err := ParseTresMemory(strings.TrimPrefix(part, "mem=")); err == nil {
+				jt.mem += memory
+			}
+		}
+	}
+	jt.gpus, jt.gpuTypes = ParseGpuTres(tres)
+	return jt
+}
 
-	args := []string{"-a", "-X", "--format=User,AllocTRES", "--state=RUNNING", "--noheader", "--parsable2"}
-	output := Execute("sacct", args)
-	for _, line := range strings.Split(string(output), "\n") {
+// ParseTresMemory converts the memory of a TRES string, e.g. "64G", into
+// bytes. Values without a unit are in megabytes, like Slurm reports them.
+func ParseTresMemory(value string) (float64, error) {
+	units := map[byte]float64{
+		'K': 1 << 10,
+		'M': 1 << 20,
+		'G': 1 << 30,
+		'T': 1 << 40,
+		'P': 1 << 50,
+	}
+	multiplier := float64(1 << 20)
+	if len(value) > 0 {
+		if unit, ok := units[value[len(value)-1]]; ok {
+			multiplier = unit
+			value = value[:len(value)-1]
+		}
+	}
+	memory, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return memory * multiplier, nil
+}
+
+// countJob returns whether a job is counted for the first time. The
+// components of a heterogeneous job count as a single job. Jobs without an
+// ID are always counted.
+func (am *AllocatedMetrics) countJob(job string) bool {
+	if job == "" {
+		return true
+	}
+	leader := HetJobLeader(job)
+	if am.jobIDs[leader] {
+		return false
+	}
+	am.jobIDs[leader] = true
+	return true
+}
+
+// AddJob accounts the TRES allocated to a running job to its user and account
+func (am *AllocatedMetrics) AddJob(job string, user string, account string, tres string) {
+	jt := ParseJobTres(tres)
+	selected := UserSelected(user)
+	if jt.mem > 0 && selected {
+		am.userMem[user] += jt.mem
+	}
+	if jt.gpus == 0 {
+		return
+	}
+	if selected {
+		am.userGpus[user] += jt.gpus
+	}
+	if am.countJob(job) {
+		am.jobs++
+		if selected {
+			am.userJobs[user]++
+		}
+	}
+	if account != "" {
+		am.accountGpus[account] += jt.gpus
+	}
+	for gpuType, count := range jt.gpuTypes {
+		am.typeGpus[gpuType] += count
+	}
+}
+
+// AddSuspendedJob accounts the GPUs of a suspended job. Slurm keeps the GRES
+// of a suspended job allocated, but the job does not use them, thus they are
+// neither counted for its user nor for its account.
+func (am *AllocatedMetrics) AddSuspendedJob(tres string) {
+	for gpuType, count := range ParseJobTres(tres).gpuTypes {
+		am.typeSuspended[gpuType] += count
+	}
+}
+
+// AddJobInState accounts a job as running or suspended, depending on its
+// state as printed by sacct or squeue. Jobs without a state are running.
+func (am *AllocatedMetrics) AddJobInState(job string, user string, account string, tres string, state string) {
+	if strings.HasPrefix(strings.ToUpper(state), "SUSPENDED") {
+		am.AddSuspendedJob(tres)
+		return
+	}
+	am.AddJob(job, user, account, tres)
+}
+
+// RunningSacctArguments completes the arguments of sacct for the running
+// jobs. The time window is pinned to now, sacct then reports the jobs in the
+// requested states right now independent of its defaults, including jobs
+// started long ago. A window in the past would add jobs which were running
+// at some point of it. The arguments configured on the command line are
+// appended last, thus they take precedence.
+func RunningSacctArguments(arguments []string) []string {
+	arguments = append(arguments, "--starttime=now", "--endtime=now")
+	return append(arguments, strings.Fields(*runningSacctArgs)...)
+}
+
+// ParseAllocatedGPUs returns the resources allocated to running jobs,
+// using either the parsable text or the JSON output of sacct, or the
+// output of squeue if configured as source of the running jobs. Suspended
+// jobs are queried as well, their GPUs are reported separately.
+func ParseAllocatedGPUs() (*AllocatedMetrics, error) {
+	if *runningSource == "squeue" {
+		output, err := ExecutePartial("squeue", PartitionArguments([]string{"-a", "-r", "-h", "--states=RUNNING,SUSPENDED", "-O", "JobID:30,HetJobID:30,UserName:100,Account:100,tres-alloc:200,State:20"}))
+		if err != nil {
+			return NewAllocatedMetrics(), err
+		}
+		return ParseAllocatedGPUsSqueue(output), nil
+	}
+	if *useJSON {
+		output, err := Execute("sacct", PartitionArguments(RunningSacctArguments([]string{"-a", "--state=RUNNING,SUSPENDED", "--json"})))
+		if err != nil {
+			return NewAllocatedMetrics(), err
+		}
+		return ParseAllocatedGPUsJSON(output)
+	}
+	args := []string{"-a", "-X", "--format=JobID,User,Account,AllocTRES,State", "--state=RUNNING,SUSPENDED", "--noheader", "--parsable2"}
+	output, err := ExecutePartial("sacct", PartitionArguments(RunningSacctArguments(args)))
+	if err != nil {
+		return NewAllocatedMetrics(), err
+	}
+	return ParseAllocatedGPUsText(output), nil
+}
+
+// HetJobLeader returns the job ID of the leader of a heterogeneous job
+// component, e.g. "4720" of "4720+1", other job IDs are returned as is
+func HetJobLeader(job string) string {
+	if i := strings.Index(job, "+"); i >= 0 {
+		return job[:i]
+	}
+	return job
+}
+
+// ParseAllocatedGPUsText parses lines of "JobID|User|Account|AllocTRES|State"
+// as printed by sacct. Some versions of sacct print a job on several lines, thus
+// every job ID is counted once. The components of a heterogeneous job, e.g.
+// "4720+0" and "4720+1", have their own TRES and are all counted. Components
+// printed without user and account are accounted to those of the other
+// components of the job.
+func ParseAllocatedGPUsText(input []byte) *AllocatedMetrics {
+	am := NewAllocatedMetrics()
+	type runningJob struct{ user, account, tres, state string }
+	var order []string
+	jobs := make(map[string]runningJob)
+	owners := make(map[string]runningJob)
+	for _, line := range strings.Split(string(input), "\n") {
 		line = strings.Trim(line, "\"")
 		if line == "" {
 			continue
 		}
 		parts := strings.Split(line, "|")
-		if len(parts) < 2 {
+		if len(parts) < 4 {
 			continue
 		}
-		user := strings.TrimSpace(parts[0])
-		tres := strings.TrimSpace(parts[1])
-		if user == "" || tres == "" {
+		job := strings.TrimSpace(parts[0])
+		user := strings.TrimSpace(parts[1])
+		account := strings.TrimSpace(parts[2])
+		tres := strings.TrimSpace(parts[3])
+		var state string
+		if len(parts) > 4 {
+			state = strings.TrimSpace(parts[4])
+		}
+		if user != "" {
+			owners[HetJobLeader(job)] = runningJob{user: user, account: account}
+		}
+		if _, ok := jobs[job]; ok || tres == "" {
 			continue
 		}
-		for _, part := range strings.Split(tres, ",") {
-			part = strings.TrimSpace(part)
-			if strings.HasPrefix(part, "gres/gpu=") {
-				descriptor := strings.TrimPrefix(part, "gres/gpu=")
-				jobGpus, err := strconv.ParseFloat(descriptor, 64)
-				if err == nil {
-					userGpus[user] += jobGpus
-					totalGpus += jobGpus
-				}
+		order = append(order, job)
+		jobs[job] = runningJob{user, account, tres, state}
+	}
+	for _, job := range order {
+		rj := jobs[job]
+		if rj.user == "" {
+			owner, ok := owners[HetJobLeader(job)]
+			if !ok {
+				continue
 			}
+			rj.user, rj.account = owner.user, owner.account
 		}
+		am.AddJobInState(job, rj.user, rj.account, rj.tres, rj.state)
 	}
+	return am
+}
 
-	return totalGpus, userGpus
+// ParseAllocatedGPUsSqueue parses the job ID, the ID of the heterogeneous job
+// leader, user, account, allocated TRES and state of running and suspended
+// jobs as printed by squeue with fixed width fields. squeue -r lists every
+// component of a heterogeneous job with its own job ID, the components are
+// counted as a single job by the ID of their leader. Jobs which are no
+// heterogeneous job have a leader ID of 0.
+func ParseAllocatedGPUsSqueue(input []byte) *AllocatedMetrics {
+	am := NewAllocatedMetrics()
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		job := fields[0]
+		if leader := fields[1]; leader != "0" && leader != "N/A" {
+			job = leader
+		}
+		var state string
+		if len(fields) > 5 {
+			state = fields[5]
+		}
+		am.AddJobInState(job, fields[2], fields[3], fields[4], state)
+	}
+	return am
 }
 
-func ParseTotalGPUs() float64 {
-	var numGpus float64
+// Subset of the jobs reported by "sacct --json" (Slurm 20.11 and newer)
+type sacctJSON struct {
+	Jobs []struct {
+		JobID   int64          `json:"job_id"`
+		User    string         `json:"user"`
+		Account string         `json:"account"`
+		State   sacctJSONState `json:"state"`
+		Tres    struct {
+			Allocated []sacctJSONTres `json:"allocated"`
+		} `json:"tres"`
+	} `json:"jobs"`
+}
 
-	args := []string{"-h", "-o", "%n %G"}
-	output := Execute("sinfo", args)
+// The state of a job is a string up to Slurm 22.05 and a list of the state
+// and its flags since Slurm 23.02
+type sacctJSONState struct {
+	Current json.RawMessage `json:"current"`
+}
 
-	for _, line := range strings.Split(string(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
+// String returns the state of a job, e.g. "RUNNING"
+func (s sacctJSONState) String() string {
+	var state string
+	if json.Unmarshal(s.Current, &state) == nil {
+		return state
+	}
+	var states []string
+	if json.Unmarshal(s.Current, &states) == nil && len(states) > 0 {
+		return states[0]
+	}
+	return ""
+}
+
+type sacctJSONTres struct {
+	Type  string  `json:"type"`
+	Name  string  `json:"name"`
+	Count float64 `json:"count"`
+}
+
+// String formats a TRES like in the AllocTRES field of sacct, e.g. "gres/gpu:a100=2"
+func (t sacctJSONTres) String() string {
+	if t.Name == "" {
+		return fmt.Sprintf("%s=%v", t.Type, t.Count)
+	}
+	return fmt.Sprintf("%s/%s=%v", t.Type, t.Name, t.Count)
+}
+
+// ParseAllocatedGPUsJSON decodes the output of "sacct --json" and returns the
+// allocated resources like ParseAllocatedGPUsText.
+func ParseAllocatedGPUsJSON(input []byte) (*AllocatedMetrics, error) {
+	am := NewAllocatedMetrics()
+	var sacct sacctJSON
+	if err := json.Unmarshal(input, &sacct); err != nil {
+		return am, fmt.Errorf("can not decode sacct JSON output: %v", err)
+	}
+	jobs := make(map[int64]bool)
+	for _, job := range sacct.Jobs {
+		if job.User == "" || jobs[job.JobID] {
 			continue
 		}
+		jobs[job.JobID] = true
+		var tres []string
+		for _, t := range job.Tres.Allocated {
+			tres = append(tres, t.String())
+		}
+		am.AddJobInState(strconv.FormatInt(job.JobID, 10), job.User, job.Account, strings.Join(tres, ","), job.State.String())
+	}
+	return am, nil
+}
+
+// ParseTotalGPUs returns the number of GPUs per type known by sinfo and the
+// number of GPUs per type on nodes which can not run jobs.
+// GRES without a type, like "gpu:4", are accounted to the unknown type.
+func ParseTotalGPUs() (map[string]float64, map[string]float64, error) {
+	nodes, ok, err := SinfoJSONNodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		total, unavailable := ParseTotalGPUsText(SinfoJSONGPUsLines(nodes))
+		return total, unavailable, nil
+	}
+	args := []string{"-h", "-o", "%n %T %G"}
+	output, err := Execute("sinfo", PartitionArguments(args))
+	if err != nil {
+		return make(map[string]float64), make(map[string]float64), err
+	}
+	total, unavailable := ParseTotalGPUsText(output)
+	return total, unavailable, nil
+}
+
+// NodeStateUsable returns whether jobs can be scheduled on a node in the
+// given state as printed by sinfo. Flags like the "*" of nodes not
+// responding or the "~" of nodes powered down by the power saving make a
+// node unusable as well.
+func NodeStateUsable(state string) bool {
+	switch state {
+	case "idle", "mixed", "allocated", "completing":
+		return true
+	}
+	return false
+}
+
+// ParseTotalGPUsText parses lines of "Hostname State GRES" as printed by
+// sinfo. All GPU entries of a comma separated GRES list are summed, e.g. both
+// types of "gpu:v100:2,gpu:a100:2" as well as the GPUs of "nic:2,gpu:4". The
+// GPUs of nodes in an unusable state, e.g. down or drained, are returned as
+// unavailable in addition. Shared GPUs configured as "no_consume" are no
+// capacity jobs can allocate and are skipped. sinfo prints a node once per
+// partition, thus every node is counted once, like by ParseIdleGPUs.
+func ParseTotalGPUsText(input []byte) (map[string]float64, map[string]float64) {
+	typeGpus := make(map[string]float64)
+	unavailable := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
 		fields := strings.Fields(line)
-		if len(fields) < 2 {
+		if len(fields) < 3 || seen[fields[0]] {
 			continue
 		}
-		gpuField := fields[1]
-		if !strings.HasPrefix(gpuField, "gpu:") {
-			continue
+		seen[fields[0]] = true
+		usable := NodeStateUsable(fields[1])
+		for _, entry := range ParseGres(fields[2]) {
+			if entry.name != "gpu" || entry.noConsume {
+				continue
+			}
+			gpuType := entry.gresType
+			if gpuType == "" {
+				gpuType = unknownGpuType
+			}
+			typeGpus[gpuType] += entry.count
+			if !usable {
+				unavailable[gpuType] += entry.count
+			}
+		}
+	}
+	return typeGpus, unavailable
+}
+
+// GresEntry is a single generic resource of a GRES string,
+// e.g. "gpu:a100:4(S:0-1)" has the name "gpu", the type "a100" and a count of 4.
+type GresEntry struct {
+	name     string
+	gresType string
+	count    float64
+	// shared resource, which is not consumed by jobs, e.g. "gpu:no_consume:4"
+	noConsume bool
+}
+
+// ParseGres splits a comma separated GRES string, as reported by the Gres and
+// GresUsed fields of sinfo, into its entries. Commas within a parenthesized
+// suffix like "(IDX:0,2)" do not separate entries, the suffix is dropped.
+// A "no_consume" flag is not taken as type and a unit of the count is
+// ignored.
+func ParseGres(gres string) []GresEntry {
+	var entries []GresEntry
+	var tokens []string
+	depth, start := 0, 0
+	for i, c := range gres {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				tokens = append(tokens, gres[start:i])
+				start = i + 1
+			}
 		}
-		parts := strings.Split(gpuField, ":")
-		if len(parts) < 3 {
+	}
+	tokens = append(tokens, gres[start:])
+	for _, token := range tokens {
+		if i := strings.Index(token, "("); i >= 0 {
+			token = token[:i]
+		}
+		var parts []string
+		noConsume := false
+		for _, part := range strings.Split(strings.TrimSpace(token), ":") {
+			if strings.EqualFold(part, "no_consume") {
+				noConsume = true
+				continue
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) < 2 {
 			continue
 		}
-		countStr := parts[2]
-		count, err := strconv.ParseFloat(countStr, 64)
+		// some setups report counts with a unit, e.g. "gpu:v100:4G"
+		count, err := strconv.ParseFloat(strings.TrimRightFunc(parts[len(parts)-1], unicode.IsLetter), 64)
 		if err != nil {
 			continue
 		}
-		numGpus += count
+		entry := GresEntry{name: parts[0], count: count, noConsume: noConsume}
+		if len(parts) > 2 {
+			entry.gresType = strings.Join(parts[1:len(parts)-1], ":")
+		}
+		entries = append(entries, entry)
 	}
+	return entries
+}
 
-	return numGpus
+// NodeGPUsData executes sinfo to get the configured and used GRES and the
+// state of every node, once per partition of the node
+func NodeGPUsData() ([]byte, error) {
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-N", "-O", "NodeHost:100,Partition:100,Gres:200,GresUsed:200,StateLong:50"}))
 }
 
-func ParseGPUsMetrics() *GPUsMetrics {
+// parseNodeGPUs parses a line of NodeGPUsData into the node, its partition
+// and its total and allocated GPUs. Nodes without GPUs are reported as not ok.
+// Nodes with several GPU models, e.g. "gpu:v100:2,gpu:a100:2", have a total
+// per type, GPUs without a type are accounted to the unknown type. Shared
+// "no_consume" GPUs are skipped, like by ParseTotalGPUsText.
+func parseNodeGPUs(line string) (string, string, NodeGPUsMetrics, bool) {
+	nm := NodeGPUsMetrics{typeTotal: make(map[string]float64), typeAlloc: make(map[string]float64)}
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", "", nm, false
+	}
+	for _, entry := range ParseGres(fields[2]) {
+		if entry.name == "gpu" && !entry.noConsume {
+			nm.total += entry.count
+			gpuType := entry.gresType
+			if gpuType == "" {
+				gpuType = unknownGpuType
+			}
+			nm.typeTotal[gpuType] += entry.count
+		}
+	}
+	if nm.total == 0 {
+		return "", "", nm, false
+	}
+	if len(fields) > 3 {
+		for _, entry := range ParseGres(fields[3]) {
+			if entry.name == "gpu" && !entry.noConsume {
+				nm.alloc += entry.count
+				gpuType := entry.gresType
+				if gpuType == "" {
+					gpuType = unknownGpuType
+				}
+				nm.typeAlloc[gpuType] += entry.count
+			}
+		}
+	}
+	// the default partition is marked by an asterisk
+	return fields[0], strings.TrimSuffix(fields[1], "*"), nm, true
+}
+
+// ParseNodeGPUsMetrics returns the total and allocated GPUs per node.
+// Nodes without GPUs are omitted, nodes listed in several partitions
+// are counted once.
+func ParseNodeGPUsMetrics(input []byte) map[string]*NodeGPUsMetrics {
+	nodes := make(map[string]*NodeGPUsMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		node, _, nm, ok := parseNodeGPUs(line)
+		if !ok {
+			continue
+		}
+		if _, seen := nodes[node]; seen {
+			continue
+		}
+		nodes[node] = &nm
+	}
+	return nodes
+}
+
+// ParseMaxFreeGPUs returns the largest number of GPUs not allocated on a
+// single node which can run jobs, i.e. the most GPUs a job on one node can
+// get right now. Nodes in an unusable state, e.g. down or drained, are
+// skipped, see NodeStateUsable.
+func ParseMaxFreeGPUs(input []byte) float64 {
+	var maxFree float64
+	for _, line := range strings.Split(string(input), "\n") {
+		_, _, nm, ok := parseNodeGPUs(line)
+		fields := strings.Fields(line)
+		if !ok || len(fields) < 5 || !NodeStateUsable(fields[4]) {
+			continue
+		}
+		maxFree = math.Max(maxFree, nm.total-nm.alloc)
+	}
+	return maxFree
+}
+
+// ParseIdleGPUs returns the GPUs not allocated on the nodes which can run
+// jobs, in total and per type, from the Gres and GresUsed of every node. Like
+// ParseMaxFreeGPUs, nodes in an unusable state are skipped, thus the GPUs
+// of jobs on a draining node count neither as idle nor twice as allocated
+// and unavailable. Nodes listed in several partitions are counted once.
+func ParseIdleGPUs(input []byte) (float64, map[string]float64) {
+	var idle float64
+	typeIdle := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		node, _, nm, ok := parseNodeGPUs(line)
+		fields := strings.Fields(line)
+		if !ok || len(fields) < 5 || !NodeStateUsable(fields[4]) || seen[node] {
+			continue
+		}
+		seen[node] = true
+		idle += math.Max(nm.total-nm.alloc, 0)
+		for gpuType, total := range nm.typeTotal {
+			typeIdle[gpuType] += math.Max(total-nm.typeAlloc[gpuType], 0)
+		}
+	}
+	return idle, typeIdle
+}
+
+// ParsePartitionGPUsMetrics returns the total, allocated and idle GPUs per
+// partition. A node belonging to several partitions is counted in each
+// of them, but only once per partition. Like ParseIdleGPUs, only the nodes
+// in a usable state count towards the idle GPUs.
+func ParsePartitionGPUsMetrics(input []byte) map[string]*NodeGPUsMetrics {
+	partitions := make(map[string]*NodeGPUsMetrics)
+	seen := make(map[[2]string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		node, partition, nm, ok := parseNodeGPUs(line)
+		if !ok || !PartitionSelected(partition) || seen[[2]string{node, partition}] {
+			continue
+		}
+		seen[[2]string{node, partition}] = true
+		if _, ok := partitions[partition]; !ok {
+			partitions[partition] = &NodeGPUsMetrics{}
+		}
+		partitions[partition].total += nm.total
+		partitions[partition].alloc += nm.alloc
+		if fields := strings.Fields(line); len(fields) >= 5 && NodeStateUsable(fields[4]) {
+			partitions[partition].idle += math.Max(nm.total-nm.alloc, 0)
+		}
+	}
+	return partitions
+}
+
+// PendingGPUsData executes squeue to get the GPUs requested by pending jobs
+func PendingGPUsData() ([]byte, error) {
+	return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "--states=PENDING", "-O", "UserName:100,NumNodes:20,tres-per-node:200,tres-per-job:200,Reason:100,Account:100"}))
+}
+
+// ParseRequestedGpus returns the number of GPUs of a requested TRES string
+// like "gres:gpu:2" (--gres=gpu:2) or "gres/gpu:a100:2" (--gpus-per-node and
+// --gpus on newer Slurm versions). Missing requests are reported as "N/A".
+func ParseRequestedGpus(tres string) float64 {
+	var gpus float64
+	for _, part := range strings.Split(tres, ",") {
+		part = strings.TrimPrefix(strings.TrimPrefix(part, "gres:"), "gres/")
+		for _, entry := range ParseGres(part) {
+			if entry.name == "gpu" {
+				gpus += entry.count
+			}
+		}
+	}
+	return gpus
+}
+
+// ParsePendingJobGPUs returns the user and the GPUs requested by a pending
+// job printed by squeue as "UserName NumNodes tres-per-node tres-per-job".
+// GPUs requested per node (--gres, --gpus-per-node) are multiplied by the
+// number of requested nodes, GPUs requested per job (--gpus) are not.
+func ParsePendingJobGPUs(line string) (string, float64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return "", 0, false
+	}
+	nodes, err := strconv.ParseFloat(strings.Split(fields[1], "-")[0], 64)
+	if err != nil || nodes < 1 {
+		nodes = 1
+	}
+	return fields[0], ParseRequestedGpus(fields[2])*nodes + ParseRequestedGpus(fields[3]), true
+}
+
+// ParsePendingGPUsMetrics returns the GPUs requested by all pending jobs and
+// per user, see ParsePendingJobGPUs.
+func ParsePendingGPUsMetrics(input []byte) (float64, map[string]float64) {
+	var pending float64
+	userPending := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		user, jobGpus, ok := ParsePendingJobGPUs(line)
+		if !ok || jobGpus == 0 {
+			continue
+		}
+		pending += jobGpus
+		if UserSelected(user) {
+			userPending[user] += jobGpus
+		}
+	}
+	return pending, userPending
+}
+
+// ParseLargestPendingGPURequest returns the most GPUs requested by a single
+// pending job, e.g. to explain why a large job stalls although enough GPUs
+// are idle on different nodes.
+func ParseLargestPendingGPURequest(input []byte) float64 {
+	var largest float64
+	for _, line := range strings.Split(string(input), "\n") {
+		if _, jobGpus, ok := ParsePendingJobGPUs(line); ok && jobGpus > largest {
+			largest = jobGpus
+		}
+	}
+	return largest
+}
+
+// GPULimitReason returns whether a job pends due to a limit on its GRES,
+// like QOSMaxGRESPerUser or AssocGrpGRES, rather than due to busy GPUs
+func GPULimitReason(reason string) bool {
+	return (strings.HasPrefix(reason, "QOS") || strings.HasPrefix(reason, "Assoc")) && strings.Contains(reason, "GRES")
+}
+
+// ParseLimitedPendingGPUJobs returns the number of pending jobs per user
+// which request GPUs and pend due to a GRES limit of their QOS or
+// association, i.e. due to the quota of the user rather than the capacity of
+// the cluster. The reason follows the fields read by ParsePendingJobGPUs.
+func ParseLimitedPendingGPUJobs(input []byte) map[string]float64 {
+	limited := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		user, jobGpus, ok := ParsePendingJobGPUs(line)
+		fields := strings.Fields(line)
+		if !ok || jobGpus == 0 || len(fields) < 5 || !GPULimitReason(fields[4]) {
+			continue
+		}
+		if UserSelected(user) {
+			limited[user]++
+		}
+	}
+	return limited
+}
+
+// ParseAccountPendingGPUs returns the GPUs requested by pending jobs per
+// account, which follows the reason of the fields read by
+// ParsePendingJobGPUs.
+func ParseAccountPendingGPUs(input []byte) map[string]float64 {
+	accountPending := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		_, jobGpus, ok := ParsePendingJobGPUs(line)
+		fields := strings.Fields(line)
+		if !ok || jobGpus == 0 || len(fields) < 6 {
+			continue
+		}
+		accountPending[fields[5]] += jobGpus
+	}
+	return accountPending
+}
+
+// TypeUtilization returns the allocated GPUs of a type as fraction of its
+// total GPUs, GPU types without any GPU known by sinfo have no utilization
+func TypeUtilization(total float64, alloc float64) (float64, bool) {
+	if total <= 0 {
+		return 0, false
+	}
+	return alloc / total, true
+}
+
+// InconsistentGPUTypes returns the GPU types with more GPUs allocated to
+// running and suspended jobs than sinfo reports in total, e.g. when sacct
+// and sinfo disagree on a node which was removed. Jobs still running on a
+// draining node do not count, their GPUs are part of the total.
+func InconsistentGPUTypes(total map[string]float64, alloc map[string]float64, suspended map[string]float64) []string {
+	var types []string
+	for gpuType := range alloc {
+		if alloc[gpuType]+suspended[gpuType] > total[gpuType] {
+			types = append(types, gpuType)
+		}
+	}
+	for gpuType := range suspended {
+		if _, ok := alloc[gpuType]; !ok && suspended[gpuType] > total[gpuType] {
+			types = append(types, gpuType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ParseGPUsMetrics combines the GPU capacity reported by sinfo with the
+// allocations of running jobs. On error the returned metrics are empty.
+func ParseGPUsMetrics() (*GPUsMetrics, error) {
 	var gm GPUsMetrics
-	totalGpus := ParseTotalGPUs()
-	allocatedGpus, userAlloc := ParseAllocatedGPUs()
+	gm.userAlloc = make(map[string]float64)
+	gm.userMem = make(map[string]float64)
+	gm.typeAlloc = make(map[string]float64)
+	gm.typeSuspended = make(map[string]float64)
+	gm.typeTotal = make(map[string]float64)
+	gm.typeUnavailable = make(map[string]float64)
+	gm.typeIdle = make(map[string]float64)
+	gm.nodeGpus = make(map[string]*NodeGPUsMetrics)
+	gm.partitionGpus = make(map[string]*NodeGPUsMetrics)
+	gm.userPending = make(map[string]float64)
+	gm.userLimited = make(map[string]float64)
+	gm.accountPending = make(map[string]float64)
+	gm.accountAlloc = make(map[string]float64)
+	gm.userJobs = make(map[string]float64)
+	// The commands are independent of each other, run them concurrently so
+	// that the scrape takes about as long as the slowest command.
+	var (
+		wg                    sync.WaitGroup
+		typeTotal             map[string]float64
+		typeUnavailable       map[string]float64
+		allocated             *AllocatedMetrics
+		nodeData, pendingData []byte
+		totalErr, allocErr    error
+		nodeErr, pendingErr   error
+	)
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		typeTotal, typeUnavailable, totalErr = ParseTotalGPUs()
+	}()
+	go func() {
+		defer wg.Done()
+		allocated, allocErr = ParseAllocatedGPUs()
+	}()
+	go func() {
+		defer wg.Done()
+		nodeData, nodeErr = NodeGPUsData()
+	}()
+	go func() {
+		defer wg.Done()
+		pendingData, pendingErr = PendingGPUsData()
+	}()
+	wg.Wait()
+	for _, err := range []error{totalErr, allocErr, nodeErr, pendingErr} {
+		if err != nil {
+			return &gm, err
+		}
+	}
+	var totalGpus, allocatedGpus, unavailableGpus float64
+	for _, count := range typeTotal {
+		totalGpus += count
+	}
+	// suspended jobs keep their GPUs, which are thus not idle either
+	for _, count := range allocated.typeGpus {
+		allocatedGpus += count
+	}
+	for _, count := range allocated.typeSuspended {
+		allocatedGpus += count
+	}
+	for _, count := range typeUnavailable {
+		unavailableGpus += count
+	}
 	gm.alloc = allocatedGpus
-	gm.idle = totalGpus - allocatedGpus
 	gm.total = totalGpus
+	gm.unavailable = unavailableGpus
 	if totalGpus > 0 {
 		gm.utilization = allocatedGpus / totalGpus
 	} else {
 		gm.utilization = 0
 	}
-	gm.userAlloc = userAlloc
-	return &gm
+	gm.userAlloc = allocated.userGpus
+	gm.userMem = allocated.userMem
+	gm.accountAlloc = allocated.accountGpus
+	gm.jobs = allocated.jobs
+	gm.userJobs = allocated.userJobs
+	gm.typeAlloc = allocated.typeGpus
+	gm.typeSuspended = allocated.typeSuspended
+	gm.typeTotal = typeTotal
+	gm.typeUnavailable = typeUnavailable
+	gm.nodeGpus = ParseNodeGPUsMetrics(nodeData)
+	gm.partitionGpus = ParsePartitionGPUsMetrics(nodeData)
+	gm.maxFree = ParseMaxFreeGPUs(nodeData)
+	gm.idle, gm.typeIdle = ParseIdleGPUs(nodeData)
+	gm.inconsistentTypes = InconsistentGPUTypes(typeTotal, allocated.typeGpus, allocated.typeSuspended)
+	gm.pending, gm.userPending = ParsePendingGPUsMetrics(pendingData)
+	gm.largestPending = ParseLargestPendingGPURequest(pendingData)
+	gm.userLimited = ParseLimitedPendingGPUJobs(pendingData)
+	gm.accountPending = ParseAccountPendingGPUs(pendingData)
+	return &gm, nil
 }
 
-func Execute(command string, arguments []string) []byte {
-	cmd := exec.Command(command, arguments...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+func NewGPUsCollector() *GPUsCollector {
+	return &GPUsCollector{
+		alloc:                NewDesc("slurm_gpus_alloc", "Allocated GPUs of running and suspended jobs", []string{"type", "mig_profile", "state"}, nil),
+		idle:                 NewDesc("slurm_gpus_idle", "Idle GPUs on nodes which can run jobs", []string{"type", "mig_profile"}, nil),
+		unavailable:          NewDesc("slurm_gpus_unavailable", "GPUs on nodes which can not run jobs, e.g. down or drained", []string{"type", "mig_profile"}, nil),
+		total:                NewDesc("slurm_gpus_total", "Total GPUs", []string{"type", "mig_profile"}, nil),
+		utilization:          NewDesc("slurm_gpus_utilization", UtilizationHelp("Allocated GPUs of all GPUs, not the device utilization"), nil, nil),
+		typeUtilization:      NewDesc("slurm_gpus_type_utilization", UtilizationHelp("Allocated GPUs of all GPUs per type, not the device utilization"), []string{"type", "mig_profile"}, nil),
+		maxFree:              NewDesc("slurm_gpus_max_free_on_single_node", "Most GPUs not allocated on a single node which can run jobs", nil, nil),
+		userAlloc:            NewDesc("slurm_user_gpus_running", "GPUs allocated per user for running jobs", []string{"user"}, nil),
+		jobs:                 NewDesc("slurm_gpu_jobs_running", "Running jobs holding at least one GPU", nil, nil),
+		userJobs:             NewDesc("slurm_user_gpu_jobs_running", "Running jobs holding at least one GPU per user", []string{"user"}, nil),
+		nodeTotal:            NewDesc("slurm_node_gpus_total", "Total GPUs per node and type", []string{"node", "type", "mig_profile"}, nil),
+		nodeAlloc:            NewDesc("slurm_node_gpus_alloc", "Allocated GPUs per node and type", []string{"node", "type", "mig_profile"}, nil),
+		pending:              NewDesc("slurm_gpus_pending", "GPUs requested by pending jobs", nil, nil),
+		largestPending:       NewDesc("slurm_gpus_largest_pending_request", "Most GPUs requested by a single pending job", nil, nil),
+		userPending:          NewDesc("slurm_user_gpus_pending", "GPUs requested per user for pending jobs", []string{"user"}, nil),
+		userLimited:          NewDesc("slurm_gpus_pending_limited", "Pending jobs requesting GPUs per user held back by a GRES limit of their QOS or association", []string{"user"}, nil),
+		userMem:              NewDesc("slurm_user_mem_bytes_running", "Memory in bytes allocated per user for running jobs", []string{"user"}, nil),
+		partitionTotal:       NewDesc("slurm_partition_gpus_total", "Total GPUs per partition", []string{"partition"}, nil),
+		partitionAlloc:       NewDesc("slurm_partition_gpus_alloc", "Allocated GPUs per partition", []string{"partition"}, nil),
+		partitionIdle:        NewDesc("slurm_partition_gpus_idle", "Idle GPUs per partition", []string{"partition"}, nil),
+		accountPending:       NewDesc("slurm_account_gpus_pending", "GPUs requested per account for pending jobs", []string{"account"}, nil),
+		accountAlloc:         NewDesc("slurm_account_gpus_running", "GPUs allocated per account for running jobs", []string{"account"}, nil),
+		inconsistency:        NewDesc("slurm_gpus_accounting_inconsistency_total", "Collections with more GPUs allocated to jobs than known by sinfo for a GPU type", nil, nil),
+		userSeconds:          NewDesc("slurm_gpu_seconds_total", "GPU seconds allocated per user for running jobs, approximated between scrapes", []string{"user"}, nil),
+		gpuSeconds:           NewGPUSeconds(),
+		userAllocSeries:      NewRecentSeries(),
+		userJobsSeries:       NewRecentSeries(),
+		userPendingSeries:    NewRecentSeries(),
+		accountAllocSeries:   NewRecentSeries(),
+		accountPendingSeries: NewRecentSeries(),
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+}
+
+// GPUSeconds approximates the GPU seconds allocated per user by integrating
+// the allocated GPUs over the time between two collections. The GPUs seen on
+// a collection are assumed to stay allocated until the next collection.
+type GPUSeconds struct {
+	sync.Mutex
+	last   time.Time
+	alloc  map[string]float64
+	totals map[string]float64
+	// last collection with GPUs allocated per user
+	lastSeen map[string]time.Time
+	limited  *LimitedCounters
+}
+
+func NewGPUSeconds() *GPUSeconds {
+	return &GPUSeconds{
+		alloc:    make(map[string]float64),
+		totals:   make(map[string]float64),
+		lastSeen: make(map[string]time.Time),
+		limited:  NewLimitedCounters(),
 	}
-	return out
 }
 
-func NewGPUsCollector() *GPUsCollector {
-	return &GPUsCollector{
-		alloc:       prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs", nil, nil),
-		idle:        prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs", nil, nil),
-		total:       prometheus.NewDesc("slurm_gpus_total", "Total GPUs", nil, nil),
-		utilization: prometheus.NewDesc("slurm_gpus_utilization", "Total GPU utilization", nil, nil),
-		userAlloc:   prometheus.NewDesc("slurm_user_gpus_running", "GPUs allocated per user for running jobs", []string{"user"}, nil),
+// Add accounts the previous allocation up to now, remembers the current
+// allocation and returns a copy of the totals. Concurrent collections are
+// serialized, hence every interval is only counted once. Users without
+// running jobs keep their total, so that the counter never decreases, until
+// the GPU seconds retention has passed since their last running job. The
+// totals are limited to the user metrics limit by LimitedCounters.
+func (gs *GPUSeconds) Add(now time.Time, alloc map[string]float64) map[string]float64 {
+	gs.Lock()
+	defer gs.Unlock()
+	if !gs.last.IsZero() && now.After(gs.last) {
+		elapsed := now.Sub(gs.last).Seconds()
+		for user, gpus := range gs.alloc {
+			gs.totals[user] += gpus * elapsed
+		}
+	}
+	if now.After(gs.last) {
+		gs.last = now
+	}
+	gs.alloc = make(map[string]float64)
+	totals := make(map[string]float64)
+	for user, gpus := range alloc {
+		if !UserSelected(user) {
+			continue
+		}
+		gs.alloc[user] = gpus
+		gs.lastSeen[user] = now
+		totals[user] = 0
 	}
+	for user, seconds := range gs.totals {
+		if *gpuSecondsRetention > 0 && now.Sub(gs.lastSeen[user]) > *gpuSecondsRetention {
+			delete(gs.totals, user)
+			delete(gs.lastSeen, user)
+			continue
+		}
+		totals[user] = seconds
+	}
+	return gs.limited.Limit(totals)[0]
+}
+
+// Reset forgets the allocation of the last collection, e.g. after a failed
+// collection. The time until the next collection is not accounted, instead
+// of accounting the stale allocation for the whole outage.
+func (gs *GPUSeconds) Reset() {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.last = time.Time{}
+	gs.alloc = make(map[string]float64)
 }
 
 type GPUsCollector struct {
-	alloc       *prometheus.Desc
-	idle        *prometheus.Desc
-	total       *prometheus.Desc
-	utilization *prometheus.Desc
-	userAlloc   *prometheus.Desc
+	alloc           *prometheus.Desc
+	idle            *prometheus.Desc
+	unavailable     *prometheus.Desc
+	total           *prometheus.Desc
+	utilization     *prometheus.Desc
+	typeUtilization *prometheus.Desc
+	maxFree         *prometheus.Desc
+	userAlloc       *prometheus.Desc
+	jobs            *prometheus.Desc
+	userJobs        *prometheus.Desc
+	nodeTotal       *prometheus.Desc
+	nodeAlloc       *prometheus.Desc
+	pending         *prometheus.Desc
+	largestPending  *prometheus.Desc
+	userPending     *prometheus.Desc
+	userLimited     *prometheus.Desc
+	userMem         *prometheus.Desc
+	accountAlloc    *prometheus.Desc
+	accountPending  *prometheus.Desc
+	userSeconds     *prometheus.Desc
+	gpuSeconds      *GPUSeconds
+	inconsistency   *prometheus.Desc
+	// collections with inconsistent GPU accounting
+	inconsistencies atomic.Uint64
+	// users and accounts exported with 0 after their last job
+	userAllocSeries      *RecentSeries
+	userJobsSeries       *RecentSeries
+	userPendingSeries    *RecentSeries
+	accountAllocSeries   *RecentSeries
+	accountPendingSeries *RecentSeries
+	partitionTotal       *prometheus.Desc
+	partitionAlloc       *prometheus.Desc
+	partitionIdle        *prometheus.Desc
 }
 
 func (cc *GPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.alloc
 	ch <- cc.idle
+	ch <- cc.unavailable
 	ch <- cc.total
 	ch <- cc.utilization
+	ch <- cc.typeUtilization
+	ch <- cc.maxFree
 	ch <- cc.userAlloc
+	ch <- cc.jobs
+	ch <- cc.userJobs
+	ch <- cc.nodeTotal
+	ch <- cc.nodeAlloc
+	ch <- cc.pending
+	ch <- cc.largestPending
+	ch <- cc.userPending
+	ch <- cc.userLimited
+	ch <- cc.userMem
+	ch <- cc.accountAlloc
+	ch <- cc.accountPending
+	ch <- cc.userSeconds
+	ch <- cc.inconsistency
+	ch <- cc.partitionTotal
+	ch <- cc.partitionAlloc
+	ch <- cc.partitionIdle
 }
 
-func (cc *GPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := GPUsGetMetrics()
-	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
-	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
-	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
-	ch <- prometheus.MustNewConstMetric(cc.utilization, prometheus.GaugeValue, cm.utilization)
-	for user, alloc := range cm.userAlloc {
+func (cc *GPUsCollector) Update(ch chan<- prometheus.Metric) error {
+	cm, err := ParseGPUsMetrics()
+	if err != nil {
+		cc.gpuSeconds.Reset()
+		return err
+	}
+	// the idle GPUs are never negative, but more allocated than total GPUs
+	// point to a disagreement of the Slurm commands worth investigating
+	if len(cm.inconsistentTypes) > 0 {
+		cc.inconsistencies.Add(1)
+		slog.Warn("More GPUs allocated than known by sinfo", "types", strings.Join(cm.inconsistentTypes, ","))
+	}
+	ch <- prometheus.MustNewConstMetric(cc.inconsistency, prometheus.CounterValue, float64(cc.inconsistencies.Load()))
+	// GPU types which are allocated but unknown to sinfo are reported as well
+	types := make(map[string]bool)
+	for gpuType := range cm.typeTotal {
+		types[gpuType] = true
+	}
+	for gpuType := range cm.typeAlloc {
+		types[gpuType] = true
+	}
+	for gpuType := range cm.typeSuspended {
+		types[gpuType] = true
+	}
+	for gpuType := range types {
+		model, profile := SplitGpuType(gpuType)
+		ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.typeAlloc[gpuType], model, profile, "running")
+		ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.typeSuspended[gpuType], model, profile, "suspended")
+		ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.typeIdle[gpuType], model, profile)
+		ch <- prometheus.MustNewConstMetric(cc.unavailable, prometheus.GaugeValue, cm.typeUnavailable[gpuType], model, profile)
+		ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.typeTotal[gpuType], model, profile)
+		if utilization, ok := TypeUtilization(cm.typeTotal[gpuType], cm.typeAlloc[gpuType]+cm.typeSuspended[gpuType]); ok {
+			ch <- prometheus.MustNewConstMetric(cc.typeUtilization, prometheus.GaugeValue, UtilizationValue(utilization), model, profile)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(cc.utilization, prometheus.GaugeValue, UtilizationValue(cm.utilization))
+	ch <- prometheus.MustNewConstMetric(cc.maxFree, prometheus.GaugeValue, cm.maxFree)
+	now := time.Now()
+	for user, alloc := range LimitUsers(cc.userAllocSeries.Fill(now, cm.userAlloc)) {
 		ch <- prometheus.MustNewConstMetric(cc.userAlloc, prometheus.GaugeValue, alloc, user)
 	}
+	ch <- prometheus.MustNewConstMetric(cc.jobs, prometheus.GaugeValue, cm.jobs)
+	for user, jobs := range LimitUsers(cc.userJobsSeries.Fill(now, cm.userJobs)) {
+		ch <- prometheus.MustNewConstMetric(cc.userJobs, prometheus.GaugeValue, jobs, user)
+	}
+	for node, gpus := range cm.nodeGpus {
+		for gpuType, total := range gpus.typeTotal {
+			model, profile := SplitGpuType(gpuType)
+			ch <- prometheus.MustNewConstMetric(cc.nodeTotal, prometheus.GaugeValue, total, node, model, profile)
+			ch <- prometheus.MustNewConstMetric(cc.nodeAlloc, prometheus.GaugeValue, gpus.typeAlloc[gpuType], node, model, profile)
+		}
+		// GPU types used but unknown to the GRES of the node are reported as well
+		for gpuType, alloc := range gpus.typeAlloc {
+			if _, ok := gpus.typeTotal[gpuType]; !ok {
+				model, profile := SplitGpuType(gpuType)
+				ch <- prometheus.MustNewConstMetric(cc.nodeAlloc, prometheus.GaugeValue, alloc, node, model, profile)
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(cc.pending, prometheus.GaugeValue, cm.pending)
+	ch <- prometheus.MustNewConstMetric(cc.largestPending, prometheus.GaugeValue, cm.largestPending)
+	for user, pending := range LimitUsers(cc.userPendingSeries.Fill(now, cm.userPending)) {
+		ch <- prometheus.MustNewConstMetric(cc.userPending, prometheus.GaugeValue, pending, user)
+	}
+	for user, jobs := range LimitUsers(cm.userLimited) {
+		ch <- prometheus.MustNewConstMetric(cc.userLimited, prometheus.GaugeValue, jobs, user)
+	}
+	for user, memory := range LimitUsers(cm.userMem) {
+		ch <- prometheus.MustNewConstMetric(cc.userMem, prometheus.GaugeValue, memory, user)
+	}
+	for user, seconds := range cc.gpuSeconds.Add(now, cm.userAlloc) {
+		ch <- prometheus.MustNewConstMetric(cc.userSeconds, prometheus.CounterValue, seconds, user)
+	}
+	for account, gpus := range cc.accountAllocSeries.Fill(now, cm.accountAlloc) {
+		ch <- prometheus.MustNewConstMetric(cc.accountAlloc, prometheus.GaugeValue, gpus, account)
+	}
+	for account, gpus := range cc.accountPendingSeries.Fill(now, cm.accountPending) {
+		ch <- prometheus.MustNewConstMetric(cc.accountPending, prometheus.GaugeValue, gpus, account)
+	}
+	for partition, gpus := range cm.partitionGpus {
+		ch <- prometheus.MustNewConstMetric(cc.partitionTotal, prometheus.GaugeValue, gpus.total, partition)
+		ch <- prometheus.MustNewConstMetric(cc.partitionAlloc, prometheus.GaugeValue, gpus.alloc, partition)
+		ch <- prometheus.MustNewConstMetric(cc.partitionIdle, prometheus.GaugeValue, gpus.idle, partition)
+	}
+	return nil
+}
+
+// Parse returns the GPUs as parsed from the Slurm commands, all users before
+// the user metrics limit and without the GPU seconds, see DebugParser
+func (cc *GPUsCollector) Parse() (interface{}, error) {
+	return ParseGPUsMetrics()
 }
@@ -0,0 +1,404 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGpuTres(t *testing.T) {
+	gpus, types := ParseGpuTres("billing=8,cpu=8,gres/gpu=2,gres/gpu:a100=2,mem=64G,node=1")
+	assert.Equal(t, 2.0, gpus)
+	assert.Equal(t, map[string]float64{"a100": 2}, types)
+
+	gpus, types = ParseGpuTres("cpu=4,gres/gpu=4,mem=16G,node=1")
+	assert.Equal(t, 4.0, gpus)
+	assert.Equal(t, map[string]float64{unknownGpuType: 4}, types)
+
+	gpus, types = ParseGpuTres("cpu=4,gres/gpu:v100=1,gres/gpu:a100=2")
+	assert.Equal(t, 3.0, gpus)
+	assert.Equal(t, map[string]float64{"v100": 1, "a100": 2}, types)
+
+	gpus, types = ParseGpuTres("cpu=1,gres/gpu:a100=1")
+	assert.Equal(t, 1.0, gpus)
+	assert.Equal(t, map[string]float64{"a100": 1}, types)
+
+	gpus, types = ParseGpuTres("cpu=4,mem=16G,node=1")
+	assert.Equal(t, 0.0, gpus)
+	assert.Empty(t, types)
+}
+
+func TestParseGres(t *testing.T) {
+	entries := ParseGres("gpu:a100:2(IDX:0,2),nic:1,gpu:4")
+	assert.Equal(t, []GresEntry{
+		{name: "gpu", gresType: "a100", count: 2},
+		{name: "nic", count: 1},
+		{name: "gpu", count: 4},
+	}, entries)
+	assert.Equal(t, []GresEntry{{name: "gpu", gresType: "v100", count: 4}}, ParseGres("gpu:v100:4(S:0-1)"))
+	assert.Equal(t, []GresEntry{{name: "gpu", gresType: "v100", count: 4}}, ParseGres("gpu:v100:4G"))
+	assert.Equal(t, []GresEntry{
+		{name: "gpu", gresType: "a100", count: 2, noConsume: true},
+		{name: "gpu", count: 1, noConsume: true},
+	}, ParseGres("gpu:a100:no_consume:2,gpu:No_Consume:1"))
+	assert.Empty(t, ParseGres("(null)"))
+}
+
+func TestParseNodeGPUsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes := ParseNodeGPUsMetrics(data)
+	t.Logf("%+v", nodes)
+	assert.NotContains(t, nodes, "cpu001")
+	assert.Equal(t, &NodeGPUsMetrics{total: 4, alloc: 4, typeTotal: map[string]float64{"a100": 4}, typeAlloc: map[string]float64{"a100": 4}}, nodes["gpu001"])
+	assert.Equal(t, &NodeGPUsMetrics{total: 4, alloc: 1, typeTotal: map[string]float64{"a100": 4}, typeAlloc: map[string]float64{"a100": 1}}, nodes["gpu002"])
+	assert.Equal(t, &NodeGPUsMetrics{total: 2, alloc: 0, typeTotal: map[string]float64{"v100": 2}, typeAlloc: map[string]float64{"v100": 0}}, nodes["gpu003"])
+	assert.Equal(t, &NodeGPUsMetrics{total: 2, alloc: 2, typeTotal: map[string]float64{unknownGpuType: 2}, typeAlloc: map[string]float64{unknownGpuType: 2}}, nodes["gpu004"])
+	// a node with two GPU models, the totals and allocations per type sum up to its total and allocation
+	assert.Equal(t, &NodeGPUsMetrics{total: 4, alloc: 1, typeTotal: map[string]float64{"a100": 2, "v100": 2}, typeAlloc: map[string]float64{"a100": 1, "v100": 0}}, nodes["gpu005"])
+	for node, nm := range nodes {
+		var sum, alloc float64
+		for _, total := range nm.typeTotal {
+			sum += total
+		}
+		for _, count := range nm.typeAlloc {
+			alloc += count
+		}
+		assert.Equal(t, nm.total, sum, "node %s", node)
+		assert.Equal(t, nm.alloc, alloc, "node %s", node)
+	}
+}
+
+func TestParsePartitionGPUsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]*NodeGPUsMetrics{
+		"gpu":   {total: 14, alloc: 6, idle: 2},
+		"main":  {total: 4, alloc: 1, idle: 0},
+		"debug": {total: 2, alloc: 2, idle: 0},
+	}, ParsePartitionGPUsMetrics(data))
+}
+
+func TestParseMaxFreeGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// gpu002 and gpu005 have 3 free GPUs, but are drained and down
+	assert.Equal(t, 2.0, ParseMaxFreeGPUs(data))
+}
+
+func TestParsePendingGPUsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_pending.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	pending, userPending := ParsePendingGPUsMetrics(data)
+	assert.Equal(t, 19.0, pending)
+	assert.Equal(t, map[string]float64{"alice": 10, "bob": 8, "dave": 1}, userPending)
+	// alice requests 4 GPUs on each of 2 nodes, bob 8 GPUs per job
+	assert.Equal(t, 8.0, ParseLargestPendingGPURequest(data))
+	assert.Equal(t, 0.0, ParseLargestPendingGPURequest([]byte("")))
+	// carol requests no GPUs, the job of alice pending for resources waits for busy GPUs
+	assert.Equal(t, map[string]float64{"alice": 1, "bob": 1}, ParseLimitedPendingGPUJobs(data))
+	assert.True(t, GPULimitReason("QOSMaxGRESPerUser"))
+	assert.False(t, GPULimitReason("Resources"))
+	// the job of carol requests no GPUs
+	assert.Equal(t, map[string]float64{"physics": 10, "chemistry": 9}, ParseAccountPendingGPUs(data))
+}
+
+func TestSplitGpuType(t *testing.T) {
+	types := map[string][2]string{
+		"a100":                {"a100", ""},
+		"a100_1g.5gb":         {"a100", "1g.5gb"},
+		"nvidia_a100_3g.20gb": {"nvidia_a100", "3g.20gb"},
+		"1g.10gb":             {unknownGpuType, "1g.10gb"},
+		"mig":                 {unknownGpuType, "mig"},
+		unknownGpuType:        {unknownGpuType, ""},
+	}
+	for gpuType, expected := range types {
+		model, profile := SplitGpuType(gpuType)
+		assert.Equal(t, expected, [2]string{model, profile}, "type %q", gpuType)
+	}
+	gpus, byType := ParseGpuTres("cpu=2,gres/gpu=2,gres/gpu:a100_1g.5gb=2")
+	assert.Equal(t, 2.0, gpus)
+	assert.Equal(t, map[string]float64{"a100_1g.5gb": 2}, byType)
+}
+
+func TestParseAllocatedGPUsJSON(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_running.json")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	am, err := ParseAllocatedGPUsJSON(data)
+	if err != nil {
+		t.Fatalf("Can not parse test data: %v", err)
+	}
+	assert.Equal(t, map[string]float64{"a100": 2, unknownGpuType: 1}, am.typeGpus)
+	assert.Equal(t, map[string]float64{"alice": 2, "bob": 1}, am.userGpus)
+	assert.Equal(t, map[string]float64{"alice": 64 << 30}, am.userMem)
+	assert.Equal(t, map[string]float64{"physics": 3}, am.accountGpus)
+	assert.Equal(t, 2.0, am.jobs)
+	assert.Equal(t, map[string]float64{"alice": 1, "bob": 1}, am.userJobs)
+	// the state of newer Slurm versions is a list
+	assert.Equal(t, map[string]float64{"a100": 1}, am.typeSuspended)
+
+	_, err = ParseAllocatedGPUsJSON([]byte("sacct: error: invalid"))
+	assert.Error(t, err)
+}
+
+func TestParseAllocatedGPUsText(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_running.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	am := ParseAllocatedGPUsText(data)
+	assert.Equal(t, map[string]float64{"a100": 3, unknownGpuType: 1}, am.typeGpus)
+	assert.Equal(t, map[string]float64{"alice": 3, "bob": 1}, am.userGpus)
+	assert.Equal(t, map[string]float64{"alice": 80 << 30, "bob": 16 << 30, "carol": 512 << 20}, am.userMem)
+	assert.Equal(t, map[string]float64{"physics": 3, "chemistry": 1}, am.accountGpus)
+	// jobs without GPUs and suspended jobs are not counted
+	assert.Equal(t, 3.0, am.jobs)
+	assert.Equal(t, map[string]float64{"alice": 2, "bob": 1}, am.userJobs)
+	// the suspended job of erin counts for neither her nor her account
+	assert.Equal(t, map[string]float64{"a100": 2}, am.typeSuspended)
+}
+
+func TestParseAllocatedGPUsHetJob(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_hetjob.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	am := ParseAllocatedGPUsText(data)
+	// the GPU component 4720+1 is printed without user and account
+	assert.Equal(t, map[string]float64{"erin": 5, "frank": 1}, am.userGpus)
+	assert.Equal(t, map[string]float64{"physics": 5, "chemistry": 1}, am.accountGpus)
+	assert.Equal(t, map[string]float64{"a100": 4, unknownGpuType: 2}, am.typeGpus)
+	assert.Equal(t, 104.0*(1<<30), am.userMem["erin"])
+	// both GPU components of 4720 count as one job
+	assert.Equal(t, map[string]float64{"erin": 1, "frank": 1}, am.userJobs)
+}
+
+func TestParseJobTres(t *testing.T) {
+	jt := ParseJobTres("billing=8,cpu=8,gres/gpu=2,gres/gpu:a100=2,mem=64G,node=1")
+	assert.Equal(t, JobTres{gpus: 2, gpuTypes: map[string]float64{"a100": 2}, mem: 64 << 30}, jt)
+}
+
+func TestParseAllocatedGPUsSqueue(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"squeue -a -r -h --states=RUNNING,SUSPENDED -O JobID:30,HetJobID:30,UserName:100,Account:100,tres-alloc:200,State:20": "test_data/squeue_running.txt",
+	})()
+	defer flag.Set("slurm.running-source", "sacct")
+
+	flag.Set("slurm.running-source", "squeue")
+	am, err := ParseAllocatedGPUs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a100": 3, unknownGpuType: 3}, am.typeGpus)
+	assert.Equal(t, map[string]float64{"alice": 3, "bob": 1, "dave": 2}, am.userGpus)
+	assert.Equal(t, map[string]float64{"physics": 3, "chemistry": 1, "biology": 2}, am.accountGpus)
+	assert.Equal(t, map[string]float64{"alice": 80 << 30, "bob": 16 << 30, "carol": 512 << 20, "dave": 16 << 30}, am.userMem)
+	assert.Equal(t, map[string]float64{"a100": 2}, am.typeSuspended)
+	// the two components of the heterogeneous job 4720 are a single job
+	assert.Equal(t, map[string]float64{"alice": 2, "bob": 1, "dave": 1}, am.userJobs)
+	assert.Equal(t, 4.0, am.jobs)
+}
+
+func TestGPUSeconds(t *testing.T) {
+	gs := NewGPUSeconds()
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, map[string]float64{"alice": 0}, gs.Add(start, map[string]float64{"alice": 2}))
+	totals := gs.Add(start.Add(time.Minute), map[string]float64{"alice": 2, "bob": 1})
+	assert.Equal(t, map[string]float64{"alice": 120, "bob": 0}, totals)
+	// alice finished her jobs, her total is kept
+	totals = gs.Add(start.Add(2*time.Minute), map[string]float64{"bob": 1})
+	assert.Equal(t, map[string]float64{"alice": 240, "bob": 60}, totals)
+	// a collection which is not newer than the last one adds nothing
+	totals = gs.Add(start.Add(2*time.Minute), map[string]float64{"bob": 1})
+	assert.Equal(t, map[string]float64{"alice": 240, "bob": 60}, totals)
+
+	// a failed collection does not account the allocation for the outage
+	gs.Reset()
+	totals = gs.Add(start.Add(time.Hour), map[string]float64{"bob": 1})
+	assert.Equal(t, map[string]float64{"alice": 240, "bob": 60}, totals)
+
+	// alice is dropped once the retention has passed since her last job
+	totals = gs.Add(start.Add(25*time.Hour), map[string]float64{"bob": 1})
+	assert.NotContains(t, totals, "alice")
+	assert.Contains(t, totals, "bob")
+
+	// the users beyond the limit are folded into __other__, which never
+	// decreases when the ranking of the users changes
+	defer flag.Set("slurm.user-metrics-limit", "0")
+	flag.Set("slurm.user-metrics-limit", "1")
+	gs = NewGPUSeconds()
+	gs.Add(start, map[string]float64{"alice": 2, "bob": 1})
+	totals = gs.Add(start.Add(time.Minute), map[string]float64{"alice": 2, "bob": 4})
+	assert.Equal(t, map[string]float64{"alice": 120, otherUsers: 60}, totals)
+	totals = gs.Add(start.Add(2*time.Minute), map[string]float64{"alice": 2, "bob": 4})
+	assert.Equal(t, map[string]float64{"alice": 240, otherUsers: 300}, totals)
+}
+
+func TestParseTresMemory(t *testing.T) {
+	for value, expected := range map[string]float64{"64G": 64 << 30, "512M": 512 << 20, "2T": 2 << 40, "100K": 100 << 10, "1024": 1 << 30} {
+		memory, err := ParseTresMemory(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, memory, "value %q", value)
+	}
+	_, err := ParseTresMemory("N/A")
+	assert.Error(t, err)
+}
+
+func TestParseTotalGPUsText(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	total, unavailable := ParseTotalGPUsText(data)
+	// the shared no_consume GPUs of gpu008 are no capacity to allocate
+	assert.Equal(t, map[string]float64{"a100": 8, "v100": 16, unknownGpuType: 4}, total)
+	// drained and down nodes
+	assert.Equal(t, map[string]float64{"a100": 2, "v100": 6}, unavailable)
+
+	// gpu001 and gpu002 belong to two partitions, sinfo prints them twice
+	data, err = ioutil.ReadFile("test_data/sinfo_gpus_partitions.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	total, unavailable = ParseTotalGPUsText(data)
+	assert.Equal(t, map[string]float64{"a100": 4, "v100": 4}, total)
+	assert.Equal(t, map[string]float64{"v100": 2}, unavailable)
+
+}
+
+// Recorded output of all Slurm commands run by the GPUs collector
+var gpusFixtures = fixtureExecutor{
+	"sinfo -h -o %n %T %G": "test_data/sinfo_gpus.txt",
+	"sacct -a -X --format=JobID,User,Account,AllocTRES,State --state=RUNNING,SUSPENDED --noheader --parsable2 --starttime=now --endtime=now": "test_data/sacct_running.txt",
+	"sinfo -h -N -O NodeHost:100,Partition:100,Gres:200,GresUsed:200,StateLong:50":                                                           "test_data/sinfo_gres.txt",
+	"squeue -a -r -h --states=PENDING -O UserName:100,NumNodes:20,tres-per-node:200,tres-per-job:200,Reason:100,Account:100":                 "test_data/squeue_gpus_pending.txt",
+}
+
+func TestParseTotalGPUs(t *testing.T) {
+	defer useFixtures(gpusFixtures)()
+	total, unavailable, err := ParseTotalGPUs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a100": 8, "v100": 16, unknownGpuType: 4}, total)
+	assert.Equal(t, 6.0, unavailable["v100"])
+}
+
+func TestParseAllocatedGPUs(t *testing.T) {
+	defer useFixtures(gpusFixtures)()
+	am, err := ParseAllocatedGPUs()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a100": 3, unknownGpuType: 1}, am.typeGpus)
+	assert.Equal(t, map[string]float64{"alice": 3, "bob": 1}, am.userGpus)
+}
+
+func TestParseGPUsMetrics(t *testing.T) {
+	defer useFixtures(gpusFixtures)()
+	gm, err := ParseGPUsMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, 28.0, gm.total)
+	// 4 GPUs of running and 2 of suspended jobs
+	assert.Equal(t, 6.0, gm.alloc)
+	assert.Equal(t, 8.0, gm.unavailable)
+	// gpu003 of sinfo_gres.txt is the only usable node with free GPUs
+	assert.Equal(t, 2.0, gm.idle)
+	assert.Equal(t, 6.0/28.0, gm.utilization)
+	assert.Equal(t, 19.0, gm.pending)
+	assert.Equal(t, 2.0, gm.maxFree)
+	// typed allocations like "gres/gpu:a100=1" line up with the typed GRES of sinfo
+	assert.Equal(t, 3.0, gm.typeAlloc["a100"])
+	assert.Equal(t, 2.0, gm.typeSuspended["a100"])
+	assert.Equal(t, 8.0, gm.typeTotal["a100"])
+	assert.Equal(t, &NodeGPUsMetrics{total: 4, alloc: 1, typeTotal: map[string]float64{"a100": 4}, typeAlloc: map[string]float64{"a100": 1}}, gm.nodeGpus["gpu002"])
+}
+
+func TestNodeStateUsable(t *testing.T) {
+	assert.True(t, NodeStateUsable("mixed"))
+	assert.False(t, NodeStateUsable("drained"))
+	// nodes not responding to slurmctld
+	assert.False(t, NodeStateUsable("idle*"))
+	assert.False(t, NodeStateUsable("mixed*"))
+	// nodes powered down or powering up by the power saving
+	assert.False(t, NodeStateUsable("idle~"))
+	assert.False(t, NodeStateUsable("idle#"))
+}
+
+func TestParseIdleGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// only gpu003 is usable and has free GPUs, the free GPUs of the drained
+	// gpu002 and the down gpu005 are not idle
+	idle, typeIdle := ParseIdleGPUs(data)
+	assert.Equal(t, 2.0, idle)
+	assert.Equal(t, map[string]float64{"a100": 0, "v100": 2, unknownGpuType: 0}, typeIdle)
+
+	// an idle node next to a draining node running a job on all its GPUs
+	idle, typeIdle = ParseIdleGPUs([]byte(
+		"gpu010 gpu gpu:a100:4 gpu:a100:0 idle\n" +
+			"gpu011 gpu gpu:a100:4 gpu:a100:4(IDX:0-3) draining\n"))
+	assert.Equal(t, 4.0, idle)
+	assert.Equal(t, map[string]float64{"a100": 4}, typeIdle)
+
+	// the shared no_consume GPUs of a node neither count as total nor idle
+	idle, typeIdle = ParseIdleGPUs([]byte(
+		"gpu012 gpu gpu:a100:2,gpu:shared:no_consume:4 gpu:a100:1(IDX:0),gpu:shared:no_consume:0 mixed\n" +
+			"gpu013 gpu gpu:no_consume:4 gpu:no_consume:0 idle\n"))
+	assert.Equal(t, 1.0, idle)
+	assert.Equal(t, map[string]float64{"a100": 1}, typeIdle)
+}
+
+func TestTypeUtilization(t *testing.T) {
+	utilization, ok := TypeUtilization(8, 6)
+	assert.True(t, ok)
+	assert.Equal(t, 0.75, utilization)
+	// allocated GPUs of a type unknown to sinfo
+	_, ok = TypeUtilization(0, 2)
+	assert.False(t, ok)
+}
+
+func TestInconsistentGPUTypes(t *testing.T) {
+	total := map[string]float64{"a100": 8, "v100": 4}
+	assert.Empty(t, InconsistentGPUTypes(total, map[string]float64{"a100": 8}, map[string]float64{"v100": 4}))
+	assert.Equal(t, []string{"a100", "h100", "v100"}, InconsistentGPUTypes(total,
+		map[string]float64{"a100": 6, "h100": 1}, map[string]float64{"a100": 3, "v100": 5}))
+}
+
+func TestParseGPUsMetricsFailure(t *testing.T) {
+	defer useFixtures(fixtureExecutor{})()
+	gm, err := ParseGPUsMetrics()
+	assert.Error(t, err)
+	assert.Equal(t, 0.0, gm.total)
+}
+
+func TestRunningSacctArguments(t *testing.T) {
+	defer flag.Set("slurm.running-sacct-args", "")
+	assert.Equal(t, []string{"-a", "--starttime=now", "--endtime=now"}, RunningSacctArguments([]string{"-a"}))
+	flag.Set("slurm.running-sacct-args", "--qos=gpu  --user=alice")
+	assert.Equal(t, []string{"-a", "--starttime=now", "--endtime=now", "--qos=gpu", "--user=alice"}, RunningSacctArguments([]string{"-a"}))
+}
@@ -0,0 +1,195 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GresMetrics stores the total and allocated GRES per name, e.g. gpu, fpga or nic
+type GresMetrics struct {
+	total map[string]float64
+	alloc map[string]float64
+}
+
+// Execute sinfo to get the GRES of every node
+func GresTotalData() ([]byte, error) {
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-o", "%n %G"}))
+}
+
+// Execute sacct, or squeue if configured as source of the running jobs, to
+// get the TRES allocated to running jobs
+func GresAllocData() ([]byte, error) {
+	if *runningSource == "squeue" {
+		return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "--states=RUNNING", "-O", "JobID:30,tres-alloc:200"}))
+	}
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--format=JobID,AllocTRES", "--state=RUNNING", "--noheader", "--parsable2"}))
+}
+
+// ParseGresTotal parses lines of "Hostname GRES" as printed by sinfo and
+// sums the GRES per name over all nodes. sinfo prints a node once per
+// partition, thus every node is counted once. GRES configured as
+// "no_consume" are shared by all jobs of a node and are no total to
+// allocate from, they are skipped.
+func ParseGresTotal(input []byte) map[string]float64 {
+	total := make(map[string]float64)
+	nodes := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || nodes[fields[0]] {
+			continue
+		}
+		nodes[fields[0]] = true
+		for _, entry := range ParseGres(fields[1]) {
+			if !entry.noConsume {
+				total[entry.name] += entry.count
+			}
+		}
+	}
+	return total
+}
+
+// ParseGresTres extracts the GRES per name of a TRES string, e.g.
+// "cpu=8,gres/fpga=1,gres/gpu=2,gres/gpu:a100=2". Typed entries are only
+// summed if there is no untyped entry of the same name, like for GPUs.
+func ParseGresTres(tres string) map[string]float64 {
+	untyped := make(map[string]float64)
+	typed := make(map[string]float64)
+	for _, part := range strings.Split(tres, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "gres/") {
+			continue
+		}
+		count, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(kv[0], "gres/")
+		if i := strings.Index(name, ":"); i >= 0 {
+			typed[name[:i]] += count
+		} else {
+			untyped[name] += count
+		}
+	}
+	for name, count := range typed {
+		if _, ok := untyped[name]; !ok {
+			untyped[name] = count
+		}
+	}
+	return untyped
+}
+
+// ParseGresAlloc parses the job ID and the allocated TRES of running jobs,
+// separated by "|" as printed by sacct or by spaces as printed by squeue,
+// and sums the GRES per name. Every job ID is counted once.
+func ParseGresAlloc(input []byte) map[string]float64 {
+	alloc := make(map[string]float64)
+	jobs := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			fields = strings.Fields(line)
+		}
+		if len(fields) < 2 || jobs[fields[0]] {
+			continue
+		}
+		jobs[fields[0]] = true
+		for name, count := range ParseGresTres(fields[1]) {
+			alloc[name] += count
+		}
+	}
+	return alloc
+}
+
+// GresGetMetrics runs sinfo and sacct, or squeue, concurrently and returns
+// the total and allocated GRES
+func GresGetMetrics() (*GresMetrics, error) {
+	var (
+		wg                   sync.WaitGroup
+		totalData, allocData []byte
+		totalErr, allocErr   error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		totalData, totalErr = GresTotalData()
+	}()
+	go func() {
+		defer wg.Done()
+		allocData, allocErr = GresAllocData()
+	}()
+	wg.Wait()
+	for _, err := range []error{totalErr, allocErr} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &GresMetrics{total: ParseGresTotal(totalData), alloc: ParseGresAlloc(allocData)}, nil
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * metrics of the generic resources into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewGresCollector() *GresCollector {
+	labels := []string{"name"}
+	return &GresCollector{
+		total: NewDesc("slurm_gres_total", "Total generic resources per name", labels, nil),
+		alloc: NewDesc("slurm_gres_alloc", "Generic resources allocated to running jobs per name", labels, nil),
+	}
+}
+
+type GresCollector struct {
+	total *prometheus.Desc
+	alloc *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (gc *GresCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gc.total
+	ch <- gc.alloc
+}
+
+func (gc *GresCollector) Update(ch chan<- prometheus.Metric) error {
+	gm, err := GresGetMetrics()
+	if err != nil {
+		return err
+	}
+	// GRES which are allocated but unknown to sinfo are reported as well
+	names := make(map[string]bool)
+	for name := range gm.total {
+		names[name] = true
+	}
+	for name := range gm.alloc {
+		names[name] = true
+	}
+	for name := range names {
+		ch <- prometheus.MustNewConstMetric(gc.total, prometheus.GaugeValue, gm.total[name], name)
+		ch <- prometheus.MustNewConstMetric(gc.alloc, prometheus.GaugeValue, gm.alloc[name], name)
+	}
+	return nil
+}
+
+// Parse returns the generic resources as parsed from sinfo and squeue, see
+// DebugParser
+func (gc *GresCollector) Parse() (interface{}, error) {
+	return GresGetMetrics()
+}
@@ -0,0 +1,45 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseGresTres(t *testing.T) {
+	assert.Equal(t, map[string]float64{"gpu": 2, "nic": 1}, ParseGresTres("cpu=8,gres/gpu=2,gres/gpu:a100=2,gres/nic=1"))
+	// only typed entries
+	assert.Equal(t, map[string]float64{"fpga": 3}, ParseGresTres("cpu=4,gres/fpga:xilinx=1,gres/fpga:intel=2"))
+}
+
+func TestGresGetMetrics(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sinfo -h -o %n %G": "test_data/sinfo_gres_names.txt",
+		"sacct -a -X --format=JobID,AllocTRES --state=RUNNING --noheader --parsable2": "test_data/sacct_gres.txt",
+	})()
+	gm, err := GresGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"fpga": 2, "gpu": 8, "nic": 3}, gm.total)
+	// job 4712 is printed twice
+	assert.Equal(t, map[string]float64{"fpga": 1, "gpu": 2, "nic": 1}, gm.alloc)
+}
+
+func TestParseGresTotal(t *testing.T) {
+	// the shared no_consume license server is no total to allocate from
+	assert.Equal(t, map[string]float64{"gpu": 4}, ParseGresTotal([]byte(
+		"gpu001 gpu:a100:4,lic:no_consume:1\ngpu001 gpu:a100:4,lic:no_consume:1\n")))
+}
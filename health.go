@@ -0,0 +1,50 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum run time of the command used by the health check, kept short
+// so that liveness and readiness probes respond quickly
+const healthCheckTimeout = 5 * time.Second
+
+// HealthHandler verifies that slurmctld responds by running "scontrol ping",
+// a cheap round trip to the controller. It responds with 200 if a controller
+// is up and 503 along with the error otherwise, without collecting any
+// metrics. A down backup controller alone does not fail the check.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	// the probe bypasses the statistics and circuits of the Slurm commands,
+	// frequent probes would otherwise mask the failures of the collectors
+	out, err := executor.Execute(ctx, "scontrol", []string{"ping"})
+	if err == nil && !strings.Contains(string(out), " is UP") {
+		err = fmt.Errorf("no controller is up: %s", strings.TrimSpace(string(out)))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Unhealthy: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "OK: %s", out)
+}
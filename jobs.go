@@ -0,0 +1,247 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Execute sacct to get the jobs active within the configured time window.
+// Only the allocations are reported (-X), not their steps.
+func JobsData() ([]byte, error) {
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", SacctStartTime(*jobsWindow), "--endtime=now", "--format=JobID,Submit,End,State", "--noheader", "--parsable2"}))
+}
+
+// A range of the task IDs of a job array
+type taskRange struct {
+	first, last int
+}
+
+func (tr taskRange) tasks() int {
+	return tr.last - tr.first + 1
+}
+
+// ParseArrayJobID splits the ID of job array tasks as printed by sacct into
+// the ID of the array and the ranges of its task IDs, e.g. "4715_[1-3,7%2]"
+// into "4715" with the tasks 1 to 3 and 7, and "4715_1" into "4715" with the
+// task 1. The tasks are not expanded, a pending array may hold millions of
+// them. It returns false for jobs which are no job array.
+func ParseArrayJobID(id string) (string, []taskRange, bool) {
+	underscore := strings.Index(id, "_")
+	if underscore < 0 {
+		return id, nil, false
+	}
+	job, tasks := id[:underscore], id[underscore+1:]
+	if strings.HasPrefix(tasks, "[") && strings.HasSuffix(tasks, "]") {
+		tasks = tasks[1 : len(tasks)-1]
+	}
+	// the maximum number of simultaneously running tasks is irrelevant
+	if throttle := strings.Index(tasks, "%"); throttle >= 0 {
+		tasks = tasks[:throttle]
+	}
+	var ranges []taskRange
+	for _, part := range strings.Split(tasks, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return id, nil, false
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return id, nil, false
+			}
+		}
+		ranges = append(ranges, taskRange{first, last})
+	}
+	return job, ranges, true
+}
+
+// ParseJobsEvents parses lines of "JobID|Submit|End|State" as printed by
+// sacct and returns the submit time of all jobs and the end time of the
+// completed jobs by job ID as printed by sacct, e.g. "4715_[2-3]" for the
+// pending tasks of a job array. Job steps are skipped.
+func ParseJobsEvents(input []byte, location *time.Location) (submitted map[string]time.Time, completed map[string]time.Time) {
+	submitted = make(map[string]time.Time)
+	completed = make(map[string]time.Time)
+	for _, line := range strings.Split(string(input), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 4 || strings.Contains(parts[0], ".") {
+			continue
+		}
+		id := strings.TrimSpace(parts[0])
+		if submit, err := time.ParseInLocation(slurmTimeLayout, strings.TrimSpace(parts[1]), location); err == nil {
+			submitted[id] = submit
+		}
+		if !strings.HasPrefix(strings.TrimSpace(parts[3]), "COMPLETED") {
+			continue
+		}
+		// the end time of jobs which did not end yet is "Unknown"
+		if end, err := time.ParseInLocation(slurmTimeLayout, strings.TrimSpace(parts[2]), location); err == nil {
+			completed[id] = end
+		}
+	}
+	return submitted, completed
+}
+
+// JobsCounter counts the jobs of a sliding time window such that the count
+// never decreases. The jobs already counted are remembered until their event
+// is older than the window and sacct does not report it anymore. Every task
+// of a job array counts as a job, like squeue -r lists them, no matter if it
+// is already running or still pending in the array.
+type JobsCounter struct {
+	sync.Mutex
+	seen map[string]time.Time
+	// the task ranges counted per job array
+	tasks map[string][]countedTasks
+	total float64
+}
+
+// A range of tasks of a job array counted with the event of its job
+type countedTasks struct {
+	taskRange
+	event time.Time
+}
+
+func NewJobsCounter() *JobsCounter {
+	return &JobsCounter{seen: make(map[string]time.Time), tasks: make(map[string][]countedTasks)}
+}
+
+// Add counts the jobs not counted before whose event is within the window
+// ending now and returns the total number of jobs counted so far
+func (jc *JobsCounter) Add(now time.Time, window time.Duration, jobs map[string]time.Time) float64 {
+	jc.Lock()
+	defer jc.Unlock()
+	start := now.Add(-window)
+	for id, event := range jobs {
+		if event.Before(start) {
+			continue
+		}
+		if array, ranges, ok := ParseArrayJobID(id); ok {
+			for _, tr := range ranges {
+				jc.addTasks(array, tr, event)
+			}
+			continue
+		}
+		if _, ok := jc.seen[id]; !ok {
+			jc.seen[id] = event
+			jc.total++
+		}
+	}
+	for id, event := range jc.seen {
+		if event.Before(start) {
+			delete(jc.seen, id)
+		}
+	}
+	for array, counted := range jc.tasks {
+		var kept []countedTasks
+		for _, ct := range counted {
+			if !ct.event.Before(start) {
+				kept = append(kept, ct)
+			}
+		}
+		if len(kept) == 0 {
+			delete(jc.tasks, array)
+		} else {
+			jc.tasks[array] = kept
+		}
+	}
+	return jc.total
+}
+
+// addTasks counts the tasks of a range which are not counted yet, the ranges
+// counted per job array are kept disjoint
+func (jc *JobsCounter) addTasks(array string, tr taskRange, event time.Time) {
+	pending := []taskRange{tr}
+	for _, ct := range jc.tasks[array] {
+		var rest []taskRange
+		for _, p := range pending {
+			if p.last < ct.first || p.first > ct.last {
+				rest = append(rest, p)
+				continue
+			}
+			if p.first < ct.first {
+				rest = append(rest, taskRange{p.first, ct.first - 1})
+			}
+			if p.last > ct.last {
+				rest = append(rest, taskRange{ct.last + 1, p.last})
+			}
+		}
+		pending = rest
+	}
+	for _, p := range pending {
+		jc.tasks[array] = append(jc.tasks[array], countedTasks{p, event})
+		jc.total += float64(p.tasks())
+	}
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * counters of the submitted and completed jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewJobsCollector() *JobsCollector {
+	return &JobsCollector{
+		submitted:     NewDesc("slurm_jobs_submitted_total", "Jobs submitted since the start of the exporter", nil, nil),
+		completed:     NewDesc("slurm_jobs_completed_total", "Jobs completed since the start of the exporter", nil, nil),
+		submittedJobs: NewJobsCounter(),
+		completedJobs: NewJobsCounter(),
+	}
+}
+
+type JobsCollector struct {
+	submitted     *prometheus.Desc
+	completed     *prometheus.Desc
+	submittedJobs *JobsCounter
+	completedJobs *JobsCounter
+}
+
+// Send all metric descriptions
+func (jc *JobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jc.submitted
+	ch <- jc.completed
+}
+
+func (jc *JobsCollector) Update(ch chan<- prometheus.Metric) error {
+	now := time.Now()
+	data, err := JobsData()
+	if err != nil {
+		return err
+	}
+	submitted, completed := ParseJobsEvents(data, now.Location())
+	ch <- prometheus.MustNewConstMetric(jc.submitted, prometheus.CounterValue, jc.submittedJobs.Add(now, *jobsWindow, submitted))
+	ch <- prometheus.MustNewConstMetric(jc.completed, prometheus.CounterValue, jc.completedJobs.Add(now, *jobsWindow, completed))
+	return nil
+}
+
+// Parse returns the submit and end time of the jobs within the window, before
+// they are counted, see DebugParser
+func (jc *JobsCollector) Parse() (interface{}, error) {
+	data, err := JobsData()
+	if err != nil {
+		return nil, err
+	}
+	submitted, completed := ParseJobsEvents(data, time.Now().Location())
+	return struct {
+		Submitted map[string]time.Time `json:"submitted"`
+		Completed map[string]time.Time `json:"completed"`
+	}{submitted, completed}, nil
+}
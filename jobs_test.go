@@ -0,0 +1,87 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseArrayJobID(t *testing.T) {
+	_, _, ok := ParseArrayJobID("4711")
+	assert.False(t, ok)
+	job, ranges, ok := ParseArrayJobID("4715_1")
+	assert.True(t, ok)
+	assert.Equal(t, "4715", job)
+	assert.Equal(t, []taskRange{{1, 1}}, ranges)
+	job, ranges, ok = ParseArrayJobID("4715_[2-3,5%2]")
+	assert.True(t, ok)
+	assert.Equal(t, "4715", job)
+	assert.Equal(t, []taskRange{{2, 3}, {5, 5}}, ranges)
+	// the tasks of a large array are not expanded
+	_, ranges, ok = ParseArrayJobID("123_[1-4000000]")
+	assert.True(t, ok)
+	assert.Equal(t, []taskRange{{1, 4000000}}, ranges)
+}
+
+func TestParseJobsEvents(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_jobs.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	submitted, completed := ParseJobsEvents(data, time.UTC)
+	assert.Len(t, submitted, 6)
+	assert.Equal(t, time.Date(2021, 5, 1, 11, 30, 0, 0, time.UTC), submitted["4715_[2-3,5%2]"])
+	assert.Equal(t, map[string]time.Time{
+		"4711":   time.Date(2021, 5, 1, 11, 50, 0, 0, time.UTC),
+		"4712":   time.Date(2021, 5, 1, 11, 30, 0, 0, time.UTC),
+		"4715_1": time.Date(2021, 5, 1, 11, 45, 0, 0, time.UTC),
+	}, completed)
+}
+
+func TestJobsCounter(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_jobs.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	submitted, _ := ParseJobsEvents(data, time.UTC)
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	jc := NewJobsCounter()
+	// job 4712 was submitted before the window
+	assert.Equal(t, 7.0, jc.Add(now, time.Hour, submitted))
+	// the same jobs are reported by the next scrape and not counted again
+	assert.Equal(t, 7.0, jc.Add(now.Add(time.Minute), time.Hour, submitted))
+	// a job array task split off a pending job array was counted before
+	assert.Equal(t, 8.0, jc.Add(now.Add(2*time.Minute), time.Hour, map[string]time.Time{
+		"4715_2": time.Date(2021, 5, 1, 11, 30, 0, 0, time.UTC),
+		"4716":   time.Date(2021, 5, 1, 12, 1, 0, 0, time.UTC),
+	}))
+	// the jobs are forgotten when they leave the window, but the count is kept
+	assert.Equal(t, 8.0, jc.Add(now.Add(2*time.Hour), time.Hour, nil))
+	assert.Empty(t, jc.seen)
+	assert.Empty(t, jc.tasks)
+
+	// the tasks of a large pending array are counted without expanding them,
+	// tasks which started since are not counted again
+	jc = NewJobsCounter()
+	assert.Equal(t, 4000000.0, jc.Add(now, time.Hour, map[string]time.Time{"123_[1-4000000]": now}))
+	assert.Equal(t, 4000001.0, jc.Add(now.Add(time.Minute), time.Hour, map[string]time.Time{
+		"123_1":           now,
+		"123_[2-4000001]": now,
+	}))
+}
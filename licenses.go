@@ -0,0 +1,121 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+type LicenseMetrics struct {
+	total float64
+	used  float64
+	free  float64
+}
+
+// Execute scontrol to get all licenses, one per line
+func LicensesData() ([]byte, error) {
+	return Execute("scontrol", []string{"show", "licenses", "--oneliner"})
+}
+
+func LicensesGetMetrics() (map[string]*LicenseMetrics, error) {
+	data, err := LicensesData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseLicensesMetrics(data), nil
+}
+
+// ParseLicensesMetrics parses the licenses printed by scontrol as "Key=Value"
+// pairs. scontrol reports the local licenses of slurm.conf as well as the
+// remote licenses managed by the slurmdbd (sacctmgr show resource), which are
+// named "<name>@<server>" and keep that name. Slurm versions which do not
+// print the free licenses of remote licenses get them as total minus used.
+// Without any license, scontrol prints "No licenses configured in Slurm.",
+// which results in no metrics.
+func ParseLicensesMetrics(input []byte) map[string]*LicenseMetrics {
+	licenses := make(map[string]*LicenseMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		name, ok := fields["LicenseName"]
+		if !ok {
+			continue
+		}
+		var lm LicenseMetrics
+		lm.total, _ = strconv.ParseFloat(fields["Total"], 64)
+		lm.used, _ = strconv.ParseFloat(fields["Used"], 64)
+		if free, err := strconv.ParseFloat(fields["Free"], 64); err == nil {
+			lm.free = free
+		} else if lm.total > lm.used {
+			lm.free = lm.total - lm.used
+		}
+		licenses[name] = &lm
+	}
+	return licenses
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm licenses metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewLicensesCollector() *LicensesCollector {
+	labels := []string{"name"}
+	return &LicensesCollector{
+		total: NewDesc("slurm_license_total", "Total licenses", labels, nil),
+		used:  NewDesc("slurm_license_used", "Licenses in use", labels, nil),
+		free:  NewDesc("slurm_license_free", "Free licenses", labels, nil),
+	}
+}
+
+type LicensesCollector struct {
+	total *prometheus.Desc
+	used  *prometheus.Desc
+	free  *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (lc *LicensesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.total
+	ch <- lc.used
+	ch <- lc.free
+}
+
+func (lc *LicensesCollector) Update(ch chan<- prometheus.Metric) error {
+	licenses, err := LicensesGetMetrics()
+	if err != nil {
+		return err
+	}
+	for name, lm := range licenses {
+		ch <- prometheus.MustNewConstMetric(lc.total, prometheus.GaugeValue, lm.total, name)
+		ch <- prometheus.MustNewConstMetric(lc.used, prometheus.GaugeValue, lm.used, name)
+		ch <- prometheus.MustNewConstMetric(lc.free, prometheus.GaugeValue, lm.free, name)
+	}
+	return nil
+}
+
+// Parse returns the licenses as parsed from scontrol, see DebugParser
+func (lc *LicensesCollector) Parse() (interface{}, error) {
+	return LicensesGetMetrics()
+}
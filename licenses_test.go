@@ -0,0 +1,37 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseLicensesMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_licenses.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	licenses := ParseLicensesMetrics(data)
+	t.Logf("%+v", licenses)
+	assert.Equal(t, map[string]*LicenseMetrics{
+		"comsol":       {total: 4, used: 4, free: 0},
+		"matlab":       {total: 10, used: 3, free: 7},
+		"ansys@flexlm": {total: 20, used: 5, free: 15},
+	}, licenses)
+	assert.Empty(t, ParseLicensesMetrics([]byte("No licenses configured in Slurm.\n")))
+}
@@ -19,45 +19,397 @@ import (
 	"flag"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
-func init() {
-	// Metrics have to be registered to be exposed
-	prometheus.MustRegister(NewAccountsCollector())       // from accounts.go
-	prometheus.MustRegister(NewCPUsCollector())           // from cpus.go
-	prometheus.MustRegister(NewNodesCollector())          // from nodes.go
-	prometheus.MustRegister(NewNodeCollector())           // from node.go
-	prometheus.MustRegister(NewPartitionsCollector())     // from partitions.go
-	prometheus.MustRegister(NewQueueCollector())          // from queue.go
-	prometheus.MustRegister(NewSchedulerCollector())      // from scheduler.go
-	prometheus.MustRegister(NewFairShareCollector())      // from sshare.go
-	prometheus.MustRegister(NewUsersCollector())          // from users.go
-}
+var logLevel = flag.String(
+	"log.level",
+	"info",
+	"Minimum level of log messages: debug, info, warn or error.")
 
-var listenAddress = flag.String(
-	"listen-address",
+var dryRun = flag.Bool(
+	"dry-run",
+	false,
+	"Run all enabled collectors once, print the executed Slurm commands and the metrics to stdout and exit, with status 1 if a command failed.")
+
+var webListenAddress = flag.String(
+	"web.listen-address",
 	":8080",
 	"The address to listen on for HTTP requests.")
 
+var listenAddress = flag.String(
+	"listen-address",
+	"",
+	"Deprecated, use -web.listen-address.")
+
+var telemetryPath = flag.String(
+	"web.telemetry-path",
+	"/metrics",
+	"Path under which to expose the metrics.")
+
+var tlsCert = flag.String(
+	"web.tls-cert",
+	"",
+	"Certificate file to serve the metrics via HTTPS.")
+
+var tlsKey = flag.String(
+	"web.tls-key",
+	"",
+	"Private key file to serve the metrics via HTTPS.")
+
+var tlsClientCA = flag.String(
+	"web.tls-client-ca",
+	"",
+	"CA certificates file to require and verify client certificates.")
+
+var basicAuthUser = flag.String(
+	"web.basic-auth-user",
+	"",
+	"User of the HTTP basic authentication required for the metrics, empty disables the authentication.")
+
+var basicAuthPasswordFile = flag.String(
+	"web.basic-auth-password-file",
+	"",
+	"File with the password of the HTTP basic authentication.")
+
+var debugEndpoint = flag.Bool(
+	"web.debug-endpoint",
+	false,
+	"Serve the parse results of all collectors as JSON on /debug/metrics.json.")
+
 var gpuAcct = flag.Bool(
 	"gpus-acct",
 	false,
-	"Enable GPUs accounting")
+	"Enable GPUs accounting, same as --collector.gpus")
+
+var customMetricsFile = flag.String(
+	"custom-metrics.file",
+	"",
+	"JSON file of custom metrics extracted from the output of commands, enables the custom collector.")
+
+var metricsNamespace = flag.String(
+	"metrics.namespace",
+	"slurm",
+	"Prefix of the names of all metrics.")
+
+var utilizationPercent = flag.Bool(
+	"metrics.utilization-percent",
+	false,
+	"Export the utilization metrics in percent between 0 and 100 instead of a ratio between 0 and 1.")
+
+var zeroRetention = flag.Duration(
+	"metrics.zero-retention",
+	0,
+	"Time to keep exporting 0 for users, accounts and partitions which disappeared from the per user, account and partition metrics, 0 disables it.")
+
+var gpuSecondsRetention = flag.Duration(
+	"metrics.gpu-seconds-retention",
+	24*time.Hour,
+	"Time to keep exporting the GPU seconds of a user after the last running job of the user, 0 keeps them forever.")
+
+var clusterName = flag.String(
+	"slurm.cluster-name",
+	"",
+	"Name of the cluster, added as cluster label to all metrics if set.")
+
+var slurmCluster = flag.String(
+	"slurm.cluster",
+	"",
+	"Cluster of a federation or multi-cluster setup to query, passed as -M to sacct and squeue.")
+
+var slurmConf = flag.String(
+	"slurm.conf",
+	"",
+	"Path of the slurm.conf set as SLURM_CONF in the environment of all Slurm commands, the default configuration if empty.")
+
+var partitionsFilter = flag.String(
+	"slurm.partitions",
+	"",
+	"Comma separated list of partitions to export metrics for, all partitions if empty.")
+
+var fairShareLevel = flag.String(
+	"slurm.fairshare-level",
+	"account",
+	"Rows of sshare exported by the fairshare collector: account, user or all.")
+
+var usersFilter = flag.String(
+	"slurm.users",
+	"",
+	"Comma separated list of users to export per user metrics for, all users if empty.")
+
+var excludeUsers = flag.String(
+	"slurm.exclude-users",
+	"",
+	"Comma separated list of users dropped from the per user metrics, e.g. root,nobody.")
+
+var userMetricsLimit = flag.Int(
+	"slurm.user-metrics-limit",
+	0,
+	"Maximum number of users per user metric, all other users are summed up as __other__. 0 disables the limit.")
+
+var completedWindow = flag.Duration(
+	"slurm.completed-window",
+	time.Hour,
+	"Time window of the completed jobs metrics.")
+
+var preemptedWindow = flag.Duration(
+	"slurm.preempted-window",
+	time.Hour,
+	"Time window of the preempted jobs metrics.")
+
+var jobsWindow = flag.Duration(
+	"slurm.jobs-window",
+	time.Hour,
+	"Time window of sacct to count the submitted and completed jobs, has to be longer than the scrape interval.")
+
+var longRunningThreshold = flag.Duration(
+	"slurm.long-running-threshold",
+	7*24*time.Hour,
+	"Elapsed time after which a running job counts as long running.")
+
+var efficiencyMinCPUs = flag.Int(
+	"slurm.efficiency-min-cpus",
+	16,
+	"Minimum allocated CPUs of a running job to export its efficiency by the efficiency collector.")
+
+var nodeWeightBuckets = flag.String(
+	"slurm.node-weight-buckets",
+	"1,10,100,1000,10000",
+	"Comma separated upper bounds of the node weight buckets of the node-weights collector.")
+
+var commandTimeout = flag.Duration(
+	"slurm.command-timeout",
+	30*time.Second,
+	"Maximum run time of a single Slurm command, 0 disables the timeout.")
+
+var maxConcurrentCommands = flag.Int(
+	"slurm.max-concurrent-commands",
+	4,
+	"Maximum number of Slurm commands run at once, further commands wait for a free slot. 0 disables the limit.")
+
+var commandRetries = flag.Int(
+	"slurm.command-retries",
+	0,
+	"Retries of a failed Slurm command with a backoff starting at 500ms, e.g. on a transient socket timeout. 0 disables the retries.")
+
+var partialOutput = flag.Bool(
+	"slurm.partial-output",
+	false,
+	"Use the complete lines printed by a Slurm command killed by the timeout for the running jobs, instead of failing the collection.")
+
+var circuitFailures = flag.Int(
+	"slurm.circuit-failures",
+	0,
+	"Consecutive failures of a Slurm command after which it is skipped for the circuit cooldown, 0 disables the circuit breaker.")
+
+var circuitCooldown = flag.Duration(
+	"slurm.circuit-cooldown",
+	time.Minute,
+	"Time a repeatedly failing Slurm command is skipped.")
+
+var cacheTTL = flag.Duration(
+	"slurm.cache-ttl",
+	0,
+	"Time to reuse the output of a Slurm command for further scrapes, 0 disables the cache.")
+
+var commandCacheTTLs = flag.String(
+	"slurm.command-cache-ttls",
+	"",
+	"Comma separated cache TTLs of single Slurm commands overriding -slurm.cache-ttl, e.g. \"sinfo=5m,sacct=10s\".")
+
+var useJSON = flag.Bool(
+	"slurm.use-json",
+	false,
+	"Parse the JSON output of sacct (Slurm 20.11 or newer) instead of its text output.")
+
+var sinfoJSONFlag = flag.Bool(
+	"slurm.sinfo-json",
+	false,
+	"Read the node data from the JSON output of sinfo (Slurm 21.08 or newer) instead of its text output.")
+
+var runningSource = flag.String(
+	"slurm.running-source",
+	"sacct",
+	"Command to get the resources of running jobs from, sacct or squeue.")
+
+var runningSacctArgs = flag.String(
+	"slurm.running-sacct-args",
+	"",
+	"Further arguments of sacct for the running jobs of the GPU accounting, separated by spaces.")
+
+var sshHost = flag.String(
+	"slurm.ssh-host",
+	"",
+	"Run the Slurm commands on this host via SSH instead of locally.")
+
+var sshUser = flag.String(
+	"slurm.ssh-user",
+	"",
+	"User to log in as on the SSH host, defaults to the user running the exporter.")
+
+var sshKey = flag.String(
+	"slurm.ssh-key",
+	"",
+	"Private key used to log in to the SSH host.")
+
+var sacctPath = flag.String(
+	"slurm.sacct-path",
+	"sacct",
+	"Path of the sacct command.")
+
+var sacctmgrPath = flag.String(
+	"slurm.sacctmgr-path",
+	"sacctmgr",
+	"Path of the sacctmgr command.")
+
+var scontrolPath = flag.String(
+	"slurm.scontrol-path",
+	"scontrol",
+	"Path of the scontrol command.")
+
+var sdiagPath = flag.String(
+	"slurm.sdiag-path",
+	"sdiag",
+	"Path of the sdiag command.")
+
+var sinfoPath = flag.String(
+	"slurm.sinfo-path",
+	"sinfo",
+	"Path of the sinfo command.")
+
+var squeuePath = flag.String(
+	"slurm.squeue-path",
+	"squeue",
+	"Path of the squeue command.")
+
+var ssharePath = flag.String(
+	"slurm.sshare-path",
+	"sshare",
+	"Path of the sshare command.")
+
+// fatal logs an error and exits the exporter
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
 func main() {
 	flag.Parse()
+	if err := ApplyEnvironment(flag.CommandLine, os.LookupEnv); err != nil {
+		fatal("Invalid environment variable", "err", err)
+	}
 
-	// Turn on GPUs accounting only if the corresponding command line option is set to true.
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("Invalid log level, use debug, info, warn or error", "level", *logLevel)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Metrics have to be registered to be exposed, only the collectors
+	// enabled on the command line are registered.
 	if *gpuAcct {
-		prometheus.MustRegister(NewGPUsCollector())   // from gpus.go
+		flag.Set("collector.gpus", "true")
+	}
+	if *customMetricsFile != "" {
+		metrics, err := LoadCustomMetrics(*customMetricsFile)
+		if err != nil {
+			fatal("Failed to load custom metrics", "err", err)
+		}
+		customMetrics = metrics
+		flag.Set("collector.custom", "true")
+	}
+	if *runningSource != "sacct" && *runningSource != "squeue" {
+		fatal("Invalid source of running jobs, use sacct or squeue", "source", *runningSource)
+	}
+	switch *fairShareLevel {
+	case "account", "user", "all":
+	default:
+		fatal("Invalid fairshare level, use account, user or all", "level", *fairShareLevel)
+	}
+	ttls, err := ParseCommandCacheTTLs(*commandCacheTTLs)
+	if err != nil {
+		fatal("Invalid Slurm command cache TTLs", "err", err)
+	}
+	commandTTLs = ttls
+	CheckCommands()
+	// the slurmctld has to respond for most metrics, its version is logged
+	// as a sanity check of the Slurm commands
+	if info, err := ControllerGetInfo(); err != nil {
+		slog.Warn("Slurm controller not responding", "err", err)
+	} else {
+		slog.Info("Slurm controller", "version", info.version)
+	}
+	exporter := NewExporter()
+	if err := exporter.Register(prometheus.DefaultRegisterer); err != nil {
+		fatal("Failed to register collectors", "err", err)
+	}
+	if *dryRun {
+		ok, err := exporter.DryRun(os.Stdout)
+		if err != nil {
+			fatal("Dry run failed", "err", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
 	}
 
 	// The Handler function provides a default handler to expose metrics
 	// via an HTTP server. "/metrics" is the usual endpoint for that.
-	log.Infof("Starting Server: %s", *listenAddress)
-	log.Infof("GPUs Accounting: %t", *gpuAcct)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	address := *webListenAddress
+	if *listenAddress != "" {
+		slog.Warn("The -listen-address flag is deprecated, use -web.listen-address")
+		address = *listenAddress
+	}
+	slog.Info("Starting Server", "address", address, "path", *telemetryPath, "version", version)
+	slog.Info("Enabled collectors", "collectors", strings.Join(exporter.Names(), ", "))
+	if *clusterName != "" {
+		slog.Info("Cluster name", "cluster", *clusterName)
+	}
+	slog.Info("Slurm command timeout", "timeout", *commandTimeout)
+	slog.Info("Slurm command cache TTL", "ttl", *cacheTTL)
+	for command, ttl := range commandTTLs {
+		slog.Info("Slurm command cache TTL", "command", command, "ttl", ttl)
+	}
+	if *sshHost != "" {
+		slog.Info("Slurm commands run via SSH", "host", *sshHost)
+	}
+	// with basic authentication configured, all endpoints except the
+	// health check for liveness probes require the credentials
+	protect := func(handler http.Handler) http.Handler { return handler }
+	if *basicAuthUser != "" || *basicAuthPasswordFile != "" {
+		if *basicAuthUser == "" || *basicAuthPasswordFile == "" {
+			fatal("HTTP basic authentication requires both a user and a password file")
+		}
+		password, err := LoadBasicAuthPassword(*basicAuthPasswordFile)
+		if err != nil {
+			fatal("Failed to read the HTTP basic authentication password", "err", err)
+		}
+		protect = func(handler http.Handler) http.Handler {
+			return BasicAuthHandler(*basicAuthUser, password, handler)
+		}
+		slog.Info("HTTP basic authentication enabled", "user", *basicAuthUser)
+	}
+	http.Handle(*telemetryPath, protect(promhttp.Handler()))
+	if *telemetryPath != "/" {
+		http.Handle("/", protect(LandingHandler(*telemetryPath)))
+	}
+	http.HandleFunc("/health", HealthHandler)
+	if *debugEndpoint {
+		http.Handle("/debug/metrics.json", protect(DebugHandler(exporter)))
+	}
+	if *tlsCert != "" {
+		slog.Info("Serving HTTPS", "certificate", *tlsCert)
+	}
+	server := &http.Server{Addr: address}
+	done := GracefulShutdown(server)
+	if err := ListenAndServe(server, *tlsCert, *tlsKey, *tlsClientCA); err != http.ErrServerClosed {
+		fatal("HTTP server failed", "err", err)
+	}
+	<-done
+	slog.Info("Server stopped")
 }
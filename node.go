@@ -16,8 +16,6 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"log"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
@@ -33,11 +31,18 @@ type NodeMetrics struct {
 	cpuIdle  uint64
 	cpuOther uint64
 	cpuTotal uint64
+	cpuLoad  float64
+	// sinfo reports no load, N/A, for nodes which are down
+	cpuLoadKnown bool
 	nodeStatus string
 }
 
-func NodeGetMetrics() map[string]*NodeMetrics {
-	return ParseNodeMetrics(NodeData())
+func NodeGetMetrics() (map[string]*NodeMetrics, error) {
+	data, err := NodeData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodeMetrics(data), nil
 }
 
 // ParseNodeMetrics takes the output of sinfo with node data
@@ -55,7 +60,7 @@ func ParseNodeMetrics(input []byte) map[string]*NodeMetrics {
 		nodeName := node[0]
 		nodeStatus := node[4] // mixed, allocated, etc.
 
-		nodes[nodeName] = &NodeMetrics{0, 0, 0, 0, 0, 0, ""}
+		nodes[nodeName] = &NodeMetrics{}
 
 		memAlloc, _ := strconv.ParseUint(node[1], 10, 64)
 		memTotal, _ := strconv.ParseUint(node[2], 10, 64)
@@ -74,6 +79,14 @@ func ParseNodeMetrics(input []byte) map[string]*NodeMetrics {
 		nodes[nodeName].cpuOther = cpuOther
 		nodes[nodeName].cpuTotal = cpuTotal
 		nodes[nodeName].nodeStatus = nodeStatus
+
+		if len(node) > 5 {
+			cpuLoad, err := strconv.ParseFloat(node[5], 64)
+			if err == nil {
+				nodes[nodeName].cpuLoad = cpuLoad
+				nodes[nodeName].cpuLoadKnown = true
+			}
+		}
 	}
 
 	return nodes
@@ -81,13 +94,15 @@ func ParseNodeMetrics(input []byte) map[string]*NodeMetrics {
 
 // NodeData executes the sinfo command to get data for each node
 // It returns the output of the sinfo command
-func NodeData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-N", "-O", "NodeList,AllocMem,Memory,CPUsState,StateLong")
-	out, err := cmd.Output()
+func NodeData() ([]byte, error) {
+	nodes, ok, err := SinfoJSONNodes()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if ok {
+		return SinfoJSONNodeLines(nodes), nil
 	}
-	return out
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-N", "-O", "NodeList,AllocMem,Memory,CPUsState,StateLong,CPUsLoad"}))
 }
 
 type NodeCollector struct {
@@ -97,6 +112,9 @@ type NodeCollector struct {
 	cpuTotal *prometheus.Desc
 	memAlloc *prometheus.Desc
 	memTotal *prometheus.Desc
+	cpuLoad  *prometheus.Desc
+	memAllocBytes *prometheus.Desc
+	memTotalBytes *prometheus.Desc
 }
 
 // NewNodeCollector creates a Prometheus collector to keep all our stats in
@@ -105,12 +123,15 @@ func NewNodeCollector() *NodeCollector {
 	labels := []string{"node","status"}
 
 	return &NodeCollector{
-		cpuAlloc: prometheus.NewDesc("slurm_node_cpu_alloc", "Allocated CPUs per node", labels, nil),
-		cpuIdle:  prometheus.NewDesc("slurm_node_cpu_idle", "Idle CPUs per node", labels, nil),
-		cpuOther: prometheus.NewDesc("slurm_node_cpu_other", "Other CPUs per node", labels, nil),
-		cpuTotal: prometheus.NewDesc("slurm_node_cpu_total", "Total CPUs per node", labels, nil),
-		memAlloc: prometheus.NewDesc("slurm_node_mem_alloc", "Allocated memory per node", labels, nil),
-		memTotal: prometheus.NewDesc("slurm_node_mem_total", "Total memory per node", labels, nil),
+		cpuAlloc: NewDesc("slurm_node_cpu_alloc", "Allocated CPUs per node", labels, nil),
+		cpuIdle:  NewDesc("slurm_node_cpu_idle", "Idle CPUs per node", labels, nil),
+		cpuOther: NewDesc("slurm_node_cpu_other", "Other CPUs per node", labels, nil),
+		cpuTotal: NewDesc("slurm_node_cpu_total", "Total CPUs per node", labels, nil),
+		memAlloc: NewDesc("slurm_node_mem_alloc", "Allocated memory per node", labels, nil),
+		memTotal: NewDesc("slurm_node_mem_total", "Total memory per node", labels, nil),
+		cpuLoad:  NewDesc("slurm_node_cpu_load", "CPU load per node", []string{"node"}, nil),
+		memAllocBytes: NewDesc("slurm_node_mem_alloc_bytes", "Allocated memory per node in bytes", []string{"node"}, nil),
+		memTotalBytes: NewDesc("slurm_node_mem_total_bytes", "Total memory per node in bytes", []string{"node"}, nil),
 	}
 }
 
@@ -122,10 +143,16 @@ func (nc *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- nc.cpuTotal
 	ch <- nc.memAlloc
 	ch <- nc.memTotal
+	ch <- nc.cpuLoad
+	ch <- nc.memAllocBytes
+	ch <- nc.memTotalBytes
 }
 
-func (nc *NodeCollector) Collect(ch chan<- prometheus.Metric) {
-	nodes := NodeGetMetrics()
+func (nc *NodeCollector) Update(ch chan<- prometheus.Metric) error {
+	nodes, err := NodeGetMetrics()
+	if err != nil {
+		return err
+	}
 	for node := range nodes {
 		ch <- prometheus.MustNewConstMetric(nc.cpuAlloc, prometheus.GaugeValue, float64(nodes[node].cpuAlloc), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.cpuIdle,  prometheus.GaugeValue, float64(nodes[node].cpuIdle),  node, nodes[node].nodeStatus)
@@ -133,5 +160,18 @@ func (nc *NodeCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.MustNewConstMetric(nc.cpuTotal, prometheus.GaugeValue, float64(nodes[node].cpuTotal), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.memAlloc, prometheus.GaugeValue, float64(nodes[node].memAlloc), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.memTotal, prometheus.GaugeValue, float64(nodes[node].memTotal), node, nodes[node].nodeStatus)
+		// sinfo reports the memory in MB
+		ch <- prometheus.MustNewConstMetric(nc.memAllocBytes, prometheus.GaugeValue, float64(nodes[node].memAlloc)*1024*1024, node)
+		ch <- prometheus.MustNewConstMetric(nc.memTotalBytes, prometheus.GaugeValue, float64(nodes[node].memTotal)*1024*1024, node)
+		if nodes[node].cpuLoadKnown {
+			ch <- prometheus.MustNewConstMetric(nc.cpuLoad, prometheus.GaugeValue, nodes[node].cpuLoad, node)
+		}
 	}
+	return nil
+}
+
+// Parse returns the CPUs, memory and state per node as parsed from sinfo, see
+// DebugParser
+func (nc *NodeCollector) Parse() (interface{}, error) {
+	return NodeGetMetrics()
 }
@@ -54,4 +54,8 @@ func TestNodeMetrics(t *testing.T) {
 	assert.Equal(t, uint64(0), metrics["b001"].cpuIdle)
 	assert.Equal(t, uint64(0), metrics["b001"].cpuOther)
 	assert.Equal(t, uint64(32), metrics["b001"].cpuTotal)
+	// the load of down nodes is N/A
+	assert.False(t, metrics["b001"].cpuLoadKnown)
+	assert.True(t, metrics["b003"].cpuLoadKnown)
+	assert.Equal(t, 28.40, metrics["b003"].cpuLoad)
 }
@@ -0,0 +1,163 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label value of the weights above the largest bucket
+const infiniteWeight = "+Inf"
+
+// Execute scontrol to get all nodes, one per line
+func NodeWeightsData() ([]byte, error) {
+	return Execute("scontrol", []string{"show", "node", "--oneliner"})
+}
+
+// ParseWeightBuckets parses the comma separated upper bounds of the weight
+// buckets configured on the command line, e.g. "1,10,100"
+func ParseWeightBuckets(buckets string) ([]uint64, error) {
+	var bounds []uint64
+	for _, bucket := range strings.Split(buckets, ",") {
+		if strings.TrimSpace(bucket) == "" {
+			continue
+		}
+		bound, err := strconv.ParseUint(strings.TrimSpace(bucket), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node weight bucket %q: %v", bucket, err)
+		}
+		bounds = append(bounds, bound)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return bounds, nil
+}
+
+// WeightBucket returns the label of the smallest bucket a weight fits in,
+// i.e. its upper bound, or "+Inf" for weights above all buckets
+func WeightBucket(weight uint64, bounds []uint64) string {
+	for _, bound := range bounds {
+		if weight <= bound {
+			return strconv.FormatUint(bound, 10)
+		}
+	}
+	return infiniteWeight
+}
+
+// ScontrolNodeStates splits a node state printed by scontrol, e.g.
+// "DOWN*+DRAIN", into the state and its flags. The "*" of a node not
+// responding becomes the NOT_RESPONDING flag.
+func ScontrolNodeStates(state string) []string {
+	states := strings.Split(strings.ToUpper(state), "+")
+	if strings.HasSuffix(states[0], "*") {
+		states[0] = strings.TrimSuffix(states[0], "*")
+		states = append(states, "NOT_RESPONDING")
+	}
+	return states
+}
+
+// ParseNodeWeights counts the nodes printed by scontrol as "Key=Value" pairs
+// per state, labeled like slurm_nodes, and weight bucket. Nodes which are
+// in none of the partitions configured on the command line are skipped.
+func ParseNodeWeights(input []byte, bounds []uint64) map[[2]string]float64 {
+	nodes := make(map[[2]string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		if fields["NodeName"] == "" || fields["State"] == "" {
+			continue
+		}
+		weight, err := strconv.ParseUint(fields["Weight"], 10, 64)
+		if err != nil {
+			continue
+		}
+		if *partitionsFilter != "" && !anyPartitionSelected(fields["Partitions"]) {
+			continue
+		}
+		state := NodeStateLabel(LongNodeState(ScontrolNodeStates(fields["State"])))
+		nodes[[2]string{state, WeightBucket(weight, bounds)}]++
+	}
+	return nodes
+}
+
+// anyPartitionSelected returns whether one of a comma separated list of
+// partitions is selected on the command line
+func anyPartitionSelected(partitions string) bool {
+	for _, partition := range strings.Split(partitions, ",") {
+		if PartitionSelected(partition) {
+			return true
+		}
+	}
+	return false
+}
+
+func NodeWeightsGetMetrics() (map[[2]string]float64, error) {
+	bounds, err := ParseWeightBuckets(*nodeWeightBuckets)
+	if err != nil {
+		return nil, err
+	}
+	data, err := NodeWeightsData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodeWeights(data, bounds), nil
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm node weight metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewNodeWeightsCollector() *NodeWeightsCollector {
+	return &NodeWeightsCollector{
+		nodes: NewDesc("slurm_nodes_by_weight", "Nodes per state and weight bucket, the upper bound of the node weights", []string{"state", "weight"}, nil),
+	}
+}
+
+type NodeWeightsCollector struct {
+	nodes *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (wc *NodeWeightsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- wc.nodes
+}
+
+func (wc *NodeWeightsCollector) Update(ch chan<- prometheus.Metric) error {
+	nodes, err := NodeWeightsGetMetrics()
+	if err != nil {
+		return err
+	}
+	for labels, count := range nodes {
+		ch <- prometheus.MustNewConstMetric(wc.nodes, prometheus.GaugeValue, count, labels[0], labels[1])
+	}
+	return nil
+}
+
+// Parse returns the nodes per state and weight, see DebugParser
+func (wc *NodeWeightsCollector) Parse() (interface{}, error) {
+	return NodeWeightsGetMetrics()
+}
@@ -0,0 +1,53 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseNodeWeights(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	bounds, err := ParseWeightBuckets("100, 1,10")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 10, 100}, bounds)
+	assert.Equal(t, map[[2]string]float64{
+		{"mix", "1"}:             1,
+		{"idle", "1"}:            1,
+		{"idle", "100"}:          1,
+		{"drain", "+Inf"}:        1,
+		{"powered_down", "+Inf"}: 1,
+	}, ParseNodeWeights(data, bounds))
+
+	defer flag.Set("slurm.partitions", "")
+	flag.Set("slurm.partitions", "bigmem")
+	assert.Equal(t, map[[2]string]float64{{"idle", "100"}: 1}, ParseNodeWeights(data, bounds))
+
+	_, err = ParseWeightBuckets("1,ten")
+	assert.Error(t, err)
+}
+
+func TestScontrolNodeStates(t *testing.T) {
+	assert.Equal(t, []string{"DOWN", "DRAIN", "NOT_RESPONDING"}, ScontrolNodeStates("DOWN*+DRAIN"))
+	assert.Equal(t, "drained*", LongNodeState(ScontrolNodeStates("IDLE*+DRAIN")))
+	assert.Equal(t, "mixed", LongNodeState(ScontrolNodeStates("MIXED")))
+}
@@ -17,9 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strconv"
@@ -37,10 +34,18 @@ type NodesMetrics struct {
 	maint float64
 	mix   float64
 	resv  float64
+	// node counts per state, see NodeStateLabel
+	states map[string]float64
+	// nodes of any state not responding to slurmctld
+	notResponding float64
 }
 
-func NodesGetMetrics() *NodesMetrics {
-	return ParseNodesMetrics(NodesData())
+func NodesGetMetrics() (*NodesMetrics, error) {
+	data, err := NodesData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodesMetrics(data), nil
 }
 
 func RemoveDuplicates(s []string) []string {
@@ -60,8 +65,77 @@ func RemoveDuplicates(s []string) []string {
 	return t
 }
 
+// NormalizeNodeState maps a node state reported by sinfo, in its long or
+// short form and with any state flag suffix like "*", "~" or "+", to the
+// state names used by the node metrics (e.g. "mixed+" becomes "mix",
+// "drained*" becomes "drain").
+func NormalizeNodeState(state string) string {
+	state = strings.ToLower(strings.TrimSpace(state))
+	state = strings.TrimRight(state, "*~#!%$@^-+")
+	switch {
+	case strings.HasPrefix(state, "alloc"):
+		return "alloc"
+	case strings.HasPrefix(state, "comp"):
+		return "comp"
+	case strings.HasPrefix(state, "down"):
+		return "down"
+	case state == "draining", state == "drng":
+		return "draining"
+	case strings.HasPrefix(state, "drain"):
+		return "drain"
+	case strings.HasPrefix(state, "fail"):
+		return "fail"
+	case strings.HasPrefix(state, "err"):
+		return "err"
+	case strings.HasPrefix(state, "idle"):
+		return "idle"
+	case strings.HasPrefix(state, "maint"):
+		return "maint"
+	case strings.HasPrefix(state, "mix"):
+		return "mix"
+	case strings.HasPrefix(state, "res"):
+		return "resv"
+	}
+	return state
+}
+
+// Flags of sinfo node states for the power saving and the state label of
+// nodes with the flag
+var powerStateFlags = []struct {
+	flag  string
+	state string
+}{
+	{"~", "powered_down"},
+	{"#", "powering_up"},
+	{"%", "powering_down"},
+}
+
+// NodeStateLabel returns the state label of a node state reported by sinfo:
+// nodes powered down, powering up or powering down by the power saving can
+// not run jobs right now, thus they are labeled as such regardless of their
+// state, e.g. "idle~" becomes "powered_down". Other states are normalized
+// by NormalizeNodeState.
+func NodeStateLabel(state string) string {
+	state = strings.TrimSpace(state)
+	flags := state[len(strings.TrimRight(state, "*~#!%$@^-+")):]
+	for _, power := range powerStateFlags {
+		if strings.Contains(flags, power.flag) {
+			return power.state
+		}
+	}
+	return NormalizeNodeState(state)
+}
+
+// NodeNotResponding returns whether a node state reported by sinfo carries
+// the "*" flag of nodes not responding to slurmctld, e.g. "idle*"
+func NodeNotResponding(state string) bool {
+	state = strings.TrimSpace(state)
+	return strings.Contains(state[len(strings.TrimRight(state, "*~#!%$@^-+")):], "*")
+}
+
 func ParseNodesMetrics(input []byte) *NodesMetrics {
 	var nm NodesMetrics
+	nm.states = make(map[string]float64)
 	lines := strings.Split(string(input), "\n")
 
 	// Sort and remove all the duplicates from the 'sinfo' output
@@ -73,6 +147,12 @@ func ParseNodesMetrics(input []byte) *NodesMetrics {
 			split := strings.Split(line, ",")
 			count, _ := strconv.ParseFloat(strings.TrimSpace(split[0]), 64)
 			state := split[1]
+			if normalized := NodeStateLabel(state); normalized != "" {
+				nm.states[normalized] += count
+			}
+			if NodeNotResponding(state) {
+				nm.notResponding += count
+			}
 			alloc := regexp.MustCompile(`^alloc`)
 			comp := regexp.MustCompile(`^comp`)
 			down := regexp.MustCompile(`^down`)
@@ -111,20 +191,59 @@ func ParseNodesMetrics(input []byte) *NodesMetrics {
 }
 
 // Execute the sinfo command and return its output
-func NodesData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %D,%T")
-	stdout, err := cmd.StdoutPipe()
+func NodesData() ([]byte, error) {
+	nodes, ok, err := SinfoJSONNodes()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	if ok {
+		return SinfoJSONNodesLines(nodes), nil
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-o %D,%T"}))
+}
+
+// Maximum length of a drain reason used as label value
+const maxDrainReasonLength = 100
+
+// Execute sinfo to get the state and reason of every node with a reason
+func DrainData() ([]byte, error) {
+	return Execute("sinfo", PartitionArguments([]string{"-h", "-N", "-R", "-o", "%n|%T|%E"}))
+}
+
+// SanitizeReason prepares a reason set by an administrator for the use as
+// label value: whitespace is collapsed and long reasons are truncated.
+func SanitizeReason(reason string) string {
+	reason = strings.Join(strings.Fields(reason), " ")
+	if runes := []rune(reason); len(runes) > maxDrainReasonLength {
+		reason = string(runes[:maxDrainReasonLength])
 	}
-	return out
+	return reason
+}
+
+// ParseDrainReasons parses lines of "node|state|reason" as printed by sinfo
+// and returns the reason of every drained or draining node.
+func ParseDrainReasons(input []byte) map[string]string {
+	reasons := make(map[string]string)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.SplitN(line, "|", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		state := NormalizeNodeState(fields[1])
+		if state != "drain" && state != "draining" {
+			continue
+		}
+		reasons[strings.TrimSpace(fields[0])] = SanitizeReason(fields[2])
+	}
+	return reasons
+}
+
+func DrainGetReasons() (map[string]string, error) {
+	data, err := DrainData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseDrainReasons(data), nil
 }
 
 /*
@@ -135,30 +254,36 @@ func NodesData() []byte {
 
 func NewNodesCollector() *NodesCollector {
 	return &NodesCollector{
-		alloc: prometheus.NewDesc("slurm_nodes_alloc", "Allocated nodes", nil, nil),
-		comp:  prometheus.NewDesc("slurm_nodes_comp", "Completing nodes", nil, nil),
-		down:  prometheus.NewDesc("slurm_nodes_down", "Down nodes", nil, nil),
-		drain: prometheus.NewDesc("slurm_nodes_drain", "Drain nodes", nil, nil),
-		err:   prometheus.NewDesc("slurm_nodes_err", "Error nodes", nil, nil),
-		fail:  prometheus.NewDesc("slurm_nodes_fail", "Fail nodes", nil, nil),
-		idle:  prometheus.NewDesc("slurm_nodes_idle", "Idle nodes", nil, nil),
-		maint: prometheus.NewDesc("slurm_nodes_maint", "Maint nodes", nil, nil),
-		mix:   prometheus.NewDesc("slurm_nodes_mix", "Mix nodes", nil, nil),
-		resv:  prometheus.NewDesc("slurm_nodes_resv", "Reserved nodes", nil, nil),
+		alloc:         NewDesc("slurm_nodes_alloc", "Allocated nodes", nil, nil),
+		comp:          NewDesc("slurm_nodes_comp", "Completing nodes", nil, nil),
+		down:          NewDesc("slurm_nodes_down", "Down nodes", nil, nil),
+		drain:         NewDesc("slurm_nodes_drain", "Drain nodes", nil, nil),
+		err:           NewDesc("slurm_nodes_err", "Error nodes", nil, nil),
+		fail:          NewDesc("slurm_nodes_fail", "Fail nodes", nil, nil),
+		idle:          NewDesc("slurm_nodes_idle", "Idle nodes", nil, nil),
+		maint:         NewDesc("slurm_nodes_maint", "Maint nodes", nil, nil),
+		mix:           NewDesc("slurm_nodes_mix", "Mix nodes", nil, nil),
+		resv:          NewDesc("slurm_nodes_resv", "Reserved nodes", nil, nil),
+		nodes:         NewDesc("slurm_nodes", "Nodes per state", []string{"state"}, nil),
+		drainReason:   NewDesc("slurm_node_drain", "Drained or draining node with the reason of the drain", []string{"node", "reason"}, nil),
+		notResponding: NewDesc("slurm_nodes_not_responding", "Nodes of any state not responding to slurmctld", nil, nil),
 	}
 }
 
 type NodesCollector struct {
-	alloc *prometheus.Desc
-	comp  *prometheus.Desc
-	down  *prometheus.Desc
-	drain *prometheus.Desc
-	err   *prometheus.Desc
-	fail  *prometheus.Desc
-	idle  *prometheus.Desc
-	maint *prometheus.Desc
-	mix   *prometheus.Desc
-	resv  *prometheus.Desc
+	alloc         *prometheus.Desc
+	comp          *prometheus.Desc
+	down          *prometheus.Desc
+	drain         *prometheus.Desc
+	err           *prometheus.Desc
+	fail          *prometheus.Desc
+	idle          *prometheus.Desc
+	maint         *prometheus.Desc
+	mix           *prometheus.Desc
+	resv          *prometheus.Desc
+	nodes         *prometheus.Desc
+	drainReason   *prometheus.Desc
+	notResponding *prometheus.Desc
 }
 
 // Send all metric descriptions
@@ -173,9 +298,19 @@ func (nc *NodesCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- nc.maint
 	ch <- nc.mix
 	ch <- nc.resv
+	ch <- nc.nodes
+	ch <- nc.drainReason
+	ch <- nc.notResponding
 }
-func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
-	nm := NodesGetMetrics()
+func (nc *NodesCollector) Update(ch chan<- prometheus.Metric) error {
+	nm, err := NodesGetMetrics()
+	if err != nil {
+		return err
+	}
+	reasons, err := DrainGetReasons()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(nc.alloc, prometheus.GaugeValue, nm.alloc)
 	ch <- prometheus.MustNewConstMetric(nc.comp, prometheus.GaugeValue, nm.comp)
 	ch <- prometheus.MustNewConstMetric(nc.down, prometheus.GaugeValue, nm.down)
@@ -186,4 +321,29 @@ func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(nc.maint, prometheus.GaugeValue, nm.maint)
 	ch <- prometheus.MustNewConstMetric(nc.mix, prometheus.GaugeValue, nm.mix)
 	ch <- prometheus.MustNewConstMetric(nc.resv, prometheus.GaugeValue, nm.resv)
+	ch <- prometheus.MustNewConstMetric(nc.notResponding, prometheus.GaugeValue, nm.notResponding)
+	for state, count := range nm.states {
+		ch <- prometheus.MustNewConstMetric(nc.nodes, prometheus.GaugeValue, count, state)
+	}
+	for node, reason := range reasons {
+		ch <- prometheus.MustNewConstMetric(nc.drainReason, prometheus.GaugeValue, 1, node, reason)
+	}
+	return nil
+}
+
+// Parse returns the nodes per state and the drain reasons as parsed from
+// sinfo, see DebugParser
+func (nc *NodesCollector) Parse() (interface{}, error) {
+	nm, err := NodesGetMetrics()
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := DrainGetReasons()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Nodes        *NodesMetrics     `json:"nodes"`
+		DrainReasons map[string]string `json:"drain_reasons"`
+	}{nm, reasons}, nil
 }
@@ -16,6 +16,7 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -31,6 +32,70 @@ func TestNodesMetrics(t *testing.T) {
 	t.Logf("%+v", ParseNodesMetrics(data))
 }
 
+func TestNodesNotResponding(t *testing.T) {
+	nm := ParseNodesMetrics([]byte("2,idle*\n3,idle\n1,down*~\n4,mixed\n1,drained*\n"))
+	assert.Equal(t, 4.0, nm.notResponding)
+	assert.False(t, NodeNotResponding("mixed+"))
+}
+
 func TestNodesGetMetrics(t *testing.T) {
-	t.Logf("%+v", NodesGetMetrics())
+	metrics, err := NodesGetMetrics()
+	t.Logf("%+v %v", metrics, err)
+}
+
+func TestNodeStateLabel(t *testing.T) {
+	states := map[string]string{
+		"idle~":  "powered_down",
+		"idle#":  "powering_up",
+		"idle%":  "powering_down",
+		"down*~": "powered_down",
+		"mixed+": "mix",
+	}
+	for state, expected := range states {
+		if label := NodeStateLabel(state); label != expected {
+			t.Errorf("NodeStateLabel(%q) = %q, expected %q", state, label, expected)
+		}
+	}
+}
+
+func TestNormalizeNodeState(t *testing.T) {
+	states := map[string]string{
+		"allocated+": "alloc",
+		"mixed":      "mix",
+		"mix*":       "mix",
+		"drained*":   "drain",
+		"drain":      "drain",
+		"draining":   "draining",
+		"idle~":      "idle",
+		"down*":      "down",
+		"failing":    "fail",
+		"reserved":   "resv",
+		"planned":    "planned",
+	}
+	for state, expected := range states {
+		if normalized := NormalizeNodeState(state); normalized != expected {
+			t.Errorf("NormalizeNodeState(%q) = %q, expected %q", state, normalized, expected)
+		}
+	}
+}
+
+func TestParseDrainReasons(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_drain.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	reasons := ParseDrainReasons(data)
+	expected := map[string]string{
+		"a001": "Bad DIMM replaced soon",
+		"a002": "kernel update, reboot",
+		"a004": "This reason is much too long to be used as a label value as it is, hence it is truncated to one hund",
+	}
+	if len(reasons) != len(expected) {
+		t.Fatalf("Unexpected drain reasons %v", reasons)
+	}
+	for node, reason := range expected {
+		if reasons[node] != reason {
+			t.Errorf("Reason of %s is %q, expected %q", node, reasons[node], reason)
+		}
+	}
 }
@@ -0,0 +1,103 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Execute nvidia-smi to get the utilization of every GPU of the node
+func NvidiaSMIData() ([]byte, error) {
+	return Execute("nvidia-smi", []string{"--query-gpu=index,utilization.gpu", "--format=csv,noheader,nounits"})
+}
+
+// ParseGPUsRealUtilization parses lines of "index, utilization" as printed by
+// nvidia-smi and returns the utilization of every GPU as a ratio. GPUs which
+// do not report their utilization, e.g. "[N/A]", are skipped.
+func ParseGPUsRealUtilization(input []byte) map[string]float64 {
+	utilization := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			continue
+		}
+		utilization[strings.TrimSpace(fields[0])] = percent / 100
+	}
+	return utilization
+}
+
+// NvidiaSMINode returns the name of the node nvidia-smi runs on, which is
+// the SSH host if configured and the local host otherwise.
+func NvidiaSMINode() string {
+	if *sshHost != "" {
+		return *sshHost
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * device utilization of the GPUs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewNvidiaSMICollector() *NvidiaSMICollector {
+	return &NvidiaSMICollector{
+		utilization: NewDesc("slurm_gpu_real_utilization", UtilizationHelp("Device utilization of a GPU as reported by nvidia-smi"), []string{"node", "index"}, nil),
+	}
+}
+
+type NvidiaSMICollector struct {
+	utilization *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (nc *NvidiaSMICollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nc.utilization
+}
+
+func (nc *NvidiaSMICollector) Update(ch chan<- prometheus.Metric) error {
+	data, err := NvidiaSMIData()
+	if err != nil {
+		return err
+	}
+	node := NvidiaSMINode()
+	for index, utilization := range ParseGPUsRealUtilization(data) {
+		ch <- prometheus.MustNewConstMetric(nc.utilization, prometheus.GaugeValue, UtilizationValue(utilization), node, index)
+	}
+	return nil
+}
+
+// Parse returns the utilization per GPU index as parsed from nvidia-smi, see
+// DebugParser
+func (nc *NvidiaSMICollector) Parse() (interface{}, error) {
+	data, err := NvidiaSMIData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseGPUsRealUtilization(data), nil
+}
@@ -0,0 +1,30 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseGPUsRealUtilization(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/nvidia_smi.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]float64{"0": 0.87, "1": 0, "3": 1}, ParseGPUsRealUtilization(data))
+}
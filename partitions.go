@@ -16,44 +16,22 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
         "strings"
         "strconv"
+        "sync"
         "github.com/prometheus/client_golang/prometheus"
 )
 
-func PartitionsData() []byte {
-        cmd := exec.Command("sinfo", "-h", "-o%R,%C")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+func PartitionsData() ([]byte, error) {
+        return Execute("sinfo", PartitionArguments([]string{"-h", "-o%R,%C"}))
 }
 
-func PartitionsPendingJobsData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o%P","--states=PENDING")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+func PartitionsNodesData() ([]byte, error) {
+        return Execute("sinfo", PartitionArguments([]string{"-h", "-o%R|%T|%D"}))
+}
+
+func PartitionsJobsData() ([]byte, error) {
+        return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "-o%P|%T", "--states=PENDING,RUNNING"}))
 }
 
 type PartitionMetrics struct {
@@ -61,19 +39,71 @@ type PartitionMetrics struct {
         idle float64
         other float64
         pending float64
+        running float64
         total float64
+        // nodes per state, see NodeStateLabel
+        nodes map[string]float64
 }
 
-func ParsePartitionsMetrics() map[string]*PartitionMetrics {
+// ParsePartitionsNodes parses lines of "partition|state|nodes" as printed by
+// sinfo and returns the nodes per partition and state. sinfo prints a node in
+// every partition it belongs to, thus it is counted in each of them.
+func ParsePartitionsNodes(input []byte) map[string]map[string]float64 {
+        partitions := make(map[string]map[string]float64)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := strings.Split(line, "|")
+                if len(fields) != 3 || !PartitionSelected(fields[0]) {
+                        continue
+                }
+                count, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+                if err != nil {
+                        continue
+                }
+                if _, ok := partitions[fields[0]]; !ok {
+                        partitions[fields[0]] = make(map[string]float64)
+                }
+                partitions[fields[0]][NodeStateLabel(fields[1])] += count
+        }
+        return partitions
+}
+
+func ParsePartitionsMetrics() (map[string]*PartitionMetrics, error) {
         partitions := make(map[string]*PartitionMetrics)
-        lines := strings.Split(string(PartitionsData()), "\n")
+        // run sinfo and squeue concurrently, all are independent
+        var wg sync.WaitGroup
+        var jobs, nodes []byte
+        var jobsErr, nodesErr error
+        wg.Add(2)
+        go func() {
+                defer wg.Done()
+                jobs, jobsErr = PartitionsJobsData()
+        }()
+        go func() {
+                defer wg.Done()
+                nodes, nodesErr = PartitionsNodesData()
+        }()
+        data, err := PartitionsData()
+        wg.Wait()
+        if err != nil {
+                return nil, err
+        }
+        if jobsErr != nil {
+                return nil, jobsErr
+        }
+        if nodesErr != nil {
+                return nil, nodesErr
+        }
+        lines := strings.Split(string(data), "\n")
         for _, line := range lines {
                 if strings.Contains(line,",") {
                         // name of a partition
                         partition := strings.Split(line,",")[0]
+                        if !PartitionSelected(partition) {
+                                continue
+                        }
                         _,key := partitions[partition]
                         if !key {
-                                partitions[partition] = &PartitionMetrics{0,0,0,0,0}
+                                partitions[partition] = &PartitionMetrics{0,0,0,0,0,0,map[string]float64{}}
                         }
                         states := strings.Split(line,",")[1]
                         allocated,_ := strconv.ParseFloat(strings.Split(states,"/")[0],64)
@@ -86,18 +116,31 @@ func ParsePartitionsMetrics() map[string]*PartitionMetrics {
                         partitions[partition].total = total
                 }
         }
-        // get list of pending jobs by partition name
-        list := strings.Split(string(PartitionsPendingJobsData()),"\n")
-        for _,partition := range list {
-		// accumulate the number of pending jobs
-		_,key := partitions[partition]
-		if key {
-			partitions[partition].pending += 1
+        // get list of pending and running jobs by partition name
+        for _,line := range strings.Split(string(jobs),"\n") {
+                if !strings.Contains(line,"|") {
+                        continue
+                }
+                partition := strings.Split(line,"|")[0]
+                state := strings.Split(line,"|")[1]
+                // accumulate the number of pending and running jobs
+                _,key := partitions[partition]
+                if key {
+                        switch state {
+                        case "PENDING":
+                                partitions[partition].pending += 1
+                        case "RUNNING":
+                                partitions[partition].running += 1
+                        }
+                }
+        }
+        for partition, states := range ParsePartitionsNodes(nodes) {
+                if _, key := partitions[partition]; key {
+                        partitions[partition].nodes = states
                 }
         }
 
-
-        return partitions
+        return partitions, nil
 }
 
 type PartitionsCollector struct {
@@ -105,17 +148,21 @@ type PartitionsCollector struct {
         idle *prometheus.Desc
         other *prometheus.Desc
         pending *prometheus.Desc
+        running *prometheus.Desc
         total *prometheus.Desc
+        nodes *prometheus.Desc
 }
 
 func NewPartitionsCollector() *PartitionsCollector {
         labels := []string{"partition"}
         return &PartitionsCollector{
-                allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
-		idle: prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
-		other: prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
-		pending: prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
-		total: prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
+                allocated: NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
+		idle: NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
+		other: NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
+		pending: NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
+		running: NewDesc("slurm_partition_jobs_running", "Running jobs for partition", labels,nil),
+		total: NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
+		nodes: NewDesc("slurm_partition_nodes", "Nodes for partition per state", []string{"partition", "state"},nil),
         }
 }
 
@@ -124,26 +171,33 @@ func (pc *PartitionsCollector) Describe(ch chan<- *prometheus.Desc) {
         ch <- pc.idle
         ch <- pc.other
         ch <- pc.pending
+        ch <- pc.running
         ch <- pc.total
+        ch <- pc.nodes
 }
 
-func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
-        pm := ParsePartitionsMetrics()
+// Partitions are always reported, even if they are down or inactive
+// and thus all their counts are zero.
+func (pc *PartitionsCollector) Update(ch chan<- prometheus.Metric) error {
+        pm, err := ParsePartitionsMetrics()
+        if err != nil {
+                return err
+        }
         for p := range pm {
-                if pm[p].allocated > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
-                }
-                if pm[p].idle > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
-                }
-                if pm[p].other > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
-                }
-                if pm[p].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
-                }
-                if pm[p].total > 0 {
-                        ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
+                ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
+                ch <- prometheus.MustNewConstMetric(pc.idle, prometheus.GaugeValue, pm[p].idle, p)
+                ch <- prometheus.MustNewConstMetric(pc.other, prometheus.GaugeValue, pm[p].other, p)
+                ch <- prometheus.MustNewConstMetric(pc.pending, prometheus.GaugeValue, pm[p].pending, p)
+                ch <- prometheus.MustNewConstMetric(pc.running, prometheus.GaugeValue, pm[p].running, p)
+                ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
+                for state, count := range pm[p].nodes {
+                        ch <- prometheus.MustNewConstMetric(pc.nodes, prometheus.GaugeValue, count, p, state)
                 }
         }
+        return nil
+}
+
+// Parse returns the CPUs, jobs and nodes per partition, see DebugParser
+func (pc *PartitionsCollector) Parse() (interface{}, error) {
+        return ParsePartitionsMetrics()
 }
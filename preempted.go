@@ -0,0 +1,92 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+// Jobs are counted per partition and QOS
+type preemptedKey struct {
+	partition string
+	qos       string
+}
+
+// Execute sacct to get the jobs preempted within the configured time window.
+// Only the allocations are reported (-X), not their steps.
+func PreemptedData() ([]byte, error) {
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--state=PREEMPTED", SacctStartTime(*preemptedWindow), "--endtime=now", "--format=JobID,Partition,QOS", "--noheader", "--parsable2"}))
+}
+
+func PreemptedGetMetrics() (map[preemptedKey]float64, error) {
+	data, err := PreemptedData()
+	if err != nil {
+		return nil, err
+	}
+	return ParsePreemptedMetrics(data), nil
+}
+
+// ParsePreemptedMetrics parses lines of "JobID|Partition|QOS" as printed by
+// sacct and counts the jobs per partition and QOS. Job steps are skipped.
+func ParsePreemptedMetrics(input []byte) map[preemptedKey]float64 {
+	jobs := make(map[preemptedKey]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 3 || strings.Contains(parts[0], ".") || !PartitionSelected(strings.TrimSpace(parts[1])) {
+			continue
+		}
+		jobs[preemptedKey{strings.TrimSpace(parts[1]), strings.TrimSpace(parts[2])}]++
+	}
+	return jobs
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * metrics of the preempted jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewPreemptedCollector() *PreemptedCollector {
+	return &PreemptedCollector{
+		jobs: NewDesc("slurm_jobs_preempted", "Jobs preempted within the configured time window", []string{"partition", "qos"}, nil),
+	}
+}
+
+type PreemptedCollector struct {
+	jobs *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (pc *PreemptedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.jobs
+}
+
+func (pc *PreemptedCollector) Update(ch chan<- prometheus.Metric) error {
+	preempted, err := PreemptedGetMetrics()
+	if err != nil {
+		return err
+	}
+	for key, jobs := range preempted {
+		ch <- prometheus.MustNewConstMetric(pc.jobs, prometheus.GaugeValue, jobs, key.partition, key.qos)
+	}
+	return nil
+}
+
+// Parse returns the preempted jobs per partition and QOS, see DebugParser
+func (pc *PreemptedCollector) Parse() (interface{}, error) {
+	return PreemptedGetMetrics()
+}
@@ -0,0 +1,34 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParsePreemptedMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_preempted.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[preemptedKey]float64{
+		{"gpu", "preemptible"}: 2,
+		{"main", "scavenger"}:  1,
+	}, ParsePreemptedMetrics(data))
+	assert.Empty(t, ParsePreemptedMetrics([]byte("")))
+}
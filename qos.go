@@ -0,0 +1,116 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+type QOSMetrics struct {
+	gpusRunning float64
+	pending     float64
+	running     float64
+}
+
+// Execute sacct to get the QOS, state and allocated TRES of all pending
+// and running jobs
+func QOSData() ([]byte, error) {
+	return Execute("sacct", PartitionArguments([]string{"-a", "-X", "--format=QOS,State,AllocTRES", "--state=PENDING,RUNNING", "--noheader", "--parsable2"}))
+}
+
+func QOSGetMetrics() (map[string]*QOSMetrics, error) {
+	data, err := QOSData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseQOSMetrics(data), nil
+}
+
+// ParseQOSMetrics parses lines of "QOS|State|AllocTRES" as printed by sacct.
+// Only running jobs have allocated GPUs.
+func ParseQOSMetrics(input []byte) map[string]*QOSMetrics {
+	qos := make(map[string]*QOSMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 3 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			continue
+		}
+		if _, ok := qos[name]; !ok {
+			qos[name] = &QOSMetrics{}
+		}
+		switch strings.TrimSpace(parts[1]) {
+		case "PENDING":
+			qos[name].pending++
+		case "RUNNING":
+			qos[name].running++
+			gpus, _ := ParseGpuTres(parts[2])
+			qos[name].gpusRunning += gpus
+		}
+	}
+	return qos
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm QOS metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewQOSCollector() *QOSCollector {
+	labels := []string{"qos"}
+	return &QOSCollector{
+		gpusRunning: NewDesc("slurm_qos_gpus_running", "Allocated GPUs of running jobs for QOS", labels, nil),
+		pending:     NewDesc("slurm_qos_jobs_pending", "Pending jobs for QOS", labels, nil),
+		running:     NewDesc("slurm_qos_jobs_running", "Running jobs for QOS", labels, nil),
+	}
+}
+
+type QOSCollector struct {
+	gpusRunning *prometheus.Desc
+	pending     *prometheus.Desc
+	running     *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (qc *QOSCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.gpusRunning
+	ch <- qc.pending
+	ch <- qc.running
+}
+
+func (qc *QOSCollector) Update(ch chan<- prometheus.Metric) error {
+	qos, err := QOSGetMetrics()
+	if err != nil {
+		return err
+	}
+	for name, qm := range qos {
+		ch <- prometheus.MustNewConstMetric(qc.gpusRunning, prometheus.GaugeValue, qm.gpusRunning, name)
+		ch <- prometheus.MustNewConstMetric(qc.pending, prometheus.GaugeValue, qm.pending, name)
+		ch <- prometheus.MustNewConstMetric(qc.running, prometheus.GaugeValue, qm.running, name)
+	}
+	return nil
+}
+
+// Parse returns the jobs and GPUs per QOS as parsed from squeue, see
+// DebugParser
+func (qc *QOSCollector) Parse() (interface{}, error) {
+	return QOSGetMetrics()
+}
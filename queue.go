@@ -17,10 +17,10 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type QueueMetrics struct {
@@ -36,25 +36,245 @@ type QueueMetrics struct {
 	timeout     float64
 	preempted   float64
 	node_fail   float64
+	// jobs per partition and normalized state, see NormalizeJobState
+	partitions map[string]map[string]float64
+	// pending jobs per reason, see NormalizePendingReason
+	reasons map[string]float64
+	// seconds since the submission of the oldest pending job per partition,
+	// separately for held jobs, see ParsePendingAges
+	oldestPending map[string]float64
+	oldestHeld    map[string]float64
+	// highest and mean priority of the pending jobs, see ParsePendingPriorities
+	priorityMax  float64
+	priorityMean float64
+	// running jobs per partition which run longer than the configured
+	// threshold, see ParseLongRunning
+	longRunning map[string]float64
 }
 
 // Returns the scheduler metrics
-func QueueGetMetrics() *QueueMetrics {
-	return ParseQueueMetrics(QueueData())
+func QueueGetMetrics() (*QueueMetrics, error) {
+	data, err := QueueData()
+	if err != nil {
+		return nil, err
+	}
+	pendingData, err := QueuePendingData()
+	if err != nil {
+		return nil, err
+	}
+	qm := ParseQueueMetrics(data)
+	qm.oldestPending, qm.oldestHeld = ParsePendingAges(pendingData, time.Now())
+	qm.priorityMax, qm.priorityMean = ParsePendingPriorities(pendingData)
+	runningData, err := QueueRunningData()
+	if err != nil {
+		return nil, err
+	}
+	qm.longRunning = ParseLongRunning(runningData, *longRunningThreshold)
+	return qm, nil
+}
+
+// Pending reasons of jobs which are not waiting for resources: held by the
+// user or an administrator, or not to be started before their begin time
+var heldReasons = map[string]bool{
+	"BeginTime":    true,
+	"JobHeldAdmin": true,
+	"JobHeldUser":  true,
+}
+
+// ParsePendingAges parses lines of "SubmitTime|Partitions|Reason" of pending
+// jobs as printed by squeue and returns the seconds since the submission of
+// the oldest job per partition. Held jobs are returned separately, thus they
+// do not mask the starvation of the jobs waiting for resources. A job
+// pending in several partitions counts for each of them.
+func ParsePendingAges(input []byte, now time.Time) (pending map[string]float64, held map[string]float64) {
+	pending = make(map[string]float64)
+	held = make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		submit, err := time.ParseInLocation(slurmTimeLayout, strings.TrimSpace(fields[0]), now.Location())
+		if err != nil {
+			continue
+		}
+		age := math.Max(now.Sub(submit).Seconds(), 0)
+		ages := pending
+		if heldReasons[strings.TrimSpace(fields[2])] {
+			ages = held
+		}
+		for _, partition := range strings.Split(fields[1], ",") {
+			if !PartitionSelected(partition) {
+				continue
+			}
+			if oldest, ok := ages[partition]; !ok || age > oldest {
+				ages[partition] = age
+			}
+		}
+	}
+	return pending, held
+}
+
+// ParseLongRunning parses lines of "Elapsed|Partition" of running jobs as
+// printed by squeue and counts the jobs per partition which run longer than
+// the threshold. Every partition with running jobs is returned, also without
+// long running jobs, so that an alert resolves once they ended.
+func ParseLongRunning(input []byte, threshold time.Duration) map[string]float64 {
+	long := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		elapsed, err := ParseSlurmDuration(strings.TrimSpace(fields[0]))
+		if err != nil {
+			continue
+		}
+		partition := strings.TrimSpace(fields[1])
+		if !PartitionSelected(partition) {
+			continue
+		}
+		if _, ok := long[partition]; !ok {
+			long[partition] = 0
+		}
+		if elapsed > threshold {
+			long[partition]++
+		}
+	}
+	return long
+}
+
+// ParsePendingPriorities parses lines of
+// "SubmitTime|Partitions|Reason|Priority" of pending jobs as printed by squeue
+// and returns the highest and the mean priority. Held jobs have a priority
+// of 0, they are left out, so that they do not drag down the mean of the
+// jobs competing for resources. Without such jobs both are 0.
+func ParsePendingPriorities(input []byte) (float64, float64) {
+	var max, sum, jobs float64
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 4 {
+			continue
+		}
+		priority, err := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+		if err != nil || priority <= 0 {
+			continue
+		}
+		max = math.Max(max, priority)
+		sum += priority
+		jobs++
+	}
+	if jobs == 0 {
+		return 0, 0
+	}
+	return max, sum / jobs
 }
 
+// Short job state codes as printed by squeue with %t
+var jobStateCodes = map[string]string{
+	"BF":  "boot_fail",
+	"CA":  "cancelled",
+	"CD":  "completed",
+	"CF":  "configuring",
+	"CG":  "completing",
+	"DL":  "deadline",
+	"F":   "failed",
+	"NF":  "node_fail",
+	"OOM": "out_of_memory",
+	"PD":  "pending",
+	"PR":  "preempted",
+	"R":   "running",
+	"S":   "suspended",
+	"TO":  "timeout",
+}
+
+// NormalizeJobState maps a job state in its long (e.g. "NODE_FAIL") or
+// short form (e.g. "NF") to the lower case long form (e.g. "node_fail")
+func NormalizeJobState(state string) string {
+	state = strings.TrimSpace(state)
+	if long, ok := jobStateCodes[state]; ok {
+		return long
+	}
+	return strings.ToLower(state)
+}
+
+// Common pending reasons as documented by squeue, all other reasons are
+// exported as "other" to cap the number of series
+var pendingReasons = map[string]bool{
+	"AssocGrpCpuLimit":         true,
+	"AssocGrpGRES":             true,
+	"AssocGrpJobsLimit":        true,
+	"AssocGrpMemLimit":         true,
+	"AssocGrpNodeLimit":        true,
+	"AssocMaxJobsLimit":        true,
+	"BadConstraints":           true,
+	"BeginTime":                true,
+	"Dependency":               true,
+	"DependencyNeverSatisfied": true,
+	"InvalidAccount":           true,
+	"InvalidQOS":               true,
+	"JobArrayTaskLimit":        true,
+	"JobHeldAdmin":             true,
+	"JobHeldUser":              true,
+	"Licenses":                 true,
+	"NodeDown":                 true,
+	"None":                     true,
+	"PartitionDown":            true,
+	"PartitionInactive":        true,
+	"PartitionNodeLimit":       true,
+	"PartitionTimeLimit":       true,
+	"Priority":                 true,
+	"QOSGrpCpuLimit":           true,
+	"QOSGrpGRES":               true,
+	"QOSGrpJobsLimit":          true,
+	"QOSGrpMemLimit":           true,
+	"QOSGrpNodeLimit":          true,
+	"QOSJobLimit":              true,
+	"QOSMaxGRESPerUser":        true,
+	"QOSMaxJobsPerUserLimit":   true,
+	"QOSResourceLimit":         true,
+	"ReqNodeNotAvail":          true,
+	"Reservation":              true,
+	"Resources":                true,
+}
+
+// NormalizePendingReason returns the reason of a pending job as printed by
+// squeue, without details like the unavailable nodes appended to
+// "ReqNodeNotAvail, UnavailableNodes:...", or "other" for uncommon reasons
+func NormalizePendingReason(reason string) string {
+	reason = strings.TrimSpace(strings.SplitN(reason, ",", 2)[0])
+	if pendingReasons[reason] {
+		return reason
+	}
+	return "other"
+}
+
+// ParseQueueMetrics parses lines of "JobID|State|Partition|Reason" as printed
+// by squeue. Array jobs are expanded by squeue, thus every element counts once.
 func ParseQueueMetrics(input []byte) *QueueMetrics {
 	var qm QueueMetrics
+	qm.partitions = make(map[string]map[string]float64)
+	qm.reasons = make(map[string]float64)
 	lines := strings.Split(string(input), "\n")
 	for _, line := range lines {
-		if strings.Contains(line, ",") {
-			splitted := strings.Split(line, ",")
+		if strings.Contains(line, "|") {
+			splitted := strings.Split(line, "|")
 			state := splitted[1]
+			if len(splitted) > 2 && PartitionSelected(splitted[2]) {
+				partition := splitted[2]
+				if _, ok := qm.partitions[partition]; !ok {
+					qm.partitions[partition] = make(map[string]float64)
+				}
+				qm.partitions[partition][NormalizeJobState(state)]++
+			}
 			switch state {
 			case "PENDING":
 				qm.pending++
-				if len(splitted) > 2 && splitted[2] == "Dependency" {
-					qm.pending_dep++
+				if len(splitted) > 3 {
+					if splitted[3] == "Dependency" {
+						qm.pending_dep++
+					}
+					qm.reasons[NormalizePendingReason(splitted[3])]++
 				}
 			case "RUNNING":
 				qm.running++
@@ -83,20 +303,19 @@ func ParseQueueMetrics(input []byte) *QueueMetrics {
 }
 
 // Execute the squeue command and return its output
-func QueueData() []byte {
-	cmd := exec.Command("squeue", "-a", "-r", "-h", "-o %A,%T,%r", "--states=all")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func QueueData() ([]byte, error) {
+	return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "-o %A|%T|%P|%r", "--states=all"}))
+}
+
+// Execute the squeue command to get the submit time, the partitions, the
+// reason and the priority of the pending jobs
+func QueuePendingData() ([]byte, error) {
+	return Execute("squeue", PartitionArguments([]string{"-a", "-h", "-t", "PENDING", "-o", "%V|%P|%r|%Q"}))
+}
+
+// Execute squeue to get the elapsed time and the partition of the running jobs
+func QueueRunningData() ([]byte, error) {
+	return Execute("squeue", PartitionArguments([]string{"-a", "-h", "-t", "RUNNING", "-o", "%M|%P"}))
 }
 
 /*
@@ -107,34 +326,52 @@ func QueueData() []byte {
 
 func NewQueueCollector() *QueueCollector {
 	return &QueueCollector{
-		pending:     prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", nil, nil),
-		pending_dep: prometheus.NewDesc("slurm_queue_pending_dependency", "Pending jobs because of dependency in queue", nil, nil),
-		running:     prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", nil, nil),
-		suspended:   prometheus.NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", nil, nil),
-		cancelled:   prometheus.NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", nil, nil),
-		completing:  prometheus.NewDesc("slurm_queue_completing", "Completing jobs in the cluster", nil, nil),
-		completed:   prometheus.NewDesc("slurm_queue_completed", "Completed jobs in the cluster", nil, nil),
-		configuring: prometheus.NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", nil, nil),
-		failed:      prometheus.NewDesc("slurm_queue_failed", "Number of failed jobs", nil, nil),
-		timeout:     prometheus.NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", nil, nil),
-		preempted:   prometheus.NewDesc("slurm_queue_preempted", "Number of preempted jobs", nil, nil),
-		node_fail:   prometheus.NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", nil, nil),
+		pending:     NewDesc("slurm_queue_pending", "Pending jobs in queue", nil, nil),
+		pending_dep: NewDesc("slurm_queue_pending_dependency", "Pending jobs because of dependency in queue", nil, nil),
+		running:     NewDesc("slurm_queue_running", "Running jobs in the cluster", nil, nil),
+		suspended:   NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", nil, nil),
+		cancelled:   NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", nil, nil),
+		completing:  NewDesc("slurm_queue_completing", "Completing jobs in the cluster", nil, nil),
+		completed:   NewDesc("slurm_queue_completed", "Completed jobs in the cluster", nil, nil),
+		configuring: NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", nil, nil),
+		failed:      NewDesc("slurm_queue_failed", "Number of failed jobs", nil, nil),
+		timeout:     NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", nil, nil),
+		preempted:   NewDesc("slurm_queue_preempted", "Number of preempted jobs", nil, nil),
+		node_fail:   NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", nil, nil),
+		jobs:        NewDesc("slurm_queue", "Jobs in the queue per state and partition", []string{"state", "partition"}, nil),
+		reasons: NewDesc("slurm_queue_pending_by_reason",
+			"Pending jobs per reason, uncommon reasons are summed up as other", []string{"reason"}, nil),
+		oldestPending: NewDesc("slurm_queue_oldest_pending_seconds",
+			"Seconds since the submission of the oldest pending job per partition, held jobs excluded", []string{"partition"}, nil),
+		priorityMax:  NewDesc("slurm_queue_priority_max", "Highest priority of the pending jobs which are not held", nil, nil),
+		priorityMean: NewDesc("slurm_queue_priority_mean", "Mean priority of the pending jobs which are not held", nil, nil),
+		oldestHeld: NewDesc("slurm_queue_oldest_held_seconds",
+			"Seconds since the submission of the oldest held job per partition, including jobs waiting for their begin time", []string{"partition"}, nil),
+		longRunning: NewDesc("slurm_jobs_long_running",
+			"Running jobs per partition with an elapsed time above the long running threshold", []string{"partition"}, nil),
 	}
 }
 
 type QueueCollector struct {
-	pending     *prometheus.Desc
-	pending_dep *prometheus.Desc
-	running     *prometheus.Desc
-	suspended   *prometheus.Desc
-	cancelled   *prometheus.Desc
-	completing  *prometheus.Desc
-	completed   *prometheus.Desc
-	configuring *prometheus.Desc
-	failed      *prometheus.Desc
-	timeout     *prometheus.Desc
-	preempted   *prometheus.Desc
-	node_fail   *prometheus.Desc
+	pending       *prometheus.Desc
+	pending_dep   *prometheus.Desc
+	running       *prometheus.Desc
+	suspended     *prometheus.Desc
+	cancelled     *prometheus.Desc
+	completing    *prometheus.Desc
+	completed     *prometheus.Desc
+	configuring   *prometheus.Desc
+	failed        *prometheus.Desc
+	timeout       *prometheus.Desc
+	preempted     *prometheus.Desc
+	node_fail     *prometheus.Desc
+	jobs          *prometheus.Desc
+	reasons       *prometheus.Desc
+	priorityMax   *prometheus.Desc
+	priorityMean  *prometheus.Desc
+	oldestPending *prometheus.Desc
+	oldestHeld    *prometheus.Desc
+	longRunning   *prometheus.Desc
 }
 
 func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -150,10 +387,20 @@ func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- qc.timeout
 	ch <- qc.preempted
 	ch <- qc.node_fail
+	ch <- qc.jobs
+	ch <- qc.reasons
+	ch <- qc.oldestPending
+	ch <- qc.oldestHeld
+	ch <- qc.priorityMax
+	ch <- qc.priorityMean
+	ch <- qc.longRunning
 }
 
-func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
-	qm := QueueGetMetrics()
+func (qc *QueueCollector) Update(ch chan<- prometheus.Metric) error {
+	qm, err := QueueGetMetrics()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(qc.pending, prometheus.GaugeValue, qm.pending)
 	ch <- prometheus.MustNewConstMetric(qc.pending_dep, prometheus.GaugeValue, qm.pending_dep)
 	ch <- prometheus.MustNewConstMetric(qc.running, prometheus.GaugeValue, qm.running)
@@ -166,4 +413,29 @@ func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(qc.timeout, prometheus.GaugeValue, qm.timeout)
 	ch <- prometheus.MustNewConstMetric(qc.preempted, prometheus.GaugeValue, qm.preempted)
 	ch <- prometheus.MustNewConstMetric(qc.node_fail, prometheus.GaugeValue, qm.node_fail)
+	for partition, states := range qm.partitions {
+		for state, count := range states {
+			ch <- prometheus.MustNewConstMetric(qc.jobs, prometheus.GaugeValue, count, state, partition)
+		}
+	}
+	for reason, count := range qm.reasons {
+		ch <- prometheus.MustNewConstMetric(qc.reasons, prometheus.GaugeValue, count, reason)
+	}
+	for partition, age := range qm.oldestPending {
+		ch <- prometheus.MustNewConstMetric(qc.oldestPending, prometheus.GaugeValue, age, partition)
+	}
+	for partition, age := range qm.oldestHeld {
+		ch <- prometheus.MustNewConstMetric(qc.oldestHeld, prometheus.GaugeValue, age, partition)
+	}
+	ch <- prometheus.MustNewConstMetric(qc.priorityMax, prometheus.GaugeValue, qm.priorityMax)
+	ch <- prometheus.MustNewConstMetric(qc.priorityMean, prometheus.GaugeValue, qm.priorityMean)
+	for partition, count := range qm.longRunning {
+		ch <- prometheus.MustNewConstMetric(qc.longRunning, prometheus.GaugeValue, count, partition)
+	}
+	return nil
+}
+
+// Parse returns the jobs per state as parsed from squeue, see DebugParser
+func (qc *QueueCollector) Parse() (interface{}, error) {
+	return QueueGetMetrics()
 }
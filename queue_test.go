@@ -19,6 +19,9 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseQueueMetrics(t *testing.T) {
@@ -28,9 +31,66 @@ func TestParseQueueMetrics(t *testing.T) {
 		t.Fatalf("Can not open test data: %v", err)
 	}
 	data, err := ioutil.ReadAll(file)
-	t.Logf("%+v", ParseQueueMetrics(data))
+	qm := ParseQueueMetrics(data)
+	t.Logf("%+v", qm)
+	assert.Equal(t, 4.0, qm.pending)
+	assert.Equal(t, 3.0, qm.pending_dep)
+	assert.Equal(t, 28.0, qm.running)
+	assert.Equal(t, 2.0, qm.partitions["gpu"]["pending"])
+	assert.Equal(t, 1.0, qm.partitions["cpu"]["node_fail"])
+	assert.Equal(t, map[string]float64{"Dependency": 3, "Resources": 1}, qm.reasons)
+}
+
+func TestNormalizePendingReason(t *testing.T) {
+	assert.Equal(t, "QOSMaxGRESPerUser", NormalizePendingReason("QOSMaxGRESPerUser"))
+	assert.Equal(t, "ReqNodeNotAvail", NormalizePendingReason("ReqNodeNotAvail, UnavailableNodes:node[01-02]"))
+	assert.Equal(t, "other", NormalizePendingReason("launch failed requeued held"))
+}
+
+func TestNormalizeJobState(t *testing.T) {
+	assert.Equal(t, "node_fail", NormalizeJobState("NODE_FAIL"))
+	assert.Equal(t, "node_fail", NormalizeJobState("NF"))
+	assert.Equal(t, "pending", NormalizeJobState("PD"))
+	assert.Equal(t, "running", NormalizeJobState("RUNNING"))
+}
+
+func TestParsePendingAges(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_pending.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	pending, held := ParsePendingAges(data, time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, map[string]float64{"gpu": 3600, "cpu": 600}, pending)
+	// the held job pending in two partitions counts for both
+	assert.Equal(t, map[string]float64{"cpu": 10800, "gpu": 7200, "debug": 300}, held)
+}
+
+func TestParsePendingPriorities(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_pending.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	max, mean := ParsePendingPriorities(data)
+	assert.Equal(t, 15000.0, max)
+	// the two held jobs with priority 0 are left out
+	assert.Equal(t, 11750.0, mean)
+	max, mean = ParsePendingPriorities([]byte("2021-05-01T11:00:00|gpu|JobHeldUser|0\n"))
+	assert.Equal(t, 0.0, max)
+	assert.Equal(t, 0.0, mean)
+}
+
+func TestParseLongRunning(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_elapsed.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	long := ParseLongRunning(data, 7*24*time.Hour)
+	// the job of exactly 7 days and the job with an invalid time are not
+	// counted, cpu has no long running job but is exported
+	assert.Equal(t, map[string]float64{"gpu": 2, "cpu": 0, "long": 1}, long)
 }
 
 func TestQueueGetMetrics(t *testing.T) {
-	t.Logf("%+v", QueueGetMetrics())
+	metrics, err := QueueGetMetrics()
+	t.Logf("%+v %v", metrics, err)
 }
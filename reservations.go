@@ -0,0 +1,133 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ReservationMetrics struct {
+	active   float64
+	cpus     float64
+	duration float64
+	nodes    float64
+}
+
+// Execute scontrol to get all reservations, one per line
+func ReservationsData() ([]byte, error) {
+	return Execute("scontrol", []string{"show", "reservation", "--oneliner"})
+}
+
+func ReservationsGetMetrics() (map[string]*ReservationMetrics, error) {
+	data, err := ReservationsData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseReservationsMetrics(data, time.Now()), nil
+}
+
+// ParseReservationsMetrics parses the reservations printed by scontrol as
+// "Key=Value" pairs. A reservation is active if the given time is between
+// its start and end time. Without any reservation, scontrol prints
+// "No reservations in the system", which results in no metrics.
+func ParseReservationsMetrics(input []byte, now time.Time) map[string]*ReservationMetrics {
+	reservations := make(map[string]*ReservationMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		name, ok := fields["ReservationName"]
+		if !ok {
+			continue
+		}
+		var rm ReservationMetrics
+		rm.nodes, _ = strconv.ParseFloat(fields["NodeCnt"], 64)
+		rm.cpus, _ = strconv.ParseFloat(fields["CoreCnt"], 64)
+		// the CPUs of the TRES, e.g. "TRES=cpu=400", take precedence over the cores
+		for _, tres := range strings.Split(fields["TRES"], ",") {
+			if strings.HasPrefix(tres, "cpu=") {
+				rm.cpus, _ = strconv.ParseFloat(strings.TrimPrefix(tres, "cpu="), 64)
+			}
+		}
+		if duration, err := ParseSlurmDuration(fields["Duration"]); err == nil {
+			rm.duration = duration.Seconds()
+		}
+		start, startErr := time.ParseInLocation(slurmTimeLayout, fields["StartTime"], now.Location())
+		end, endErr := time.ParseInLocation(slurmTimeLayout, fields["EndTime"], now.Location())
+		if startErr == nil && endErr == nil && !now.Before(start) && now.Before(end) {
+			rm.active = 1
+		}
+		reservations[name] = &rm
+	}
+	return reservations
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm reservations metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewReservationsCollector() *ReservationsCollector {
+	labels := []string{"reservation"}
+	return &ReservationsCollector{
+		active:   NewDesc("slurm_reservation_active", "Whether the reservation is active (1) or not (0)", labels, nil),
+		cpus:     NewDesc("slurm_reservation_cpus", "Reserved CPUs", labels, nil),
+		duration: NewDesc("slurm_reservation_duration_seconds", "Duration of the reservation", labels, nil),
+		nodes:    NewDesc("slurm_reservation_nodes", "Reserved nodes", labels, nil),
+	}
+}
+
+type ReservationsCollector struct {
+	active   *prometheus.Desc
+	cpus     *prometheus.Desc
+	duration *prometheus.Desc
+	nodes    *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (rc *ReservationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.active
+	ch <- rc.cpus
+	ch <- rc.duration
+	ch <- rc.nodes
+}
+
+func (rc *ReservationsCollector) Update(ch chan<- prometheus.Metric) error {
+	reservations, err := ReservationsGetMetrics()
+	if err != nil {
+		return err
+	}
+	for name, rm := range reservations {
+		ch <- prometheus.MustNewConstMetric(rc.active, prometheus.GaugeValue, rm.active, name)
+		ch <- prometheus.MustNewConstMetric(rc.cpus, prometheus.GaugeValue, rm.cpus, name)
+		ch <- prometheus.MustNewConstMetric(rc.duration, prometheus.GaugeValue, rm.duration, name)
+		ch <- prometheus.MustNewConstMetric(rc.nodes, prometheus.GaugeValue, rm.nodes, name)
+	}
+	return nil
+}
+
+// Parse returns the reservations as parsed from scontrol, see DebugParser
+func (rc *ReservationsCollector) Parse() (interface{}, error) {
+	return ReservationsGetMetrics()
+}
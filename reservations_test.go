@@ -0,0 +1,38 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseReservationsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_reservations.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.Local)
+	reservations := ParseReservationsMetrics(data, now)
+	t.Logf("%+v", reservations)
+	assert.Equal(t, map[string]*ReservationMetrics{
+		"maint":    {active: 1, cpus: 400, duration: 43200, nodes: 10},
+		"workshop": {active: 0, cpus: 128, duration: 172800, nodes: 2},
+	}, reservations)
+	assert.Empty(t, ParseReservationsMetrics([]byte("No reservations in the system\n"), now))
+}
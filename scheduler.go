@@ -17,9 +17,6 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -42,82 +39,120 @@ type SchedulerMetrics struct {
 	backfill_last_cycle               float64
 	backfill_mean_cycle               float64
 	backfill_depth_mean               float64
+	backfill_last_depth               float64
 	total_backfilled_jobs_since_start float64
 	total_backfilled_jobs_since_cycle float64
 	total_backfilled_heterogeneous    float64
+	// number of RPCs per message type
+	rpc_count map[string]float64
+	// number of RPCs and their total time in microseconds per user
+	rpc_user_count map[string]float64
+	rpc_user_time  map[string]float64
 }
 
 // Execute the sdiag command and return its output
-func SchedulerData() []byte {
-	cmd := exec.Command("sdiag")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func SchedulerData() ([]byte, error) {
+	return Execute("sdiag", nil)
 }
 
-// Extract the relevant metrics from the sdiag output
+// Sections of the sdiag output which repeat the same keys
+const (
+	sdiagSectionNone = iota
+	sdiagSectionMain
+	sdiagSectionBackfill
+	sdiagSectionRPCType
+	sdiagSectionRPCUser
+)
+
+// Match the RPC statistics per message type or per user, e.g.
+// "REQUEST_PARTITION_INFO ( 2009) count:3290 ave_time:181 total_time:595863"
+var sdiagRPCRegexp = regexp.MustCompile(`^(\S+)\s+\(\s*\d+\)\s+count:(\d+)(?:\s+ave_time:\d+\s+total_time:(\d+))?`)
+
+// Extract the relevant metrics from the sdiag output. The output is split
+// into sections, e.g. both the main and the backfill scheduler report their
+// "Last cycle", thus the parser keeps track of the current section.
 func ParseSchedulerMetrics(input []byte) *SchedulerMetrics {
 	var sm SchedulerMetrics
-	lines := strings.Split(string(input), "\n")
-	// Guard variables to check for string repetitions in the output of sdiag
-	// (two occurencies of the following strings: 'Last cycle', 'Mean cycle')
-	lc_count := 0
-	mc_count := 0
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			state := strings.Split(line, ":")[0]
-			st := regexp.MustCompile(`^Server thread`)
-			qs := regexp.MustCompile(`^Agent queue`)
-			dbd := regexp.MustCompile(`^DBD Agent`)
-			lc := regexp.MustCompile(`^[\s]+Last cycle$`)
-			mc := regexp.MustCompile(`^[\s]+Mean cycle$`)
-			cpm := regexp.MustCompile(`^[\s]+Cycles per`)
-			dpm := regexp.MustCompile(`^[\s]+Depth Mean$`)
-			tbs := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last slurm start\)`)
-			tbc := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last stats cycle start\)`)
-			tbh := regexp.MustCompile(`^[\s]+Total backfilled heterogeneous job components`)
-			switch {
-			case st.MatchString(state) == true:
-				sm.threads, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case qs.MatchString(state) == true:
-				sm.queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dbd.MatchString(state) == true:
-				sm.dbd_queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case lc.MatchString(state) == true:
-				if lc_count == 0 {
-					sm.last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					lc_count = 1
-				}
-				if lc_count == 1 {
-					sm.backfill_last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case mc.MatchString(state) == true:
-				if mc_count == 0 {
-					sm.mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					mc_count = 1
-				}
-				if mc_count == 1 {
-					sm.backfill_mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case cpm.MatchString(state) == true:
-				sm.cycle_per_minute, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dpm.MatchString(state) == true:
-				sm.backfill_depth_mean, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbs.MatchString(state) == true:
-				sm.total_backfilled_jobs_since_start, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbc.MatchString(state) == true:
-				sm.total_backfilled_jobs_since_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbh.MatchString(state) == true:
-				sm.total_backfilled_heterogeneous, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
+	sm.rpc_count = make(map[string]float64)
+	sm.rpc_user_count = make(map[string]float64)
+	sm.rpc_user_time = make(map[string]float64)
+	section := sdiagSectionNone
+	for _, line := range strings.Split(string(input), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "Main schedule statistics"):
+			section = sdiagSectionMain
+			continue
+		case strings.HasPrefix(trimmed, "Backfilling stats"):
+			section = sdiagSectionBackfill
+			continue
+		case strings.HasPrefix(trimmed, "Remote Procedure Call statistics by message type"):
+			section = sdiagSectionRPCType
+			continue
+		case strings.HasPrefix(trimmed, "Remote Procedure Call statistics by user"):
+			section = sdiagSectionRPCUser
+			continue
+		case strings.HasPrefix(trimmed, "Pending RPC statistics"):
+			section = sdiagSectionNone
+			continue
+		}
+		if section == sdiagSectionRPCType {
+			if match := sdiagRPCRegexp.FindStringSubmatch(trimmed); match != nil {
+				sm.rpc_count[match[1]], _ = strconv.ParseFloat(match[2], 64)
+			}
+			continue
+		}
+		if section == sdiagSectionRPCUser {
+			if match := sdiagRPCRegexp.FindStringSubmatch(trimmed); match != nil && UserSelected(match[1]) {
+				sm.rpc_user_count[match[1]], _ = strconv.ParseFloat(match[2], 64)
+				sm.rpc_user_time[match[1]], _ = strconv.ParseFloat(match[3], 64)
+			}
+			continue
+		}
+		kv := strings.SplitN(trimmed, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := kv[0]
+		value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			continue
+		}
+		switch section {
+		case sdiagSectionNone:
+			switch key {
+			case "Server thread count":
+				sm.threads = value
+			case "Agent queue size":
+				sm.queue_size = value
+			case "DBD Agent queue size":
+				sm.dbd_queue_size = value
+			}
+		case sdiagSectionMain:
+			switch key {
+			case "Last cycle":
+				sm.last_cycle = value
+			case "Mean cycle":
+				sm.mean_cycle = value
+			case "Cycles per minute":
+				sm.cycle_per_minute = value
+			}
+		case sdiagSectionBackfill:
+			switch key {
+			case "Last cycle":
+				sm.backfill_last_cycle = value
+			case "Mean cycle":
+				sm.backfill_mean_cycle = value
+			case "Depth Mean":
+				sm.backfill_depth_mean = value
+			case "Last depth cycle":
+				sm.backfill_last_depth = value
+			case "Total backfilled jobs (since last slurm start)":
+				sm.total_backfilled_jobs_since_start = value
+			case "Total backfilled jobs (since last stats cycle start)":
+				sm.total_backfilled_jobs_since_cycle = value
+			case "Total backfilled heterogeneous job components":
+				sm.total_backfilled_heterogeneous = value
 			}
 		}
 	}
@@ -125,8 +160,12 @@ func ParseSchedulerMetrics(input []byte) *SchedulerMetrics {
 }
 
 // Returns the scheduler metrics
-func SchedulerGetMetrics() *SchedulerMetrics {
-	return ParseSchedulerMetrics(SchedulerData())
+func SchedulerGetMetrics() (*SchedulerMetrics, error) {
+	data, err := SchedulerData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchedulerMetrics(data), nil
 }
 
 /*
@@ -149,6 +188,18 @@ type SchedulerCollector struct {
 	total_backfilled_jobs_since_start *prometheus.Desc
 	total_backfilled_jobs_since_cycle *prometheus.Desc
 	total_backfilled_heterogeneous    *prometheus.Desc
+	cycle_last_seconds                *prometheus.Desc
+	cycle_mean_seconds                *prometheus.Desc
+	backfill_last_cycle_seconds       *prometheus.Desc
+	backfill_mean_cycle_seconds       *prometheus.Desc
+	rpc_count                         *prometheus.Desc
+	rpc_user_count                    *prometheus.Desc
+	rpc_user_time                     *prometheus.Desc
+	backfill_jobs_considered          *prometheus.Desc
+	backfill_jobs_started             *prometheus.Desc
+	backfill_depth_mean_jobs          *prometheus.Desc
+	// users of the RPC counters, see LimitedCounters
+	rpc_users *LimitedCounters
 }
 
 // Send all metric descriptions
@@ -165,11 +216,24 @@ func (c *SchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.total_backfilled_jobs_since_start
 	ch <- c.total_backfilled_jobs_since_cycle
 	ch <- c.total_backfilled_heterogeneous
+	ch <- c.cycle_last_seconds
+	ch <- c.cycle_mean_seconds
+	ch <- c.backfill_last_cycle_seconds
+	ch <- c.backfill_mean_cycle_seconds
+	ch <- c.rpc_count
+	ch <- c.rpc_user_count
+	ch <- c.rpc_user_time
+	ch <- c.backfill_jobs_considered
+	ch <- c.backfill_jobs_started
+	ch <- c.backfill_depth_mean_jobs
 }
 
 // Send the values of all metrics
-func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
-	sm := SchedulerGetMetrics()
+func (sc *SchedulerCollector) Update(ch chan<- prometheus.Metric) error {
+	sm, err := SchedulerGetMetrics()
+	if err != nil {
+		return err
+	}
 	ch <- prometheus.MustNewConstMetric(sc.threads, prometheus.GaugeValue, sm.threads)
 	ch <- prometheus.MustNewConstMetric(sc.queue_size, prometheus.GaugeValue, sm.queue_size)
 	ch <- prometheus.MustNewConstMetric(sc.dbd_queue_size, prometheus.GaugeValue, sm.dbd_queue_size)
@@ -182,70 +246,148 @@ func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_start, prometheus.GaugeValue, sm.total_backfilled_jobs_since_start)
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_cycle, prometheus.GaugeValue, sm.total_backfilled_jobs_since_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_heterogeneous, prometheus.GaugeValue, sm.total_backfilled_heterogeneous)
+	// sdiag reports the cycle times in microseconds
+	ch <- prometheus.MustNewConstMetric(sc.cycle_last_seconds, prometheus.GaugeValue, sm.last_cycle/1e6)
+	ch <- prometheus.MustNewConstMetric(sc.cycle_mean_seconds, prometheus.GaugeValue, sm.mean_cycle/1e6)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_last_cycle_seconds, prometheus.GaugeValue, sm.backfill_last_cycle/1e6)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_mean_cycle_seconds, prometheus.GaugeValue, sm.backfill_mean_cycle/1e6)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_jobs_considered, prometheus.GaugeValue, sm.backfill_last_depth)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_jobs_started, prometheus.GaugeValue, sm.total_backfilled_jobs_since_cycle)
+	ch <- prometheus.MustNewConstMetric(sc.backfill_depth_mean_jobs, prometheus.GaugeValue, sm.backfill_depth_mean)
+	for operation, count := range sm.rpc_count {
+		ch <- prometheus.MustNewConstMetric(sc.rpc_count, prometheus.CounterValue, count, operation)
+	}
+	// every user may send RPCs, the number of users may be limited, both
+	// counters share the users ranked by their number of RPCs
+	limited := sc.rpc_users.Limit(sm.rpc_user_count, sm.rpc_user_time)
+	for user, count := range limited[0] {
+		ch <- prometheus.MustNewConstMetric(sc.rpc_user_count, prometheus.CounterValue, count, user)
+	}
+	for user, total := range limited[1] {
+		ch <- prometheus.MustNewConstMetric(sc.rpc_user_time, prometheus.CounterValue, total/1e6, user)
+	}
+	return nil
+}
+
+// Parse returns the scheduler statistics as parsed from sdiag, all users
+// before the user metrics limit, see DebugParser
+func (sc *SchedulerCollector) Parse() (interface{}, error) {
+	return SchedulerGetMetrics()
 }
 
 // Returns the Slurm scheduler collector, used to register with the prometheus client
 func NewSchedulerCollector() *SchedulerCollector {
 	return &SchedulerCollector{
-		threads: prometheus.NewDesc(
+		threads: NewDesc(
 			"slurm_scheduler_threads",
 			"Information provided by the Slurm sdiag command, number of scheduler threads ",
 			nil,
 			nil),
-		queue_size: prometheus.NewDesc(
+		queue_size: NewDesc(
 			"slurm_scheduler_queue_size",
 			"Information provided by the Slurm sdiag command, length of the scheduler queue",
 			nil,
 			nil),
-		dbd_queue_size: prometheus.NewDesc(
+		dbd_queue_size: NewDesc(
 			"slurm_scheduler_dbd_queue_size",
 			"Information provided by the Slurm sdiag command, length of the DBD agent queue",
 			nil,
 			nil),
-		last_cycle: prometheus.NewDesc(
+		last_cycle: NewDesc(
 			"slurm_scheduler_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)",
 			nil,
 			nil),
-		mean_cycle: prometheus.NewDesc(
+		mean_cycle: NewDesc(
 			"slurm_scheduler_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler mean cycle time in (microseconds)",
 			nil,
 			nil),
-		cycle_per_minute: prometheus.NewDesc(
+		cycle_per_minute: NewDesc(
 			"slurm_scheduler_cycle_per_minute",
 			"Information provided by the Slurm sdiag command, number scheduler cycles per minute",
 			nil,
 			nil),
-		backfill_last_cycle: prometheus.NewDesc(
+		backfill_last_cycle: NewDesc(
 			"slurm_scheduler_backfill_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)",
 			nil,
 			nil),
-		backfill_mean_cycle: prometheus.NewDesc(
+		backfill_mean_cycle: NewDesc(
 			"slurm_scheduler_backfill_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in (microseconds)",
 			nil,
 			nil),
-		backfill_depth_mean: prometheus.NewDesc(
+		backfill_depth_mean: NewDesc(
 			"slurm_scheduler_backfill_depth_mean",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean depth",
 			nil,
 			nil),
-		total_backfilled_jobs_since_start: prometheus.NewDesc(
+		total_backfilled_jobs_since_start: NewDesc(
 			"slurm_scheduler_backfilled_jobs_since_start_total",
 			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last slurm start",
 			nil,
 			nil),
-		total_backfilled_jobs_since_cycle: prometheus.NewDesc(
+		total_backfilled_jobs_since_cycle: NewDesc(
 			"slurm_scheduler_backfilled_jobs_since_cycle_total",
 			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last time stats where reset",
 			nil,
 			nil),
-		total_backfilled_heterogeneous: prometheus.NewDesc(
+		total_backfilled_heterogeneous: NewDesc(
 			"slurm_scheduler_backfilled_heterogeneous_total",
 			"Information provided by the Slurm sdiag command, number of heterogeneous job components started thanks to backfilling since last Slurm start",
 			nil,
 			nil),
+		cycle_last_seconds: NewDesc(
+			"slurm_scheduler_cycle_last_seconds",
+			"Information provided by the Slurm sdiag command, scheduler last cycle time in seconds",
+			nil,
+			nil),
+		cycle_mean_seconds: NewDesc(
+			"slurm_scheduler_cycle_mean_seconds",
+			"Information provided by the Slurm sdiag command, scheduler mean cycle time in seconds",
+			nil,
+			nil),
+		backfill_last_cycle_seconds: NewDesc(
+			"slurm_scheduler_backfill_last_cycle_seconds",
+			"Information provided by the Slurm sdiag command, scheduler backfill last cycle time in seconds",
+			nil,
+			nil),
+		backfill_mean_cycle_seconds: NewDesc(
+			"slurm_scheduler_backfill_mean_cycle_seconds",
+			"Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in seconds",
+			nil,
+			nil),
+		rpc_count: NewDesc(
+			"slurm_scheduler_rpc_count_total",
+			"Information provided by the Slurm sdiag command, number of RPCs per message type",
+			[]string{"operation"},
+			nil),
+		rpc_user_count: NewDesc(
+			"slurm_rpc_user_count",
+			"Information provided by the Slurm sdiag command, number of RPCs per user",
+			[]string{"user"},
+			nil),
+		rpc_user_time: NewDesc(
+			"slurm_rpc_user_time_total",
+			"Information provided by the Slurm sdiag command, total time in seconds spent on the RPCs per user",
+			[]string{"user"},
+			nil),
+		backfill_jobs_considered: NewDesc(
+			"slurm_backfill_jobs_considered",
+			"Information provided by the Slurm sdiag command, number of jobs considered by the last backfill cycle",
+			nil,
+			nil),
+		backfill_jobs_started: NewDesc(
+			"slurm_backfill_jobs_started",
+			"Information provided by the Slurm sdiag command, number of jobs started by backfilling since last time stats where reset",
+			nil,
+			nil),
+		backfill_depth_mean_jobs: NewDesc(
+			"slurm_backfill_depth_mean",
+			"Information provided by the Slurm sdiag command, mean number of jobs considered per backfill cycle since last time stats where reset",
+			nil,
+			nil),
+		rpc_users: NewLimitedCounters(),
 	}
 }
@@ -16,8 +16,12 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"flag"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -31,6 +35,71 @@ func TestSchedulerMetrics(t *testing.T) {
 	t.Logf("%+v", ParseSchedulerMetrics(data))
 }
 
+func TestParseSchedulerMetricsSections(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sdiag.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sm := ParseSchedulerMetrics(data)
+	assert.Equal(t, 3.0, sm.threads)
+	assert.Equal(t, 97209.0, sm.last_cycle)
+	assert.Equal(t, 74593.0, sm.mean_cycle)
+	assert.Equal(t, 63.0, sm.cycle_per_minute)
+	assert.Equal(t, 1942890.0, sm.backfill_last_cycle)
+	assert.Equal(t, 1960820.0, sm.backfill_mean_cycle)
+	assert.Equal(t, 29324.0, sm.backfill_depth_mean)
+	assert.Equal(t, 111544.0, sm.total_backfilled_jobs_since_start)
+	assert.Equal(t, 793.0, sm.total_backfilled_jobs_since_cycle)
+	// only the depth of the backfill section, not of the main scheduler
+	assert.Equal(t, 56.0, sm.backfill_last_depth)
+	assert.Equal(t, map[string]float64{
+		"REQUEST_PARTITION_INFO":           3290,
+		"MESSAGE_NODE_REGISTRATION_STATUS": 88,
+		"REQUEST_JOB_INFO":                 1210,
+	}, sm.rpc_count)
+	assert.Equal(t, map[string]float64{"root": 4500, "alice": 88}, sm.rpc_user_count)
+	assert.Equal(t, map[string]float64{"root": 2532347, "alice": 34426}, sm.rpc_user_time)
+}
+
 func TestSchedulerGetMetrics(t *testing.T) {
-	t.Logf("%+v", SchedulerGetMetrics())
+	metrics, err := SchedulerGetMetrics()
+	t.Logf("%+v %v", metrics, err)
+}
+
+func TestSchedulerRPCUsersLimit(t *testing.T) {
+	defer useFixtures(fixtureExecutor{"sdiag": "test_data/sdiag.txt"})()
+	defer flag.Set("slurm.user-metrics-limit", "0")
+	flag.Set("slurm.user-metrics-limit", "1")
+
+	// alice sends fewer RPCs than root and is folded into __other__ of both
+	// counters
+	expected := `
+# HELP slurm_rpc_user_count Information provided by the Slurm sdiag command, number of RPCs per user
+# TYPE slurm_rpc_user_count counter
+slurm_rpc_user_count{user="__other__"} 88
+slurm_rpc_user_count{user="root"} 4500
+# HELP slurm_rpc_user_time_total Information provided by the Slurm sdiag command, total time in seconds spent on the RPCs per user
+# TYPE slurm_rpc_user_time_total counter
+slurm_rpc_user_time_total{user="__other__"} 0.034426
+slurm_rpc_user_time_total{user="root"} 2.532347
+`
+	collector := newScrapeCollector("scheduler", NewSchedulerCollector())
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_rpc_user_count", "slurm_rpc_user_time_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedulerRPCCount(t *testing.T) {
+	defer useFixtures(fixtureExecutor{"sdiag": "test_data/sdiag.txt"})()
+	expected := `
+# HELP slurm_scheduler_rpc_count_total Information provided by the Slurm sdiag command, number of RPCs per message type
+# TYPE slurm_scheduler_rpc_count_total counter
+slurm_scheduler_rpc_count_total{operation="MESSAGE_NODE_REGISTRATION_STATUS"} 88
+slurm_scheduler_rpc_count_total{operation="REQUEST_JOB_INFO"} 1210
+slurm_scheduler_rpc_count_total{operation="REQUEST_PARTITION_INFO"} 3290
+`
+	collector := newScrapeCollector("scheduler", NewSchedulerCollector())
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_scheduler_rpc_count_total"); err != nil {
+		t.Fatal(err)
+	}
 }
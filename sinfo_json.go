@@ -0,0 +1,337 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Set once sinfo turned out to not support --json, all further node data is
+// read from its text output
+var sinfoJSONUnsupported atomic.Bool
+
+// Time the decoded nodes of sinfo --json are shared. The collectors of a
+// scrape run concurrently and all ask for the nodes within this time, so a
+// scrape runs sinfo --json once and all collectors see the same snapshot.
+var sinfoJSONReuse = 5 * time.Second
+
+// The nodes of the last run of sinfo --json, or its error
+type sinfoJSONSnapshot struct {
+	sync.Mutex
+	nodes   []sinfoJSONNode
+	err     error
+	expires time.Time
+}
+
+var sinfoJSONLast sinfoJSONSnapshot
+
+// The nodes of sinfo --json
+type sinfoJSON struct {
+	Nodes []sinfoJSONNode `json:"nodes"`
+}
+
+type sinfoJSONNode struct {
+	Name string `json:"name"`
+	// The state is a string with separate flags up to Slurm 22.05 and a
+	// list of the state and its flags since Slurm 23.02
+	State       json.RawMessage `json:"state"`
+	StateFlags  []string        `json:"state_flags"`
+	CPUs        sinfoJSONNumber `json:"cpus"`
+	AllocCPUs   sinfoJSONNumber `json:"alloc_cpus"`
+	IdleCPUs    sinfoJSONNumber `json:"idle_cpus"`
+	RealMemory  sinfoJSONNumber `json:"real_memory"`
+	AllocMemory sinfoJSONNumber `json:"alloc_memory"`
+	// The load multiplied by 100
+	CPULoad    *sinfoJSONNumber `json:"cpu_load"`
+	Gres       string           `json:"gres"`
+	Partitions []string         `json:"partitions"`
+}
+
+// A number of sinfo --json, either plain or as an object of "set" and
+// "number" like Slurm 23.02 prints some of them
+type sinfoJSONNumber float64
+
+func (n *sinfoJSONNumber) UnmarshalJSON(data []byte) error {
+	var number float64
+	if err := json.Unmarshal(data, &number); err == nil {
+		*n = sinfoJSONNumber(number)
+		return nil
+	}
+	var object struct {
+		Set    bool    `json:"set"`
+		Number float64 `json:"number"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*n = sinfoJSONNumber(object.Number)
+	return nil
+}
+
+// States returns the state of the node followed by its flags, all upper case,
+// e.g. ["IDLE", "DRAIN"]
+func (n sinfoJSONNode) States() []string {
+	var states []string
+	var state string
+	if json.Unmarshal(n.State, &state) == nil {
+		states = []string{state}
+	} else {
+		json.Unmarshal(n.State, &states)
+	}
+	states = append(states, n.StateFlags...)
+	for i := range states {
+		states[i] = strings.ToUpper(states[i])
+	}
+	return states
+}
+
+// Suffixes of sinfo for the node state flags
+var sinfoStateSuffixes = []struct {
+	flag   string
+	suffix string
+}{
+	{"NOT_RESPONDING", "*"},
+	{"POWERED_DOWN", "~"},
+	{"POWERING_UP", "#"},
+	{"POWERING_DOWN", "%"},
+	{"REBOOT_REQUESTED", "@"},
+}
+
+// LongState formats the state of the node like sinfo prints it with %T, e.g.
+// "drained*" for an idle node which is drained and does not respond
+func (n sinfoJSONNode) LongState() string {
+	return LongNodeState(n.States())
+}
+
+// LongNodeState formats a node state and its flags, all upper case like
+// Slurm reports them in JSON or scontrol, as sinfo prints it with %T
+func LongNodeState(states []string) string {
+	if len(states) == 0 {
+		return "unknown"
+	}
+	flags := make(map[string]bool)
+	for _, flag := range states[1:] {
+		flags[flag] = true
+	}
+	state := strings.ToLower(states[0])
+	switch {
+	case flags["DRAIN"] && (state == "allocated" || state == "mixed" || flags["COMPLETING"]):
+		state = "draining"
+	case flags["DRAIN"]:
+		state = "drained"
+	case flags["FAIL"]:
+		state = "fail"
+	case flags["MAINTENANCE"]:
+		state = "maint"
+	case flags["COMPLETING"]:
+		state = "completing"
+	case flags["RESERVED"] && state == "idle":
+		state = "reserved"
+	}
+	for _, s := range sinfoStateSuffixes {
+		if flags[s.flag] {
+			state += s.suffix
+		}
+	}
+	return state
+}
+
+// ParseSinfoJSON decodes the output of sinfo --json into its nodes. Without
+// a partition configured on the command line all nodes are returned,
+// otherwise the nodes of the configured partitions, as --json ignores the
+// --partition argument of sinfo.
+func ParseSinfoJSON(input []byte) ([]sinfoJSONNode, error) {
+	var sinfo sinfoJSON
+	if err := json.Unmarshal(input, &sinfo); err != nil {
+		return nil, fmt.Errorf("can not decode sinfo JSON output: %v", err)
+	}
+	return selectSinfoJSONNodes(sinfo.Nodes), nil
+}
+
+func selectSinfoJSONNodes(all []sinfoJSONNode) []sinfoJSONNode {
+	if *partitionsFilter == "" {
+		return all
+	}
+	var nodes []sinfoJSONNode
+	for _, node := range all {
+		if nodeInSelectedPartition(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func nodeInSelectedPartition(node sinfoJSONNode) bool {
+	for _, partition := range node.Partitions {
+		if PartitionSelected(partition) {
+			return true
+		}
+	}
+	return false
+}
+
+// sinfoJSONUnsupportedError returns whether sinfo rejected the --json option
+func sinfoJSONUnsupportedError(err error) bool {
+	return strings.Contains(err.Error(), "unrecognized option") || strings.Contains(err.Error(), "invalid option")
+}
+
+// SinfoJSONNodes returns the nodes of sinfo --json if enabled on the command
+// line. It returns false if the node data has to be read from the text output
+// of sinfo instead: the JSON output is disabled or sinfo does not support it,
+// i.e. Slurm is older than 21.08. Any other failure of sinfo or its output is
+// returned as error.
+//
+// The nodes are decoded once and shared by all callers within sinfoJSONReuse,
+// concurrent callers wait for a running sinfo instead of starting it once
+// more.
+func SinfoJSONNodes() ([]sinfoJSONNode, bool, error) {
+	if !*sinfoJSONFlag || sinfoJSONUnsupported.Load() {
+		return nil, false, nil
+	}
+	nodes, err := sinfoJSONLast.get(time.Now())
+	if err != nil {
+		if sinfoJSONUnsupported.Load() {
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+	return selectSinfoJSONNodes(nodes), true, nil
+}
+
+// get returns the nodes of the snapshot, running sinfo --json once the
+// snapshot is older than sinfoJSONReuse
+func (s *sinfoJSONSnapshot) get(now time.Time) ([]sinfoJSONNode, error) {
+	s.Lock()
+	defer s.Unlock()
+	if now.Before(s.expires) {
+		return s.nodes, s.err
+	}
+	var sinfo sinfoJSON
+	output, err := Execute("sinfo", []string{"--json"})
+	if err == nil {
+		if err = json.Unmarshal(output, &sinfo); err != nil {
+			err = fmt.Errorf("can not decode sinfo JSON output: %v", err)
+		}
+	} else if sinfoJSONUnsupportedError(err) {
+		sinfoJSONUnsupported.Store(true)
+		slog.Warn("sinfo does not support --json, using its text output", "err", err)
+	}
+	s.nodes, s.err, s.expires = sinfo.Nodes, err, time.Now().Add(sinfoJSONReuse)
+	return s.nodes, s.err
+}
+
+// reset drops the snapshot, the next caller runs sinfo --json again
+func (s *sinfoJSONSnapshot) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.nodes, s.err, s.expires = nil, nil, time.Time{}
+}
+
+func formatUint(n sinfoJSONNumber) string {
+	if n < 0 {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+// CPUStates returns the allocated, idle and other CPUs of the node. Like
+// sinfo, the CPUs not allocated on a drained, down or failed node are
+// counted as other instead of idle.
+func (n sinfoJSONNode) CPUStates() (alloc, idle, other sinfoJSONNumber) {
+	alloc, idle = n.AllocCPUs, n.IdleCPUs
+	for _, state := range n.States() {
+		if state == "DRAIN" || state == "DOWN" || state == "FAIL" {
+			idle = 0
+			break
+		}
+	}
+	if other = n.CPUs - alloc - idle; other < 0 {
+		other = 0
+	}
+	return alloc, idle, other
+}
+
+// SinfoJSONNodeLines formats the nodes like
+// sinfo -h -N -O NodeList,AllocMem,Memory,CPUsState,StateLong,CPUsLoad
+func SinfoJSONNodeLines(nodes []sinfoJSONNode) []byte {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		alloc, idle, other := node.CPUStates()
+		load := "N/A"
+		if node.CPULoad != nil {
+			load = strconv.FormatFloat(float64(*node.CPULoad)/100, 'f', 2, 64)
+		}
+		fmt.Fprintf(&buf, "%s %s %s %s/%s/%s/%s %s %s\n", node.Name,
+			formatUint(node.AllocMemory), formatUint(node.RealMemory),
+			formatUint(alloc), formatUint(idle), formatUint(other), formatUint(node.CPUs),
+			node.LongState(), load)
+	}
+	return buf.Bytes()
+}
+
+// SinfoJSONCPUsLines formats the CPUs of all nodes like sinfo -h -o %C
+func SinfoJSONCPUsLines(nodes []sinfoJSONNode) []byte {
+	var alloc, idle, other, total sinfoJSONNumber
+	for _, node := range nodes {
+		a, i, o := node.CPUStates()
+		alloc += a
+		idle += i
+		other += o
+		total += node.CPUs
+	}
+	return []byte(fmt.Sprintf("%s/%s/%s/%s\n", formatUint(alloc), formatUint(idle), formatUint(other), formatUint(total)))
+}
+
+// SinfoJSONNodesLines formats the number of nodes per state like
+// sinfo -h -o %D,%T
+func SinfoJSONNodesLines(nodes []sinfoJSONNode) []byte {
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		counts[node.LongState()]++
+	}
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	var buf bytes.Buffer
+	for _, state := range states {
+		fmt.Fprintf(&buf, "%d,%s\n", counts[state], state)
+	}
+	return buf.Bytes()
+}
+
+// SinfoJSONGPUsLines formats the nodes like sinfo -h -o "%n %T %G"
+func SinfoJSONGPUsLines(nodes []sinfoJSONNode) []byte {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		gres := node.Gres
+		if gres == "" {
+			gres = "(null)"
+		}
+		fmt.Fprintf(&buf, "%s %s %s\n", node.Name, node.LongState(), gres)
+	}
+	return buf.Bytes()
+}
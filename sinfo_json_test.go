@@ -0,0 +1,168 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSinfoJSON(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_nodes.json")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes, err := ParseSinfoJSON(data)
+	assert.NoError(t, err)
+	states := make(map[string]string)
+	for _, node := range nodes {
+		states[node.Name] = node.LongState()
+	}
+	assert.Equal(t, map[string]string{
+		"a048":   "mixed",
+		"gpu001": "drained",
+		"gpu002": "down*",
+		"gpu003": "draining",
+		"gpu004": "idle~",
+	}, states)
+
+	metrics := ParseNodeMetrics(SinfoJSONNodeLines(nodes))
+	assert.Equal(t, &NodeMetrics{memAlloc: 163840, memTotal: 193000, cpuAlloc: 8, cpuIdle: 8, cpuTotal: 16,
+		cpuLoad: 15.87, cpuLoadKnown: true, nodeStatus: "mixed"}, metrics["a048"])
+	// the CPUs of drained, draining and down nodes are no idle CPUs
+	assert.Equal(t, uint64(32), metrics["gpu001"].cpuOther)
+	assert.False(t, metrics["gpu002"].cpuLoadKnown)
+	assert.Equal(t, uint64(512000), metrics["gpu003"].memTotal)
+	assert.Equal(t, 8.0, metrics["gpu003"].cpuLoad)
+
+	assert.Equal(t, &CPUsMetrics{alloc: 24, idle: 40, other: 80, total: 144}, ParseCPUsMetrics(SinfoJSONCPUsLines(nodes)))
+
+	total, unavailable := ParseTotalGPUsText(SinfoJSONGPUsLines(nodes))
+	assert.Equal(t, map[string]float64{"v100": 6, "a100": 8}, total)
+	assert.Equal(t, map[string]float64{"v100": 6, "a100": 8}, unavailable)
+
+	_, err = ParseSinfoJSON([]byte("5725/877/34/6636\n"))
+	assert.Error(t, err)
+}
+
+// countingExecutor counts the executions of every command line
+type countingExecutor struct {
+	sync.Mutex
+	fixtureExecutor
+	executions map[string]int
+}
+
+func (c *countingExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	c.Lock()
+	c.executions[strings.Join(append([]string{command}, arguments...), " ")]++
+	c.Unlock()
+	return c.fixtureExecutor.Execute(ctx, command, arguments)
+}
+
+// unsupportedExecutor fails like sinfo of Slurm older than 21.08 on --json
+type unsupportedExecutor struct {
+	fixtureExecutor
+}
+
+func (u unsupportedExecutor) Execute(ctx context.Context, command string, arguments []string) ([]byte, error) {
+	if command == "sinfo" && len(arguments) == 1 && arguments[0] == "--json" {
+		return nil, fmt.Errorf("sinfo: unrecognized option '--json'")
+	}
+	return u.fixtureExecutor.Execute(ctx, command, arguments)
+}
+
+func TestSinfoJSONNodes(t *testing.T) {
+	counting := &countingExecutor{
+		fixtureExecutor: fixtureExecutor{
+			"sinfo --json":   "test_data/sinfo_nodes.json",
+			"sinfo -h -o %C": "test_data/sinfo_cpus.txt",
+		},
+		executions: make(map[string]int),
+	}
+	previous := executor
+	executor = counting
+	defer func() { executor = previous }()
+	sinfoJSONLast.reset()
+	defer sinfoJSONLast.reset()
+	defer flag.Set("slurm.sinfo-json", "false")
+	defer flag.Set("slurm.partitions", "")
+
+	// disabled by default
+	cpus, err := CPUsGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, 6636.0, cpus.total)
+
+	flag.Set("slurm.sinfo-json", "true")
+	cpus, err = CPUsGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, 144.0, cpus.total)
+
+	nodes, err := NodesGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"mix": 1, "drain": 1, "draining": 1, "down": 1, "powered_down": 1}, nodes.states)
+
+	// --json ignores --partition, the nodes are filtered by the exporter
+	flag.Set("slurm.partitions", "debug")
+	selected, ok, err := SinfoJSONNodes()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, selected, 1)
+	assert.Equal(t, "gpu003", selected[0].Name)
+
+	// all collectors of a scrape share a single run of sinfo --json
+	assert.Equal(t, 1, counting.executions["sinfo --json"])
+}
+
+func TestSinfoJSONFallback(t *testing.T) {
+	previous := executor
+	executor = unsupportedExecutor{fixtureExecutor{
+		"sinfo -h -o %C": "test_data/sinfo_cpus.txt",
+	}}
+	defer func() { executor = previous }()
+	sinfoJSONLast.reset()
+	defer sinfoJSONLast.reset()
+	defer flag.Set("slurm.sinfo-json", "false")
+	defer sinfoJSONUnsupported.Store(false)
+
+	// sinfo of Slurm older than 21.08 does not know --json
+	flag.Set("slurm.sinfo-json", "true")
+	cpus, err := CPUsGetMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, 6636.0, cpus.total)
+	assert.True(t, sinfoJSONUnsupported.Load())
+}
+
+func TestSinfoJSONError(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"sinfo --json":   "test_data/sinfo_cpus.txt",
+		"sinfo -h -o %C": "test_data/sinfo_cpus.txt",
+	})()
+	sinfoJSONLast.reset()
+	defer sinfoJSONLast.reset()
+	defer flag.Set("slurm.sinfo-json", "false")
+
+	// output which is no JSON is an error, not a reason to use the text output
+	flag.Set("slurm.sinfo-json", "true")
+	_, err := CPUsGetMetrics()
+	assert.Error(t, err)
+	assert.False(t, sinfoJSONUnsupported.Load())
+}
@@ -0,0 +1,82 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout of the times printed by Slurm, e.g. the start and end time of a
+// reservation or the submit time of a job, in the local time zone
+const slurmTimeLayout = "2006-01-02T15:04:05"
+
+// ParseSlurmDuration parses a duration as printed by Slurm, e.g. the Elapsed,
+// TotalCPU and Timelimit of sacct or the Duration of a reservation:
+// "[days-][hours:]minutes:seconds", where the seconds may have a fraction
+// like the "12:34.567" of TotalCPU. Slurm prints "UNLIMITED",
+// "Partition_Limit", "INVALID" or "N/A" instead of a duration, which are
+// reported as an error like any other malformed duration. All collectors
+// parse durations with it, so that they handle these values alike.
+func ParseSlurmDuration(duration string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid duration %q", duration)
+	clock := duration
+	var days int
+	if i := strings.Index(clock, "-"); i >= 0 {
+		if !isDigits(clock[:i]) {
+			return 0, invalid
+		}
+		days, _ = strconv.Atoi(clock[:i])
+		clock = clock[i+1:]
+	}
+	fields := strings.Split(clock, ":")
+	if len(fields) > 3 {
+		return 0, invalid
+	}
+	var seconds int
+	for _, field := range fields[:len(fields)-1] {
+		if !isDigits(field) {
+			return 0, invalid
+		}
+		value, _ := strconv.Atoi(field)
+		seconds = seconds*60 + value
+	}
+	// only plain decimals, ParseFloat also accepts e.g. "1e3" or "Inf"
+	last := fields[len(fields)-1]
+	if !isDigits(strings.Replace(last, ".", "", 1)) {
+		return 0, invalid
+	}
+	fraction, err := strconv.ParseFloat(last, 64)
+	if err != nil {
+		return 0, invalid
+	}
+	return time.Duration(days*86400+seconds*60)*time.Second + time.Duration(fraction*float64(time.Second)), nil
+}
+
+// isDigits returns whether s is a non-empty string of the digits 0-9
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
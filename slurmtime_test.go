@@ -0,0 +1,43 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseSlurmDuration(t *testing.T) {
+	for input, expected := range map[string]time.Duration{
+		"3-12:30:45":   3*24*time.Hour + 12*time.Hour + 30*time.Minute + 45*time.Second,
+		"1-02:03:04":   26*time.Hour + 3*time.Minute + 4*time.Second,
+		"2-00:00:01.5": 48*time.Hour + 1500*time.Millisecond,
+		"01:00:00":     time.Hour,
+		"30:00":        30 * time.Minute,
+		"12:34.567":    12*time.Minute + 34567*time.Millisecond,
+		"00:00:00":     0,
+		"45":           45 * time.Second,
+	} {
+		duration, err := ParseSlurmDuration(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, duration, input)
+	}
+	for _, input := range []string{"UNLIMITED", "Partition_Limit", "INVALID", "N/A", "", "1-", "-01:00:00", "1:2:3:4", "01:-1:00", "1e3", "Inf", "01:00:00.1.2"} {
+		_, err := ParseSlurmDuration(input)
+		assert.Error(t, err, input)
+	}
+}
@@ -16,71 +16,118 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
         "strings"
         "strconv"
         "github.com/prometheus/client_golang/prometheus"
 )
 
-func FairShareData() []byte {
-        cmd := exec.Command( "sshare", "-n","-a","-U","-P", "-o", "user,fairshare" )
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+// Execute sshare for all accounts, an account is indented by one space
+// per level of the hierarchy and its rows have no user.
+func FairShareData() ([]byte, error) {
+        return Execute("sshare", []string{"-n", "-a", "-P", "-o", "account,user,normusage,fairshare"})
 }
 
 type FairShareMetrics struct {
         fairshare float64
+        usage float64
+}
+
+// Users are reported per account, a user may belong to several accounts
+type fairShareUser struct {
+        account string
+        user string
+}
+
+func FairShareGetMetrics() (map[string]*FairShareMetrics, map[fairShareUser]*FairShareMetrics, error) {
+        data, err := FairShareData()
+        if err != nil {
+                return nil, nil, err
+        }
+        accounts, users := ParseFairShareMetrics(data, *fairShareLevel)
+        return accounts, users, nil
 }
 
-func ParseFairShareMetrics() map[string]*FairShareMetrics {
+// ParseFairShareMetrics returns the fairshare factor and the normalized usage
+// of the accounts and of the users per account, depending on the level:
+// "account" returns the accounts without the root of the hierarchy, "user"
+// returns the users only and "all" returns all rows including the root.
+func ParseFairShareMetrics(input []byte, level string) (map[string]*FairShareMetrics, map[fairShareUser]*FairShareMetrics) {
         accounts := make(map[string]*FairShareMetrics)
-        lines := strings.Split(string(FairShareData()), "\n")
+        users := make(map[fairShareUser]*FairShareMetrics)
+        lines := strings.Split(string(input), "\n")
         for _, line := range lines {
-                if ! strings.HasPrefix(line,"  ") {
-                        if strings.Contains(line,"|") {
-                                account := strings.Trim(strings.Split(line,"|")[0]," ")
-                                _,key := accounts[account]
-                                if !key {
-                                        accounts[account] = &FairShareMetrics{0}
-                                }
-                                fairshare,_ := strconv.ParseFloat(strings.Split(line,"|")[1],64)
-                                accounts[account].fairshare = fairshare
-                        }
+                fields := strings.Split(line,"|")
+                if len(fields) < 4 {
+                        continue
+                }
+                account := strings.TrimSpace(fields[0])
+                user := strings.TrimSpace(fields[1])
+                if account == "" {
+                        continue
+                }
+                usage,_ := strconv.ParseFloat(strings.TrimSpace(fields[2]),64)
+                fairshare,_ := strconv.ParseFloat(strings.TrimSpace(fields[3]),64)
+                switch {
+                case user != "" && level != "account":
+                        users[fairShareUser{account, user}] = &FairShareMetrics{fairshare, usage}
+                case user == "" && level == "all":
+                        accounts[account] = &FairShareMetrics{fairshare, usage}
+                case user == "" && level == "account" && account != "root":
+                        accounts[account] = &FairShareMetrics{fairshare, usage}
                 }
         }
-        return accounts
+        return accounts, users
 }
 
 type FairShareCollector struct {
         fairshare *prometheus.Desc
+        usage *prometheus.Desc
+        userFairshare *prometheus.Desc
+        userUsage *prometheus.Desc
 }
 
 func NewFairShareCollector() *FairShareCollector {
         labels := []string{"account"}
         return &FairShareCollector{
-                fairshare: prometheus.NewDesc("slurm_account_fairshare","FairShare for account" , labels,nil),
+                fairshare: NewDesc("slurm_account_fairshare","FairShare for account" , labels,nil),
+                usage: NewDesc("slurm_account_usage","Normalized usage for account" , labels,nil),
+                userFairshare: NewDesc("slurm_user_fairshare","FairShare for user of account" , []string{"account","user"},nil),
+                userUsage: NewDesc("slurm_user_usage","Normalized usage for user of account" , []string{"account","user"},nil),
         }
 }
 
 func (fsc *FairShareCollector) Describe(ch chan<- *prometheus.Desc) {
         ch <- fsc.fairshare
+        ch <- fsc.usage
+        ch <- fsc.userFairshare
+        ch <- fsc.userUsage
 }
 
-func (fsc *FairShareCollector) Collect(ch chan<- prometheus.Metric) {
-        fsm := ParseFairShareMetrics()
+func (fsc *FairShareCollector) Update(ch chan<- prometheus.Metric) error {
+        fsm, users, err := FairShareGetMetrics()
+        if err != nil {
+                return err
+        }
         for f := range fsm {
                 ch <- prometheus.MustNewConstMetric(fsc.fairshare, prometheus.GaugeValue, fsm[f].fairshare, f)
+                ch <- prometheus.MustNewConstMetric(fsc.usage, prometheus.GaugeValue, fsm[f].usage, f)
+        }
+        for u := range users {
+                ch <- prometheus.MustNewConstMetric(fsc.userFairshare, prometheus.GaugeValue, users[u].fairshare, u.account, u.user)
+                ch <- prometheus.MustNewConstMetric(fsc.userUsage, prometheus.GaugeValue, users[u].usage, u.account, u.user)
+        }
+        return nil
+}
+
+// Parse returns the fair-share per account and per user as parsed from
+// sshare, see DebugParser
+func (fsc *FairShareCollector) Parse() (interface{}, error) {
+        fsm, users, err := FairShareGetMetrics()
+        if err != nil {
+                return nil, err
         }
+        return struct {
+                Accounts map[string]*FairShareMetrics        `json:"accounts"`
+                Users    map[fairShareUser]*FairShareMetrics `json:"users"`
+        }{fsm, users}, nil
 }
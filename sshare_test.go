@@ -0,0 +1,51 @@
+/* Copyright 2021 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseFairShareMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sshare.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	accounts, users := ParseFairShareMetrics(data, "account")
+	t.Logf("%+v", accounts)
+	assert.Equal(t, map[string]*FairShareMetrics{
+		"physics":   {fairshare: 0.25, usage: 0.412},
+		"chemistry": {fairshare: 0.75, usage: 0.088},
+		"theory":    {fairshare: 0.75, usage: 0.088},
+	}, accounts)
+	assert.Empty(t, users)
+
+	accounts, users = ParseFairShareMetrics(data, "user")
+	assert.Empty(t, accounts)
+	assert.Equal(t, map[fairShareUser]*FairShareMetrics{
+		{"root", "root"}:     {fairshare: 1, usage: 0},
+		{"physics", "alice"}: {fairshare: 0.2, usage: 0.4},
+		{"physics", "bob"}:   {fairshare: 0.7, usage: 0.012},
+		{"theory", "carol"}:  {fairshare: 0.75, usage: 0.088},
+	}, users)
+
+	accounts, users = ParseFairShareMetrics(data, "all")
+	assert.Len(t, accounts, 4)
+	assert.Equal(t, &FairShareMetrics{fairshare: 0, usage: 1}, accounts["root"])
+	assert.Len(t, users, 4)
+}
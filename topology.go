@@ -0,0 +1,286 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A switch of the topology/tree plugin with its nodes, including the nodes
+// of all switches below it
+type TopologySwitch struct {
+	level    string
+	nodes    map[string]bool
+	switches []string
+}
+
+type TopologyMetrics struct {
+	// nodes and allocated nodes per switch
+	nodes map[string]float64
+	alloc map[string]float64
+	level map[string]string
+}
+
+// Execute scontrol to get the switches of the network topology, one per line
+func TopologyData() ([]byte, error) {
+	return Execute("scontrol", []string{"show", "topology"})
+}
+
+// Execute sinfo to get the state of every node
+func TopologyNodesData() ([]byte, error) {
+	return Execute("sinfo", []string{"-h", "-N", "-o", "%n|%T"})
+}
+
+// ExpandHostlist expands a Slurm hostlist expression like
+// "tux[01-03,7],login1" into the single host names. Expressions with
+// several ranges, e.g. "rack[1-2]-node[1-2]", are expanded as well.
+func ExpandHostlist(hostlist string) ([]string, error) {
+	var hosts []string
+	for _, expression := range SplitHostlist(hostlist) {
+		expanded, err := expandHostRange(expression)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, expanded...)
+	}
+	return hosts, nil
+}
+
+// SplitHostlist splits a hostlist at the commas outside of brackets
+func SplitHostlist(hostlist string) []string {
+	var expressions []string
+	depth, start := 0, 0
+	for i, c := range hostlist {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				expressions = append(expressions, hostlist[start:i])
+				start = i + 1
+			}
+		}
+	}
+	expressions = append(expressions, hostlist[start:])
+	var nonEmpty []string
+	for _, expression := range expressions {
+		if expression = strings.TrimSpace(expression); expression != "" {
+			nonEmpty = append(nonEmpty, expression)
+		}
+	}
+	return nonEmpty
+}
+
+// expandHostRange expands the first range of a single host expression and
+// recurses for further ranges. Leading zeros of a range are kept, e.g.
+// "a[08-10]" becomes "a08", "a09" and "a10".
+func expandHostRange(expression string) ([]string, error) {
+	open := strings.Index(expression, "[")
+	if open < 0 {
+		return []string{expression}, nil
+	}
+	close := strings.Index(expression[open:], "]")
+	if close < 0 {
+		return nil, fmt.Errorf("invalid hostlist %q: missing ]", expression)
+	}
+	close += open
+	prefix, suffix := expression[:open], expression[close+1:]
+	rests, err := expandHostRange(suffix)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, part := range strings.Split(expression[open+1:close], ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostlist %q: %v", expression, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid hostlist %q: %v", expression, err)
+			}
+		}
+		width := len(bounds[0])
+		for n := first; n <= last; n++ {
+			for _, rest := range rests {
+				hosts = append(hosts, fmt.Sprintf("%s%0*d%s", prefix, width, n, rest))
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// ParseTopology parses the switches printed by scontrol as "Key=Value"
+// pairs. Switches of a higher level list the switches below them, their
+// nodes are the nodes of these switches if scontrol does not list them.
+func ParseTopology(input []byte) (map[string]*TopologySwitch, error) {
+	switches := make(map[string]*TopologySwitch)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		name, ok := fields["SwitchName"]
+		if !ok {
+			continue
+		}
+		sw := &TopologySwitch{level: fields["Level"], nodes: make(map[string]bool)}
+		if fields["Nodes"] != "" {
+			nodes, err := ExpandHostlist(fields["Nodes"])
+			if err != nil {
+				return nil, err
+			}
+			for _, node := range nodes {
+				sw.nodes[node] = true
+			}
+		}
+		if fields["Switches"] != "" {
+			children, err := ExpandHostlist(fields["Switches"])
+			if err != nil {
+				return nil, err
+			}
+			sw.switches = children
+		}
+		switches[name] = sw
+	}
+	for _, sw := range switches {
+		addSwitchNodes(sw, sw, switches, make(map[string]bool))
+	}
+	return switches, nil
+}
+
+// addSwitchNodes adds the nodes of all switches below a switch to the nodes
+// of the top switch, a switch visited once is skipped to survive loops
+func addSwitchNodes(top *TopologySwitch, sw *TopologySwitch, switches map[string]*TopologySwitch, visited map[string]bool) {
+	for _, name := range sw.switches {
+		child, ok := switches[name]
+		if !ok || visited[name] {
+			continue
+		}
+		visited[name] = true
+		for node := range child.nodes {
+			top.nodes[node] = true
+		}
+		addSwitchNodes(top, child, switches, visited)
+	}
+}
+
+// NodeAllocated returns whether a node in the given state as printed by
+// sinfo runs at least one job
+func NodeAllocated(state string) bool {
+	switch NormalizeNodeState(state) {
+	case "alloc", "mix", "comp", "draining":
+		return true
+	}
+	return false
+}
+
+// ParseTopologyMetrics counts the nodes and the allocated nodes per switch,
+// the node states are lines of "node|state" as printed by sinfo
+func ParseTopologyMetrics(switches map[string]*TopologySwitch, nodeStates []byte) *TopologyMetrics {
+	tm := TopologyMetrics{
+		nodes: make(map[string]float64),
+		alloc: make(map[string]float64),
+		level: make(map[string]string),
+	}
+	allocated := make(map[string]bool)
+	for _, line := range strings.Split(string(nodeStates), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "|", 2)
+		if len(fields) == 2 && NodeAllocated(fields[1]) {
+			allocated[fields[0]] = true
+		}
+	}
+	for name, sw := range switches {
+		tm.level[name] = sw.level
+		tm.nodes[name] = float64(len(sw.nodes))
+		for node := range sw.nodes {
+			if allocated[node] {
+				tm.alloc[name]++
+			}
+		}
+	}
+	return &tm
+}
+
+func TopologyGetMetrics() (*TopologyMetrics, error) {
+	data, err := TopologyData()
+	if err != nil {
+		return nil, err
+	}
+	switches, err := ParseTopology(data)
+	if err != nil {
+		return nil, err
+	}
+	nodeStates, err := TopologyNodesData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseTopologyMetrics(switches, nodeStates), nil
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm network topology metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewTopologyCollector() *TopologyCollector {
+	labels := []string{"switch", "level"}
+	return &TopologyCollector{
+		nodes: NewDesc("slurm_topology_switch_nodes", "Nodes below a switch of the network topology", labels, nil),
+		alloc: NewDesc("slurm_topology_switch_nodes_alloc", "Nodes running jobs below a switch of the network topology", labels, nil),
+	}
+}
+
+type TopologyCollector struct {
+	nodes *prometheus.Desc
+	alloc *prometheus.Desc
+}
+
+// Send all metric descriptions
+func (tc *TopologyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.nodes
+	ch <- tc.alloc
+}
+
+func (tc *TopologyCollector) Update(ch chan<- prometheus.Metric) error {
+	tm, err := TopologyGetMetrics()
+	if err != nil {
+		return err
+	}
+	for name, nodes := range tm.nodes {
+		ch <- prometheus.MustNewConstMetric(tc.nodes, prometheus.GaugeValue, nodes, name, tm.level[name])
+		ch <- prometheus.MustNewConstMetric(tc.alloc, prometheus.GaugeValue, tm.alloc[name], name, tm.level[name])
+	}
+	return nil
+}
+
+// Parse returns the switches of the network topology with their nodes, see
+// DebugParser
+func (tc *TopologyCollector) Parse() (interface{}, error) {
+	return TopologyGetMetrics()
+}
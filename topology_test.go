@@ -0,0 +1,42 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExpandHostlist(t *testing.T) {
+	hosts, err := ExpandHostlist("tux[08-10,15],login1,rack[1-2]-n[1-2]")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tux08", "tux09", "tux10", "tux15", "login1", "rack1-n1", "rack1-n2", "rack2-n1", "rack2-n2"}, hosts)
+	_, err = ExpandHostlist("tux[1-")
+	assert.Error(t, err)
+}
+
+func TestTopologyGetMetrics(t *testing.T) {
+	defer useFixtures(fixtureExecutor{
+		"scontrol show topology": "test_data/scontrol_topology.txt",
+		"sinfo -h -N -o %n|%T":   "test_data/sinfo_node_states.txt",
+	})()
+	tm, err := TopologyGetMetrics()
+	assert.NoError(t, err)
+	// s2 lists no nodes, it has the nodes of s0 and s1
+	assert.Equal(t, map[string]float64{"s0": 4, "s1": 3, "s2": 7}, tm.nodes)
+	assert.Equal(t, map[string]float64{"s0": 2, "s1": 2, "s2": 4}, tm.alloc)
+	assert.Equal(t, "1", tm.level["s2"])
+}
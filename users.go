@@ -16,29 +16,15 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
         "strings"
         "strconv"
         "regexp"
+        "time"
         "github.com/prometheus/client_golang/prometheus"
 )
 
-func UsersData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o %A|%u|%T|%C")
-        stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+func UsersData() ([]byte, error) {
+        return Execute("squeue", PartitionArguments([]string{"-a", "-r", "-h", "-o %A|%u|%T|%C"}))
 }
 
 type UserJobMetrics struct {
@@ -54,6 +40,9 @@ func ParseUsersMetrics(input []byte) map[string]*UserJobMetrics {
         for _, line := range lines {
                 if strings.Contains(line,"|") {
                         user := strings.Split(line,"|")[1]
+                        if !UserSelected(user) {
+                                continue
+                        }
                         _,key := users[user]
                         if !key {
                                 users[user] = &UserJobMetrics{0,0,0,0}
@@ -83,15 +72,24 @@ type UsersCollector struct {
         running *prometheus.Desc
         running_cpus *prometheus.Desc
         suspended *prometheus.Desc
+        // users exported with 0 after their last job
+        pendingSeries *RecentSeries
+        runningSeries *RecentSeries
+        runningCPUsSeries *RecentSeries
+        suspendedSeries *RecentSeries
 }
 
 func NewUsersCollector() *UsersCollector {
         labels := []string{"user"}
         return &UsersCollector {
-                pending: prometheus.NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil), 
-                running: prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
-                running_cpus: prometheus.NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
-                suspended: prometheus.NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
+                pending: NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil), 
+                running: NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
+                running_cpus: NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
+                suspended: NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
+                pendingSeries: NewRecentSeries(),
+                runningSeries: NewRecentSeries(),
+                runningCPUsSeries: NewRecentSeries(),
+                suspendedSeries: NewRecentSeries(),
         }
 }
 
@@ -102,21 +100,53 @@ func (uc *UsersCollector) Describe(ch chan<- *prometheus.Desc) {
         ch <- uc.suspended
 }
 
-func (uc *UsersCollector) Collect(ch chan<- prometheus.Metric) {
-        um := ParseUsersMetrics(UsersData())
+func (uc *UsersCollector) Update(ch chan<- prometheus.Metric) error {
+        data, err := UsersData()
+        if err != nil {
+                return err
+        }
+        um := ParseUsersMetrics(data)
+        pending := make(map[string]float64)
+        running := make(map[string]float64)
+        running_cpus := make(map[string]float64)
+        suspended := make(map[string]float64)
         for u := range um {
                 if um[u].pending > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.pending, prometheus.GaugeValue, um[u].pending, u)
+                        pending[u] = um[u].pending
                 }
                 if um[u].running > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.running, prometheus.GaugeValue, um[u].running, u)
+                        running[u] = um[u].running
                 }
                 if um[u].running_cpus > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.running_cpus, prometheus.GaugeValue, um[u].running_cpus, u)
+                        running_cpus[u] = um[u].running_cpus
                 }
                 if um[u].suspended > 0 {
-                        ch <- prometheus.MustNewConstMetric(uc.suspended, prometheus.GaugeValue, um[u].suspended, u)
+                        suspended[u] = um[u].suspended
                 }
         }
+        // the number of users per metric may be limited, see LimitUsers
+        now := time.Now()
+        for u, v := range LimitUsers(uc.pendingSeries.Fill(now, pending)) {
+                ch <- prometheus.MustNewConstMetric(uc.pending, prometheus.GaugeValue, v, u)
+        }
+        for u, v := range LimitUsers(uc.runningSeries.Fill(now, running)) {
+                ch <- prometheus.MustNewConstMetric(uc.running, prometheus.GaugeValue, v, u)
+        }
+        for u, v := range LimitUsers(uc.runningCPUsSeries.Fill(now, running_cpus)) {
+                ch <- prometheus.MustNewConstMetric(uc.running_cpus, prometheus.GaugeValue, v, u)
+        }
+        for u, v := range LimitUsers(uc.suspendedSeries.Fill(now, suspended)) {
+                ch <- prometheus.MustNewConstMetric(uc.suspended, prometheus.GaugeValue, v, u)
+        }
+        return nil
 }
 
+// Parse returns the jobs per user as parsed from squeue, before the user
+// metrics limit, see DebugParser
+func (uc *UsersCollector) Parse() (interface{}, error) {
+        data, err := UsersData()
+        if err != nil {
+                return nil, err
+        }
+        return ParseUsersMetrics(data), nil
+}
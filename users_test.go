@@ -0,0 +1,34 @@
+/* Copyright 2020 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseUsersMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_users.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	users := ParseUsersMetrics(data)
+	assert.Equal(t, UserJobMetrics{pending: 1, running: 1, running_cpus: 8}, *users["alice"])
+	// every element of a job array is counted, as printed by squeue -r
+	assert.Equal(t, UserJobMetrics{pending: 3, running: 2, running_cpus: 4}, *users["bob"])
+	assert.Equal(t, UserJobMetrics{suspended: 1}, *users["carol"])
+}
@@ -0,0 +1,166 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NewTLSConfig returns the TLS configuration of the HTTP server. With a
+// client CA, clients have to present a certificate signed by this CA.
+func NewTLSConfig(clientCA string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", clientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// LoadBasicAuthPassword reads the password of the HTTP basic authentication
+// from a file, a trailing newline is removed. The password is not passed as
+// flag, which every user could read in the process list.
+func LoadBasicAuthPassword(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("%s: empty password", file)
+	}
+	return password, nil
+}
+
+// BasicAuthHandler requires the user and password of the HTTP basic
+// authentication for every request to the handler. The credentials are
+// compared as hashes in constant time, so that the response time reveals
+// neither the credentials nor their length.
+func BasicAuthHandler(user string, password string, handler http.Handler) http.Handler {
+	userHash := sha256.Sum256([]byte(user))
+	passwordHash := sha256.Sum256([]byte(password))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		givenUser := sha256.Sum256([]byte(u))
+		givenPassword := sha256.Sum256([]byte(p))
+		userOk := subtle.ConstantTimeCompare(givenUser[:], userHash[:])
+		passwordOk := subtle.ConstantTimeCompare(givenPassword[:], passwordHash[:])
+		if !ok || userOk&passwordOk != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Slurm Exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Time to wait on shutdown for the scrapes in flight and their commands
+const shutdownTimeout = 10 * time.Second
+
+// LandingHandler responds to "/" with a page linking to the metrics, other
+// paths are not found
+func LandingHandler(telemetryPath string) http.Handler {
+	page := fmt.Sprintf(`<html>
+<head><title>Slurm Exporter</title></head>
+<body>
+<h1>Slurm Exporter</h1>
+<p><a href="%s">Metrics</a></p>
+<p><a href="/health">Health</a></p>
+</body>
+</html>
+`, html.EscapeString(telemetryPath))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	})
+}
+
+// ListenAndServe serves HTTP, or HTTPS if a certificate and key are given,
+// on the address of the server. Once the server is shut down, it returns
+// http.ErrServerClosed.
+func ListenAndServe(server *http.Server, certFile string, keyFile string, clientCA string) error {
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return fmt.Errorf("a client CA requires a TLS certificate and key")
+		}
+		return server.ListenAndServe()
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	config, err := NewTLSConfig(clientCA)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = config
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// GracefulShutdown shuts down the server on SIGTERM or SIGINT, e.g. on a
+// restart by systemd. The server stops accepting scrapes, the running Slurm
+// commands are killed, which fails the scrapes in flight instead of leaving
+// orphaned commands behind, and the scrapes are waited for up to the
+// shutdown timeout. The returned channel is closed once the server is shut
+// down.
+func GracefulShutdown(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer close(done)
+		sig := <-signals
+		signal.Stop(signals)
+		slog.Info("Shutting down", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(ctx) }()
+		if !StopCommands(ctx) {
+			slog.Warn("Slurm commands still running on shutdown")
+		}
+		if err := <-shutdown; err != nil {
+			slog.Warn("Failed to shut down the HTTP server", "err", err)
+		}
+	}()
+	return done
+}
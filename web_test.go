@@ -0,0 +1,187 @@
+/* Copyright 2021 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	config, err := NewTLSConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("Client certificates required without client CA")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "slurm-exporter-test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "slurm-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err = NewTLSConfig(ca)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("Client certificates not required with client CA")
+	}
+
+	if _, err := NewTLSConfig(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("Expected an error for a missing client CA")
+	}
+}
+
+func TestListenAndServeIncompleteTLS(t *testing.T) {
+	if err := ListenAndServe(&http.Server{Addr: "127.0.0.1:0"}, "cert.pem", "", ""); err == nil {
+		t.Errorf("Expected an error for a certificate without key")
+	}
+	if err := ListenAndServe(&http.Server{Addr: "127.0.0.1:0"}, "", "", "ca.pem"); err == nil {
+		t.Errorf("Expected an error for a client CA without certificate")
+	}
+}
+
+func TestLandingHandler(t *testing.T) {
+	handler := LandingHandler("/slurm/metrics")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<a href="/slurm/metrics">`) {
+		t.Errorf("Unexpected landing page %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown path, got %d", rec.Code)
+	}
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slurm-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	password, err := LoadBasicAuthPassword(file)
+	if err != nil || password != "s3cret" {
+		t.Fatalf("Unexpected password %q: %v", password, err)
+	}
+	if err := ioutil.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBasicAuthPassword(file); err == nil {
+		t.Errorf("Expected an error for an empty password")
+	}
+
+	handler := BasicAuthHandler("prometheus", password, LandingHandler("/metrics"))
+	for _, c := range []struct {
+		user, password string
+		code           int
+	}{
+		{"prometheus", "s3cret", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"other", "s3cret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("Expected %d for %q:%q, got %d", c.code, c.user, c.password, rec.Code)
+		}
+		if c.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("No WWW-Authenticate header for %q:%q", c.user, c.password)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	defer func() { commandsContext, cancelCommands = context.WithCancel(context.Background()) }()
+
+	server := &http.Server{Addr: "127.0.0.1:0"}
+	done := GracefulShutdown(server)
+	served := make(chan error, 1)
+	go func() { served <- ListenAndServe(server, "", "", "") }()
+	executed := make(chan error, 1)
+	go func() {
+		_, err := Execute("sleep", []string{"10"})
+		executed <- err
+	}()
+	for runningCommands.count() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-executed; err == nil {
+		t.Errorf("Expected an error for a command killed on shutdown")
+	}
+	<-done
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Unexpected error of the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Shutdown took %s", elapsed)
+	}
+	if _, err := Execute("true", nil); err == nil {
+		t.Errorf("Expected an error for a command after the shutdown")
+	}
+}